@@ -0,0 +1,344 @@
+package main
+
+import (
+  "bytes"
+  "encoding/binary"
+  "fmt"
+  "hash/crc32"
+  "io"
+  "os"
+  "strconv"
+)
+
+const (
+  checkpointMagic = "TSBSKTCH" // first 8 bytes of every checkpoint
+  checkpointVersion = 1
+  checkpointFlagDFT = 1
+  checkpointFlagStream = 2
+)
+
+/* Sketch state saved by a checkpoint: parameters, location index, statistics of the retained basic windows of every
+   series and pair, and the correlations of the last query */
+type SketchCheckpoint struct {
+  granularity int
+  isDFT bool
+  ratio float64
+  energy float64
+  halfLife float64
+  locations []int
+  latitudes []int
+  longitudes []int
+  seriesSketches []SeriesSketch
+  pairWindowsMap map[Pair]BasicWindowResult
+  pairWindowsMapDFT map[Pair]BasicWindowDFTResult
+  accurateMatrix [][]float64
+  stream *StreamCheckpoint // nil for the in-memory mode
+}
+
+/* State of a stream besides its sketch, so that a restored engine continues at the next observation */
+type StreamCheckpoint struct {
+  observed int
+  filled int
+  windowsClosed int
+  climatologyBefore int // see prepareDataset, values read after a restore get the climatology of the sketched ones
+  window [][]float64 // values of the open basic window, one series per location
+  seriesAggregates []SeriesAggregate
+  pairAggregates []PairAggregate // aligned with the pairs ordered by row
+  seriesDFTs [][][]complex128    // for "d", the spectra of the retained basic windows, indexed by [row][window]
+}
+
+/* Writes the little-endian fields of a checkpoint, the first error is kept */
+type CheckpointWriter struct {
+  writer io.Writer
+  err error
+}
+
+/* Reads the fields written by CheckpointWriter from the bytes of a checkpoint, the first error is kept */
+type CheckpointReader struct {
+  reader *bytes.Reader
+  err error
+}
+
+func (cw *CheckpointWriter) write(data interface{}) {
+  if cw.err == nil {
+    cw.err = binary.Write(cw.writer, binary.LittleEndian, data)
+  }
+}
+
+func (cw *CheckpointWriter) writeInt(value int) {
+  cw.write(int64(value))
+}
+
+func (cr *CheckpointReader) read(data interface{}) {
+  if cr.err == nil {
+    cr.err = binary.Read(cr.reader, binary.LittleEndian, data)
+  }
+}
+
+func (cr *CheckpointReader) readInt() int {
+  var value int64
+  cr.read(&value)
+  return int(value)
+}
+
+/* Read n floats, n is checked against the remaining bytes so that a corrupt count fails instead of allocating */
+func (cr *CheckpointReader) readFloats(n int) []float64 {
+  if n < 0 || n > cr.reader.Len() / 8 {
+    if cr.err == nil {
+      cr.err = fmt.Errorf("invalid length %d", n)
+    }
+    return nil
+  }
+  values := make([]float64, n)
+  cr.read(values)
+  return values
+}
+
+/* Pairs of the locations ordered by row, the order of the pair statistics in a checkpoint */
+func getPairsOfLocations(locations []int) []Pair {
+  var pairs []Pair
+  for i := range locations {
+    for j := i + 1; j < len(locations); j += 1 {
+      pairs = append(pairs, Pair{locations[i], locations[j], i, j})
+    }
+  }
+  return pairs
+}
+
+/* Write a checkpoint to fileName. The file is replaced at once, an interrupted write leaves the previous checkpoint */
+func writeCheckpoint(fileName string, checkpoint *SketchCheckpoint) {
+  var buffer bytes.Buffer
+  cw := CheckpointWriter{writer: &buffer}
+  buffer.WriteString(checkpointMagic)
+  cw.write(uint32(checkpointVersion))
+  var flags uint8
+  if checkpoint.isDFT {
+    flags |= checkpointFlagDFT
+  }
+  if checkpoint.stream != nil {
+    flags |= checkpointFlagStream
+  }
+  cw.write(flags)
+  cw.writeInt(checkpoint.granularity)
+  cw.write(checkpoint.ratio)
+  cw.write(checkpoint.energy)
+  cw.write(checkpoint.halfLife)
+
+  // Location index
+  locationsNum := len(checkpoint.locations)
+  cw.writeInt(locationsNum)
+  for row := range checkpoint.locations {
+    cw.writeInt(checkpoint.locations[row])
+    cw.writeInt(checkpoint.latitudes[row])
+    cw.writeInt(checkpoint.longitudes[row])
+  }
+
+  // Sketch
+  numberOfBasicwindows := len(*checkpoint.seriesSketches[0].slicesOfMean)
+  cw.writeInt(numberOfBasicwindows)
+  for _, seriesSketch := range checkpoint.seriesSketches {
+    cw.write(*seriesSketch.slicesOfMean)
+    cw.write(*seriesSketch.slicesOfSigma)
+    cw.write(*seriesSketch.slicesOfSumSquared)
+    cw.write(*seriesSketch.slicesOfCount)
+  }
+  pairs := getPairsOfLocations(checkpoint.locations)
+  for _, pair := range pairs {
+    if !checkpoint.isDFT {
+      cw.write(*checkpoint.pairWindowsMap[pair].slicesOfCXY)
+    } else {
+      bwrdft := checkpoint.pairWindowsMapDFT[pair]
+      cw.write(*bwrdft.slicesOfDXY)
+      cw.write(*bwrdft.slicesOfBound)
+    }
+  }
+  for row := range checkpoint.accurateMatrix {
+    cw.write(checkpoint.accurateMatrix[row])
+  }
+
+  // Stream
+  if stream := checkpoint.stream; stream != nil {
+    cw.writeInt(stream.observed)
+    cw.writeInt(stream.filled)
+    cw.writeInt(stream.windowsClosed)
+    cw.writeInt(stream.climatologyBefore)
+    for row := range stream.window {
+      cw.write(stream.window[row])
+    }
+    for _, aggregate := range stream.seriesAggregates {
+      cw.write([]float64{aggregate.reference, aggregate.count, aggregate.sumDelta, aggregate.sumSquares})
+    }
+    for _, aggregate := range stream.pairAggregates {
+      cw.write(aggregate.sumCross)
+    }
+    if checkpoint.isDFT {
+      for row := range stream.seriesDFTs {
+        for _, coefficients := range stream.seriesDFTs[row] {
+          cw.writeInt(len(coefficients))
+          cw.write(coefficients)
+        }
+      }
+    }
+  }
+  cw.write(crc32.ChecksumIEEE(buffer.Bytes()))
+  if cw.err != nil {
+    panic(cw.err)
+  }
+
+  tmpName := fileName + ".tmp"
+  if err := os.WriteFile(tmpName, buffer.Bytes(), 0644); err != nil {
+    panic(err)
+  }
+  if err := os.Rename(tmpName, fileName); err != nil {
+    panic(err)
+  }
+  fmt.Println(fmt.Sprintf("Checkpoint written to %s: %d locations, %d basic windows, %d bytes", fileName, locationsNum, numberOfBasicwindows, buffer.Len()))
+}
+
+/* Read a checkpoint written by writeCheckpoint */
+func readCheckpoint(fileName string) *SketchCheckpoint {
+  data, err := os.ReadFile(fileName)
+  if err != nil {
+    panic(err)
+  }
+  if len(data) < len(checkpointMagic) + 8 || string(data[:len(checkpointMagic)]) != checkpointMagic {
+    panic(fmt.Sprintf("ERROR: %s is not a checkpoint", fileName))
+  }
+  if crc32.ChecksumIEEE(data[:len(data)-4]) != binary.LittleEndian.Uint32(data[len(data)-4:]) {
+    panic(fmt.Sprintf("ERROR: checkpoint %s is corrupt, its checksum does not match", fileName))
+  }
+  cr := CheckpointReader{reader: bytes.NewReader(data[len(checkpointMagic):len(data)-4])}
+  var version uint32
+  cr.read(&version)
+  if version != checkpointVersion {
+    panic(fmt.Sprintf("ERROR: checkpoint %s has version %d, version %d can be read", fileName, version, checkpointVersion))
+  }
+  var flags uint8
+  cr.read(&flags)
+  checkpoint := SketchCheckpoint{isDFT: flags & checkpointFlagDFT != 0}
+  checkpoint.granularity = cr.readInt()
+  cr.read(&checkpoint.ratio)
+  cr.read(&checkpoint.energy)
+  cr.read(&checkpoint.halfLife)
+
+  // Location index
+  locationsNum := cr.readInt()
+  if cr.err == nil && (locationsNum < 2 || locationsNum > cr.reader.Len() / 24) {
+    cr.err = fmt.Errorf("invalid number of locations %d", locationsNum)
+  }
+  if cr.err != nil {
+    panic(fmt.Sprintf("ERROR: checkpoint %s cannot be read: %v", fileName, cr.err))
+  }
+  checkpoint.locations = make([]int, locationsNum)
+  checkpoint.latitudes = make([]int, locationsNum)
+  checkpoint.longitudes = make([]int, locationsNum)
+  for row := range checkpoint.locations {
+    checkpoint.locations[row] = cr.readInt()
+    checkpoint.latitudes[row] = cr.readInt()
+    checkpoint.longitudes[row] = cr.readInt()
+  }
+
+  // Sketch
+  numberOfBasicwindows := cr.readInt()
+  checkpoint.seriesSketches = make([]SeriesSketch, locationsNum)
+  for row := range checkpoint.seriesSketches {
+    slicesOfMean := cr.readFloats(numberOfBasicwindows)
+    slicesOfSigma := cr.readFloats(numberOfBasicwindows)
+    slicesOfSumSquared := cr.readFloats(numberOfBasicwindows)
+    slicesOfCount := cr.readFloats(numberOfBasicwindows)
+    checkpoint.seriesSketches[row] = SeriesSketch{checkpoint.locations[row], &slicesOfMean, &slicesOfSigma, &slicesOfSumSquared, &slicesOfCount}
+  }
+  pairs := getPairsOfLocations(checkpoint.locations)
+  checkpoint.pairWindowsMap = make(map[Pair]BasicWindowResult)
+  checkpoint.pairWindowsMapDFT = make(map[Pair]BasicWindowDFTResult)
+  for _, pair := range pairs {
+    if !checkpoint.isDFT {
+      slicesOfCXY := cr.readFloats(numberOfBasicwindows)
+      checkpoint.pairWindowsMap[pair] = BasicWindowResult{pair, &slicesOfCXY}
+    } else {
+      slicesOfDXY := cr.readFloats(numberOfBasicwindows)
+      slicesOfBound := cr.readFloats(numberOfBasicwindows)
+      checkpoint.pairWindowsMapDFT[pair] = BasicWindowDFTResult{pair, &slicesOfDXY, &slicesOfBound}
+    }
+  }
+  checkpoint.accurateMatrix = make([][]float64, locationsNum)
+  for row := range checkpoint.accurateMatrix {
+    checkpoint.accurateMatrix[row] = cr.readFloats(locationsNum)
+  }
+
+  // Stream
+  if flags & checkpointFlagStream != 0 {
+    stream := StreamCheckpoint{}
+    stream.observed = cr.readInt()
+    stream.filled = cr.readInt()
+    stream.windowsClosed = cr.readInt()
+    stream.climatologyBefore = cr.readInt()
+    stream.window = make([][]float64, locationsNum)
+    for row := range stream.window {
+      stream.window[row] = cr.readFloats(checkpoint.granularity)
+    }
+    stream.seriesAggregates = make([]SeriesAggregate, locationsNum)
+    for row := range stream.seriesAggregates {
+      values := cr.readFloats(4)
+      if values != nil {
+        stream.seriesAggregates[row] = SeriesAggregate{values[0], values[1], values[2], values[3]}
+      }
+    }
+    stream.pairAggregates = make([]PairAggregate, len(pairs))
+    for n := range stream.pairAggregates {
+      cr.read(&stream.pairAggregates[n].sumCross)
+    }
+    if checkpoint.isDFT {
+      stream.seriesDFTs = make([][][]complex128, locationsNum)
+      for row := range stream.seriesDFTs {
+        stream.seriesDFTs[row] = make([][]complex128, numberOfBasicwindows)
+        for b := range stream.seriesDFTs[row] {
+          N := cr.readInt()
+          if cr.err == nil && (N < 0 || N > checkpoint.granularity || N > cr.reader.Len() / 16) {
+            cr.err = fmt.Errorf("invalid number of coefficients %d", N)
+          }
+          if cr.err != nil {
+            break
+          }
+          stream.seriesDFTs[row][b] = make([]complex128, N)
+          cr.read(stream.seriesDFTs[row][b])
+        }
+      }
+    }
+    checkpoint.stream = &stream
+  }
+  if cr.err == nil && cr.reader.Len() != 0 {
+    cr.err = fmt.Errorf("%d bytes left after the state", cr.reader.Len())
+  }
+  if cr.err != nil {
+    panic(fmt.Sprintf("ERROR: checkpoint %s cannot be read: %v", fileName, cr.err))
+  }
+  fmt.Println(fmt.Sprintf("Checkpoint read from %s: %d locations, %d basic windows", fileName, locationsNum, numberOfBasicwindows))
+  return &checkpoint
+}
+
+/* A checkpoint can only be restored with the parameters of its sketch, thres may change */
+func (checkpoint *SketchCheckpoint) checkParameters(granularity int, isDFT bool, ratio float64, energy float64, halfLife float64) {
+  if checkpoint.granularity != granularity || checkpoint.isDFT != isDFT {
+    panic(fmt.Sprintf("ERROR: the checkpoint was sketched with granularity %d and DFT %t", checkpoint.granularity, checkpoint.isDFT))
+  }
+  if isDFT && (checkpoint.ratio != ratio || checkpoint.energy != energy) {
+    panic(fmt.Sprintf("ERROR: the checkpoint was sketched with ratio %v and energy %v", checkpoint.ratio, checkpoint.energy))
+  }
+  if checkpoint.halfLife != halfLife {
+    panic(fmt.Sprintf("ERROR: the checkpoint was sketched with half-life %v", checkpoint.halfLife))
+  }
+}
+
+/* Parse the number of closed basic windows between checkpoints of a stream, checkpointevery=<n>. 0 (default) only
+   writes the checkpoint when the stream ends */
+func parseCheckpointEvery(options map[string]string) int {
+  if options["checkpointevery"] == "" {
+    return 0
+  }
+  intVal, err := strconv.Atoi(options["checkpointevery"])
+  if err != nil || intVal <= 0 {
+    panic("Invalid checkpoint interval: " + options["checkpointevery"])
+  }
+  return intVal
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+  "encoding/binary"
+  "fmt"
+  "hash/crc32"
+  "os"
+  "path/filepath"
+  "reflect"
+  "strings"
+  "testing"
+)
+
+/* Helper function: the state of a stream of dataset after pushing extra observations, or of its sketch only when
+   inMemory is set */
+func getTestCheckpoint(dataset *Dataset, extra int, isDFT bool, halfLife float64, inMemory bool) *SketchCheckpoint {
+  const granularity, thres, ratio = 16, 0.5, 0.5
+  sketched := dataset.subsequence(0, dataset.length() - extra)
+  engine := newStreamEngine(sketched, granularity, thres, isDFT, ratio, 0, halfLife)
+  engine.climatologyBefore = sketched.length()
+  observation := make([]float64, dataset.numOfLocations())
+  for k := sketched.length(); k < dataset.length(); k += 1 {
+    for row := range observation {
+      observation[row] = dataset.at(row, k)
+    }
+    engine.push(observation)
+  }
+  checkpoint := engine.getCheckpoint()
+  if inMemory {
+    checkpoint.stream = nil
+  }
+  return checkpoint
+}
+
+/* Write and read back the checkpoints of in-memory and streaming sketches of "t" and "d" */
+func TestCheckpointRoundTrip(t *testing.T) {
+  dataset := newWalksDataset(4, 10 * 16 + 5, 19)
+  tests := []struct {
+    isDFT bool
+    halfLife float64
+    inMemory bool
+    extra int // observations pushed after the sketch
+  }{
+    {false, 0, true, 0},
+    {true, 0, true, 0},
+    {false, 0, false, 21},
+    {false, 40, false, 16},
+    {true, 0, false, 37},
+  }
+  for _, test := range tests {
+    fileName := filepath.Join(t.TempDir(), "sketch.ckpt")
+    checkpoint := getTestCheckpoint(dataset, test.extra, test.isDFT, test.halfLife, test.inMemory)
+    writeCheckpoint(fileName, checkpoint)
+    read := readCheckpoint(fileName)
+    if !reflect.DeepEqual(read, checkpoint) {
+      t.Errorf("dft %v, half-life %v, in memory %v: the checkpoint read differs from the one written", test.isDFT, test.halfLife, test.inMemory)
+    }
+    if _, err := os.Stat(fileName + ".tmp"); !os.IsNotExist(err) {
+      t.Errorf("dft %v, half-life %v, in memory %v: the temporary file is left", test.isDFT, test.halfLife, test.inMemory)
+    }
+  }
+}
+
+/* Helper function: the panic message of readCheckpoint, "" if it reads the file */
+func readCheckpointError(fileName string) (message string) {
+  defer func() {
+    if r := recover(); r != nil {
+      message = fmt.Sprint(r)
+    }
+  }()
+  readCheckpoint(fileName)
+  return ""
+}
+
+/* A damaged checkpoint is rejected: a flipped byte fails the checksum, and a checkpoint with a valid checksum is still
+   checked for its magic, version and lengths */
+func TestCheckpointCorrupt(t *testing.T) {
+  dataset := newWalksDataset(3, 4 * 16, 23)
+  fileName := filepath.Join(t.TempDir(), "sketch.ckpt")
+  writeCheckpoint(fileName, getTestCheckpoint(dataset, 9, true, 0, false))
+  data, err := os.ReadFile(fileName)
+  if err != nil {
+    t.Fatal(err)
+  }
+  withChecksum := func(data []byte) []byte {
+    return binary.LittleEndian.AppendUint32(data, crc32.ChecksumIEEE(data))
+  }
+  body := append([]byte(nil), data[:len(data)-4]...)
+  tests := []struct {
+    name string
+    damage func() []byte
+    message string
+  }{
+    {"flipped byte", func() []byte {
+      damaged := append([]byte(nil), data...)
+      damaged[len(damaged)/2] ^= 0x10
+      return damaged
+    }, "corrupt"},
+    {"flipped checksum", func() []byte {
+      damaged := append([]byte(nil), data...)
+      damaged[len(damaged)-1] ^= 0x01
+      return damaged
+    }, "corrupt"},
+    {"truncated", func() []byte {
+      return data[:len(data)-9]
+    }, "corrupt"},
+    {"empty", func() []byte {
+      return nil
+    }, "not a checkpoint"},
+    {"magic", func() []byte {
+      damaged := append([]byte(nil), body...)
+      damaged[0] = 'X'
+      return withChecksum(damaged)
+    }, "not a checkpoint"},
+    {"version", func() []byte {
+      damaged := append([]byte(nil), body...)
+      binary.LittleEndian.PutUint32(damaged[len(checkpointMagic):], checkpointVersion + 1)
+      return withChecksum(damaged)
+    }, "version"},
+    {"truncated state", func() []byte {
+      return withChecksum(append([]byte(nil), body[:len(body)-8]...))
+    }, "cannot be read"},
+    {"trailing bytes", func() []byte {
+      return withChecksum(append(append([]byte(nil), body...), 0))
+    }, "cannot be read"},
+  }
+  for _, test := range tests {
+    damagedName := filepath.Join(t.TempDir(), "damaged.ckpt")
+    if err := os.WriteFile(damagedName, test.damage(), 0644); err != nil {
+      t.Fatal(err)
+    }
+    if message := readCheckpointError(damagedName); !strings.Contains(message, test.message) {
+      t.Errorf("%s: read fails with %q, expected %q", test.name, message, test.message)
+    }
+  }
+  if message := readCheckpointError(fileName); message != "" {
+    t.Errorf("the checkpoint is rejected: %s", message)
+  }
+}
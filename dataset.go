@@ -0,0 +1,294 @@
+package main
+
+import (
+  "fmt"
+  "math"
+  "sort"
+)
+
+const maxReportedLocations = 20 // locations with missing values printed before only counting them
+
+/* Columnar in-memory store of all loaded series, row i is the i-th location */
+type Dataset struct {
+  locations []int         // row -> location
+  indexOfLocation map[int]int // location -> row
+  latitudes []int         // row -> latitude
+  longitudes []int        // row -> longitude
+  timestamps []int        // time axis shared by all series
+  values [][]float64      // row -> series, nil when stored in single precision
+  values32 [][]float32    // row -> series in single precision
+  singlePrecision bool
+}
+
+/* Create an empty dataset */
+func newDataset(singlePrecision bool) *Dataset {
+  return &Dataset{indexOfLocation: make(map[int]int), singlePrecision: singlePrecision}
+}
+
+/* Append a series of given length filled with NaN, returns its row */
+func (dataset *Dataset) addLocation(location int, latitude int, longitude int, length int) int {
+  row := len(dataset.locations)
+  dataset.locations = append(dataset.locations, location)
+  dataset.indexOfLocation[location] = row
+  dataset.latitudes = append(dataset.latitudes, latitude)
+  dataset.longitudes = append(dataset.longitudes, longitude)
+  if dataset.singlePrecision {
+    series := make([]float32, length)
+    for k := range series {
+      series[k] = float32(math.NaN())
+    }
+    dataset.values32 = append(dataset.values32, series)
+  } else {
+    series := make([]float64, length)
+    for k := range series {
+      series[k] = math.NaN()
+    }
+    dataset.values = append(dataset.values, series)
+  }
+  return row
+}
+
+/* Number of loaded locations */
+func (dataset *Dataset) numOfLocations() int {
+  return len(dataset.locations)
+}
+
+/* Length of the time axis */
+func (dataset *Dataset) length() int {
+  return len(dataset.timestamps)
+}
+
+/* Get the series of a row. Single precision series are converted into buf, which is reused between calls */
+func (dataset *Dataset) series(row int, buf *([]float64)) []float64 {
+  if !dataset.singlePrecision {
+    return dataset.values[row]
+  }
+  series32 := dataset.values32[row]
+  if cap(*buf) < len(series32) {
+    *buf = make([]float64, len(series32))
+  }
+  *buf = (*buf)[:len(series32)]
+  for k, val := range series32 {
+    (*buf)[k] = float64(val)
+  }
+  return *buf
+}
+
+/* Get one value */
+func (dataset *Dataset) at(row int, k int) float64 {
+  if dataset.singlePrecision {
+    return float64(dataset.values32[row][k])
+  }
+  return dataset.values[row][k]
+}
+
+/* Set one value */
+func (dataset *Dataset) set(row int, k int, val float64) {
+  if dataset.singlePrecision {
+    dataset.values32[row][k] = float32(val)
+  } else {
+    dataset.values[row][k] = val
+  }
+}
+
+/* Grow every series to the given length, new values are NaN */
+func (dataset *Dataset) grow(length int) {
+  for row := range dataset.locations {
+    if dataset.singlePrecision {
+      series := make([]float32, length)
+      copy(series, dataset.values32[row])
+      for k := len(dataset.values32[row]); k < length; k += 1 {
+        series[k] = float32(math.NaN())
+      }
+      dataset.values32[row] = series
+    } else {
+      series := make([]float64, length)
+      copy(series, dataset.values[row])
+      for k := len(dataset.values[row]); k < length; k += 1 {
+        series[k] = math.NaN()
+      }
+      dataset.values[row] = series
+    }
+  }
+}
+
+/* Cut every series and the time axis to the given length */
+func (dataset *Dataset) truncate(length int) {
+  for row := range dataset.locations {
+    if dataset.singlePrecision {
+      dataset.values32[row] = dataset.values32[row][:length]
+    } else {
+      dataset.values[row] = dataset.values[row][:length]
+    }
+  }
+  if len(dataset.timestamps) > length {
+    dataset.timestamps = dataset.timestamps[:length]
+  }
+}
+
+/* Get a dataset with the rows of the given locations in their order, the series are shared with dataset */
+func (dataset *Dataset) selectLocations(locations []int) *Dataset {
+  selected := newDataset(dataset.singlePrecision)
+  selected.timestamps = dataset.timestamps
+  for _, location := range locations {
+    row, ok := dataset.indexOfLocation[location]
+    if !ok {
+      panic(fmt.Sprintf("ERROR: location %d is not loaded", location))
+    }
+    selected.indexOfLocation[location] = len(selected.locations)
+    selected.locations = append(selected.locations, location)
+    selected.latitudes = append(selected.latitudes, dataset.latitudes[row])
+    selected.longitudes = append(selected.longitudes, dataset.longitudes[row])
+    if dataset.singlePrecision {
+      selected.values32 = append(selected.values32, dataset.values32[row])
+    } else {
+      selected.values = append(selected.values, dataset.values[row])
+    }
+  }
+  return selected
+}
+
+/* Get the values of timestamps start to end - 1 of every series, the series are shared with dataset */
+func (dataset *Dataset) subsequence(start int, end int) *Dataset {
+  selected := dataset.selectLocations(dataset.locations)
+  selected.timestamps = dataset.timestamps[start:end]
+  for row := range selected.locations {
+    if selected.singlePrecision {
+      selected.values32[row] = selected.values32[row][start:end]
+    } else {
+      selected.values[row] = selected.values[row][start:end]
+    }
+  }
+  return selected
+}
+
+/* Reorder rows by ascending location, so that row i is the same location in every run */
+func (dataset *Dataset) sortByLocation() {
+  rows := make([]int, dataset.numOfLocations())
+  for row := range rows {
+    rows[row] = row
+  }
+  sort.Slice(rows, func(a, b int) bool {
+    return dataset.locations[rows[a]] < dataset.locations[rows[b]]
+  })
+  locations := make([]int, len(rows))
+  latitudes := make([]int, len(rows))
+  longitudes := make([]int, len(rows))
+  values := make([][]float64, len(dataset.values))
+  values32 := make([][]float32, len(dataset.values32))
+  for newRow, row := range rows {
+    locations[newRow] = dataset.locations[row]
+    latitudes[newRow] = dataset.latitudes[row]
+    longitudes[newRow] = dataset.longitudes[row]
+    if dataset.singlePrecision {
+      values32[newRow] = dataset.values32[row]
+    } else {
+      values[newRow] = dataset.values[row]
+    }
+    dataset.indexOfLocation[locations[newRow]] = newRow
+  }
+  dataset.locations = locations
+  dataset.latitudes = latitudes
+  dataset.longitudes = longitudes
+  dataset.values = values
+  dataset.values32 = values32
+}
+
+/* Check that a stored location index maps every row to the same location as the dataset */
+func (dataset *Dataset) matchesIndex(locations []int) bool {
+  if len(locations) != dataset.numOfLocations() {
+    return false
+  }
+  for row, location := range locations {
+    if dataset.locations[row] != location {
+      return false
+    }
+  }
+  return true
+}
+
+/* Helper function: whether a value is missing, missing values are NaN (infinite values are treated alike) */
+func isMissing(val float64) bool {
+  return math.IsNaN(val) || math.IsInf(val, 0)
+}
+
+/* Fill the missing values of every series by linear interpolation between the nearest valid values, the values before
+   the first and after the last valid one take its value. Window statistics, cross terms and DFTs assume complete
+   series, a single gap would turn every correlation of its location into NaN. Returns the locations without any valid
+   value, they are left unchanged */
+func fillMissingValues(dataset *Dataset) []int {
+  var emptyLocations []int
+  var buf []float64
+  numOfFilled, locationsWithGaps := 0, 0
+  for row, location := range dataset.locations {
+    series := dataset.series(row, &buf)
+    last := -1 // index of the last valid value
+    filled := 0
+    for k, val := range series {
+      if isMissing(val) {
+        continue
+      }
+      for gap := last + 1; gap < k; gap += 1 {
+        if last < 0 {
+          dataset.set(row, gap, val)
+        } else {
+          dataset.set(row, gap, series[last] + (val - series[last]) * float64(gap - last) / float64(k - last))
+        }
+      }
+      filled += k - last - 1
+      last = k
+    }
+    if last < 0 {
+      emptyLocations = append(emptyLocations, location)
+      continue
+    }
+    for gap := last + 1; gap < len(series); gap += 1 {
+      dataset.set(row, gap, series[last])
+    }
+    filled += len(series) - last - 1
+    if filled == 0 {
+      continue
+    }
+    if locationsWithGaps < maxReportedLocations {
+      fmt.Println(fmt.Sprintf("Location %d: %d missing values filled", location, filled))
+    }
+    locationsWithGaps += 1
+    numOfFilled += filled
+  }
+  if locationsWithGaps > 0 {
+    fmt.Println(fmt.Sprintf("Missing values: %d values of %d locations filled by interpolation", numOfFilled, locationsWithGaps))
+  }
+  return emptyLocations
+}
+
+/* Drop the locations without any valid value, see fillMissingValues */
+func dropEmptyLocations(dataset *Dataset, emptyLocations []int) *Dataset {
+  if len(emptyLocations) == 0 {
+    return dataset
+  }
+  isEmpty := make(map[int]bool, len(emptyLocations))
+  for _, location := range emptyLocations {
+    isEmpty[location] = true
+    fmt.Println(fmt.Sprintf("Location %d: no valid values, dropped", location))
+  }
+  var locations []int
+  for _, location := range dataset.locations {
+    if !isEmpty[location] {
+      locations = append(locations, location)
+    }
+  }
+  return dataset.selectLocations(locations)
+}
+
+/* Size of the stored values in bytes */
+func (dataset *Dataset) sizeInBytes() int {
+  if dataset.singlePrecision {
+    return 4 * dataset.numOfLocations() * dataset.length()
+  }
+  return 8 * dataset.numOfLocations() * dataset.length()
+}
+
+/* String representation of the dataset */
+func displayDataset(dataset *Dataset) {
+  fmt.Println(fmt.Sprintf("Dataset: %d locations, %d timestamps, %d bytes", dataset.numOfLocations(), dataset.length(), dataset.sizeInBytes()))
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+  "database/sql"
+  "fmt"
+  "strconv"
+  "strings"
+)
+
+/* Basic windows of a stored sketch. The rows written when sketching hold windows [0, stored), updates write the later
+   windows (and the completed trailing partial one) to the update tables, one row per window, and expire the oldest.
+   The sketch retains windows [first, end) */
+type StoredWindows struct {
+  stored int
+  first int
+  end int
+}
+
+/* Statistic of one basic window read from an update table */
+type WindowValue struct {
+  window int
+  value float64
+}
+
+/* Number of retained basic windows */
+func (windows *StoredWindows) retained() int {
+  return windows.end - windows.first
+}
+
+/* Get the range of stored basic windows of a query, queryStart and queryEnd are relative to the retained windows */
+func (windows *StoredWindows) getQueryRange(queryStart int, queryEnd int) (int, int) {
+  queryStart, queryEnd = getQueryRange(queryStart, queryEnd, windows.retained())
+  return windows.first + queryStart, windows.first + queryEnd
+}
+
+/* Create the update table of a pair table */
+func createUpdateTable(db *sql.DB, tableName string, isDFT bool) {
+  if !isDFT {
+    createTable(db, tableName + updatetablesuffix, pairsupdateschema)
+  } else {
+    createTable(db, tableName + updatetablesuffix, pairsdftupdateschema)
+  }
+}
+
+/* Create the tables that keep the updates of the series and the state of the sketch */
+func createSketchState(db *sql.DB, numberOfBasicwindows int) {
+  createTable(db, seriestablename + updatetablesuffix, seriesupdateschema)
+  createTable(db, statetablename, stateschema)
+  sqlStatement := fmt.Sprintf("INSERT INTO %s %s VALUES (%d, 0, %d);", statetablename, stateheader, numberOfBasicwindows, numberOfBasicwindows)
+  execDB(db, &sqlStatement)
+}
+
+/* Delete the tables of createSketchState */
+func deleteSketchState(db *sql.DB) {
+  deleteTable(db, seriestablename + updatetablesuffix)
+  deleteTable(db, statetablename)
+}
+
+/* Read the basic windows of the stored sketch */
+func querySketchState(db *sql.DB) StoredWindows {
+  var windows StoredWindows
+  sqlStatement := fmt.Sprintf("SELECT stored, firstwindow, endwindow FROM %s", statetablename)
+  err := db.QueryRow(sqlStatement).Scan(&windows.stored, &windows.first, &windows.end)
+  if err != nil {
+    panic(err)
+  }
+  return windows
+}
+
+/* Count the pairs of a table */
+func countStoredPairs(db *sql.DB, tableName string) int {
+  var count int
+  sqlStatement := fmt.Sprintf("SELECT COUNT(*) FROM %s", tableName)
+  if err := db.QueryRow(sqlStatement).Scan(&count); err != nil {
+    panic(err)
+  }
+  return count
+}
+
+/* Write the basic windows of the stored sketch */
+func updateSketchState(db *sql.DB, windows *StoredWindows) {
+  sqlStatement := fmt.Sprintf("UPDATE %s SET firstwindow = %d, endwindow = %d;", statetablename, windows.first, windows.end)
+  execDB(db, &sqlStatement)
+}
+
+/* Helper function: format a statistic of an update row with full precision */
+func formatFloat(value float64) string {
+  return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+/* Insert the statistics of the coming basic windows of every series, the first one is stored window startWindow.
+   A window that was already written is replaced */
+func insertSeriesUpdates(db *sql.DB, seriesSketches *([]SeriesSketch), startWindow int) {
+  var statementSB strings.Builder
+  statementSB.WriteString(fmt.Sprintf("INSERT INTO %s%s %s VALUES ", seriestablename, updatetablesuffix, seriesupdateheader))
+  for row := range *seriesSketches {
+    seriesSketch := &((*seriesSketches)[row])
+    for b := range *seriesSketch.slicesOfMean {
+      if row > 0 || b > 0 {
+        statementSB.WriteString(",")
+      }
+      statementSB.WriteString(fmt.Sprintf(" (%d, %d, %s, %s, %s, %s)", row, startWindow + b,
+        formatFloat((*seriesSketch.slicesOfMean)[b]), formatFloat((*seriesSketch.slicesOfSigma)[b]),
+        formatFloat((*seriesSketch.slicesOfSumSquared)[b]), formatFloat((*seriesSketch.slicesOfCount)[b])))
+    }
+  }
+  statementSB.WriteString(" ON CONFLICT (rowindex, windowindex) DO UPDATE SET mean = EXCLUDED.mean, sigma = EXCLUDED.sigma, sumsquared = EXCLUDED.sumsquared, count = EXCLUDED.count;")
+  insertRowsBWR(db, &statementSB)
+}
+
+/* Replace the statistics of the stored windows [start, end) of every series by their updates, seriesSketches is indexed by row */
+func querySeriesUpdates(db *sql.DB, start int, end int, seriesSketches *([]SeriesSketch)) {
+  sqlStatement := fmt.Sprintf("SELECT rowindex, windowindex, mean, sigma, sumsquared, count FROM %s%s WHERE windowindex >= %d AND windowindex < %d",
+    seriestablename, updatetablesuffix, start, end)
+  rows, err := db.Query(sqlStatement)
+  if err != nil {
+    panic(err)
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var row, window int
+    var mean, sigma, sumSquared, count float64
+    if err = rows.Scan(&row, &window, &mean, &sigma, &sumSquared, &count); err != nil {
+      panic(err)
+    }
+    seriesSketch := &((*seriesSketches)[row])
+    (*seriesSketch.slicesOfMean)[window - start] = mean
+    (*seriesSketch.slicesOfSigma)[window - start] = sigma
+    (*seriesSketch.slicesOfSumSquared)[window - start] = sumSquared
+    (*seriesSketch.slicesOfCount)[window - start] = count
+  }
+}
+
+/* Insert the cross statistics of the coming basic windows of the pairs of one table, the id of a pair is its index in pairs */
+func insertPairUpdates(db *sql.DB, tableName string, pairs []Pair, datasetComing *Dataset, granularity int, isDFT bool,
+  seriesDFTsComing *([][][]complex128), startWindow int, blockSize int) {
+  header := pairsupdateheader
+  column := "cxy"
+  if isDFT {
+    header = pairsdftupdateheader
+    column = "dxy"
+  }
+  blockInsertionSQLStarter := fmt.Sprintf("INSERT INTO %s %s VALUES ", tableName, header)
+  blockInsertionSQLEnder := fmt.Sprintf(" ON CONFLICT (id, windowindex) DO UPDATE SET %s = EXCLUDED.%s;", column, column)
+  if blockSize <= 0 {
+    blockSize = 1
+  }
+  var statementSB strings.Builder
+  var accumulate int = 0
+  for id := range pairs {
+    var slices *([]float64)
+    if !isDFT {
+      var bwr BasicWindowResult
+      getBasicWindowResult(datasetComing, granularity, &pairs[id], &bwr, nil, false, nil)
+      slices = bwr.slicesOfCXY
+    } else {
+      var bwrdft BasicWindowDFTResult
+      getBasicWindowResult(datasetComing, granularity, &pairs[id], nil, &bwrdft, true, seriesDFTsComing)
+      slices = bwrdft.slicesOfDXY
+    }
+    if accumulate == 0 {
+      statementSB.Reset()
+      statementSB.WriteString(blockInsertionSQLStarter)
+    } else {
+      statementSB.WriteString(",")
+    }
+    for b, value := range *slices {
+      if b > 0 {
+        statementSB.WriteString(",")
+      }
+      statementSB.WriteString(fmt.Sprintf(" (%d, %d, %s)", id, startWindow + b, formatFloat(value)))
+    }
+    accumulate += 1
+    if accumulate == blockSize || id == len(pairs) - 1 {
+      statementSB.WriteString(blockInsertionSQLEnder)
+      insertRowsBWR(db, &statementSB)
+      accumulate = 0
+    }
+  }
+}
+
+/* Read the updates of the stored windows [start, end) for the pairs with startID <= id < endID */
+func queryPairUpdates(db *sql.DB, tableName string, startID int, endID int, start int, end int, isDFT bool) map[int][]WindowValue {
+  column := "cxy"
+  if isDFT {
+    column = "dxy"
+  }
+  sqlStatement := fmt.Sprintf("SELECT id, windowindex, %s FROM %s%s WHERE id >= %d AND id < %d AND windowindex >= %d AND windowindex < %d",
+    column, tableName, updatetablesuffix, startID, endID, start, end)
+  rows, err := db.Query(sqlStatement)
+  if err != nil {
+    panic(err)
+  }
+  defer rows.Close()
+  updates := make(map[int][]WindowValue)
+  for rows.Next() {
+    var id int
+    var windowValue WindowValue
+    if err = rows.Scan(&id, &windowValue.window, &windowValue.value); err != nil {
+      panic(err)
+    }
+    updates[id] = append(updates[id], windowValue)
+  }
+  return updates
+}
+
+/* Helper function: replace the values of the slices of windows [start, ...) by their updates */
+func applyWindowValues(slices *([]float64), updates []WindowValue, start int) {
+  for _, windowValue := range updates {
+    (*slices)[windowValue.window - start] = windowValue.value
+  }
+}
+
+/* Delete the updates of the windows before first, the rows written when sketching are left as they are */
+func expireUpdates(db *sql.DB, tableNames []string, first int) {
+  for _, tableName := range tableNames {
+    sqlStatement := fmt.Sprintf("DELETE FROM %s%s WHERE windowindex < %d;", tableName, updatetablesuffix, first)
+    execDB(db, &sqlStatement)
+  }
+  sqlStatement := fmt.Sprintf("DELETE FROM %s%s WHERE windowindex < %d;", seriestablename, updatetablesuffix, first)
+  execDB(db, &sqlStatement)
+}
+
+/* Slide a stored sketch by the values of datasetNew, which follow the values of dataset. Only the statistics of the
+   coming basic windows are written, tableNames[n] holds the pairs of listOfPairs[n] */
+func updateStoredSketch(db *sql.DB, dataset *Dataset, datasetNew *Dataset, granularity int, tableNames []string,
+  listOfPairs [][]Pair, isDFT bool, ratio float64, energy float64, writeBlockSize int) {
+  windows := querySketchState(db)
+  if getNumberOfBasicwindows(dataset, granularity) != windows.end {
+    // The update would write the windows after the loaded values a second time, or leave a gap
+    panic(fmt.Sprintf("ERROR: the loaded values end at basic window %d, the stored sketch at %d: load the values it was last updated with",
+      getNumberOfBasicwindows(dataset, granularity), windows.end))
+  }
+  datasetComing, replaceLast := getComingDataset(dataset, datasetNew, granularity)
+  startWindow := windows.end
+  if replaceLast {
+    startWindow -= 1
+  }
+  seriesSketchesComing := getSeriesSketches(datasetComing, granularity)
+  insertSeriesUpdates(db, &seriesSketchesComing, startWindow)
+  var seriesDFTsComing [][][]complex128
+  if isDFT {
+    seriesDFTsComing = getSeriesDFTsSliding(dataset, datasetNew, granularity, ratio, energy)
+  }
+  for n, tableName := range tableNames {
+    insertPairUpdates(db, tableName + updatetablesuffix, listOfPairs[n], datasetComing, granularity, isDFT, &seriesDFTsComing, startWindow, writeBlockSize)
+  }
+  retained := windows.retained()
+  windows.end = startWindow + getNumberOfBasicwindows(datasetComing, granularity)
+  windows.first = windows.end - retained
+  expireUpdates(db, tableNames, windows.first)
+  updateSketchState(db, &windows)
+  fmt.Println(fmt.Sprintf("Stored sketch: basic windows [%d, %d), %d written by the update", windows.first, windows.end, windows.end - startWindow))
+}
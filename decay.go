@@ -0,0 +1,92 @@
+package main
+
+import (
+  "math"
+  "strconv"
+)
+
+/* Parse the half-life of the exponentially decayed correlations, halflife=<timestamps>, in the units of <granularity>.
+   0 (default) keeps the sliding windows */
+func parseHalfLife(options map[string]string) float64 {
+  if options["halflife"] == "" {
+    return 0
+  }
+  floatVal, err := strconv.ParseFloat(options["halflife"], 64)
+  if err != nil || floatVal <= 0 || math.IsInf(floatVal, 0) {
+    panic("Invalid half-life: " + options["halflife"])
+  }
+  return floatVal
+}
+
+/* Get the weight of a basic window relative to the next one, the weight halves every halfLife timestamps */
+func getDecayFactor(granularity int, halfLife float64) float64 {
+  return math.Pow(0.5, float64(granularity) / halfLife)
+}
+
+/* Multiply the sums of every window by factor */
+func (aggregate *SeriesAggregate) scale(factor float64) {
+  aggregate.count *= factor
+  aggregate.sumDelta *= factor
+  aggregate.sumSquares *= factor
+}
+
+/* Multiply the sums of every window by factor */
+func (aggregate *PairAggregate) scale(factor float64) {
+  aggregate.sumCross *= factor
+}
+
+/* Get the decayed aggregates of every series over all windows of its sketch, the last window has weight 1 */
+func getDecayedSeriesAggregates(seriesSketches *([]SeriesSketch), factor float64) []SeriesAggregate {
+  seriesAggregates := getSeriesAggregates(seriesSketches)
+  for row := range seriesAggregates {
+    seriesSketch := &((*seriesSketches)[row])
+    seriesAggregates[row] = SeriesAggregate{reference: seriesAggregates[row].reference}
+    for b := range *seriesSketch.slicesOfMean {
+      seriesAggregates[row].scale(factor)
+      seriesAggregates[row].add(seriesSketch, b, 1)
+    }
+  }
+  return seriesAggregates
+}
+
+/* Get the decayed aggregate of a pair over all windows of its sketch, the last window has weight 1. Decayed
+   correlations are only kept for "t" */
+func getDecayedPairAggregate(pair *Pair, seriesSketches *([]SeriesSketch), seriesAggregates []SeriesAggregate, slicesOfCXY *([]float64),
+  factor float64) PairAggregate {
+  var aggregate PairAggregate
+  for b := range *slicesOfCXY {
+    aggregate.scale(factor)
+    aggregate.add(&seriesAggregates[pair.indexOfRow], &seriesAggregates[pair.indexOfCol],
+      &((*seriesSketches)[pair.indexOfRow]), &((*seriesSketches)[pair.indexOfCol]), slicesOfCXY, b, 1, false)
+  }
+  return aggregate
+}
+
+/* Decay the aggregate of a series by every coming window and add the window, nothing expires. A replaced last window
+   is removed first and its completed window takes its weight */
+func (aggregate *SeriesAggregate) decay(seriesSketchOld *SeriesSketch, seriesSketchComing *SeriesSketch, replaceLast bool, factor float64) {
+  if replaceLast {
+    aggregate.add(seriesSketchOld, len(*seriesSketchOld.slicesOfMean) - 1, -1)
+  }
+  for b := range *seriesSketchComing.slicesOfMean {
+    if b > 0 || !replaceLast {
+      aggregate.scale(factor)
+    }
+    aggregate.add(seriesSketchComing, b, 1)
+  }
+}
+
+/* Decay the aggregate of a pair like SeriesAggregate.decay */
+func (aggregate *PairAggregate) decay(seriesAggregateX *SeriesAggregate, seriesAggregateY *SeriesAggregate,
+  seriesSketchXOld *SeriesSketch, seriesSketchYOld *SeriesSketch, slicesOfCXYOld *([]float64),
+  seriesSketchXComing *SeriesSketch, seriesSketchYComing *SeriesSketch, slicesOfCXYComing *([]float64), replaceLast bool, factor float64) {
+  if replaceLast {
+    aggregate.add(seriesAggregateX, seriesAggregateY, seriesSketchXOld, seriesSketchYOld, slicesOfCXYOld, len(*slicesOfCXYOld) - 1, -1, false)
+  }
+  for b := range *slicesOfCXYComing {
+    if b > 0 || !replaceLast {
+      aggregate.scale(factor)
+    }
+    aggregate.add(seriesAggregateX, seriesAggregateY, seriesSketchXComing, seriesSketchYComing, slicesOfCXYComing, b, 1, false)
+  }
+}
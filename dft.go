@@ -0,0 +1,509 @@
+package main
+
+import (
+  "fmt"
+  "math"
+  "math/cmplx"
+  "strconv"
+  "time"
+)
+
+/* Precomputed data to transform windows of one length, any length is handled with Bluestein's algorithm */
+type FFTPlan struct {
+  w int                 // window length
+  m int                 // power of two used by the convolution, m >= 2w-1
+  chirp []complex128    // exp(i*pi*k^2/w)
+  chirpFFT []complex128 // FFT of the zero-padded conjugated chirp
+}
+
+/* Sliding DFT of one series, coefficients follow getDFTResult but are not z-normalized */
+type SlidingDFT struct {
+  w int
+  N int
+  window []float64       // ring buffer of the last w values
+  head int               // index of the oldest value in window
+  coefficients []complex128
+  twiddles []complex128  // exp(-i*2*pi*f/w)
+  mean float64
+  m2 float64             // sum of squared deviations of the window
+}
+
+/* Get the smallest power of two not less than n */
+func nextPowerOfTwo(n int) int {
+  m := 1
+  for m < n {
+    m <<= 1
+  }
+  return m
+}
+
+/* In-place radix-2 FFT, len(a) must be a power of two. sign is the sign of the exponent */
+func fftRadix2(a []complex128, sign float64) {
+  n := len(a)
+  // Bit reversal permutation
+  for i, j := 1, 0; i < n; i += 1 {
+    bit := n >> 1
+    for ; j & bit != 0; bit >>= 1 {
+      j ^= bit
+    }
+    j ^= bit
+    if i < j {
+      a[i], a[j] = a[j], a[i]
+    }
+  }
+  for length := 2; length <= n; length <<= 1 {
+    wLength := cmplx.Rect(1, sign * 2 * math.Pi / float64(length))
+    for i := 0; i < n; i += length {
+      var wk complex128 = 1
+      for k := 0; k < length/2; k += 1 {
+        u := a[i+k]
+        v := a[i+k+length/2] * wk
+        a[i+k] = u + v
+        a[i+k+length/2] = u - v
+        wk *= wLength
+      }
+    }
+  }
+}
+
+/* Create a plan for windows of length w */
+func newFFTPlan(w int) *FFTPlan {
+  plan := FFTPlan{w: w, m: nextPowerOfTwo(2*w - 1)}
+  plan.chirp = make([]complex128, w)
+  for k := 0; k < w; k += 1 {
+    // k^2 mod 2w keeps the angle small for long windows
+    plan.chirp[k] = cmplx.Rect(1, math.Pi * float64((k * k) % (2 * w)) / float64(w))
+  }
+  plan.chirpFFT = make([]complex128, plan.m)
+  plan.chirpFFT[0] = cmplx.Conj(plan.chirp[0])
+  for k := 1; k < w; k += 1 {
+    plan.chirpFFT[k] = cmplx.Conj(plan.chirp[k])
+    plan.chirpFFT[plan.m - k] = cmplx.Conj(plan.chirp[k])
+  }
+  fftRadix2(plan.chirpFFT, -1)
+  return &plan
+}
+
+/* Compute sum_i x_i * exp(+i*2*pi*f*i/w) for f < N into result */
+func (plan *FFTPlan) transform(x []float64, N int, result []complex128) {
+  w := plan.w
+  if w & (w - 1) == 0 {
+    a := make([]complex128, w)
+    for i := 0; i < w; i += 1 {
+      a[i] = complex(x[i], 0)
+    }
+    fftRadix2(a, 1)
+    copy(result, a[:N])
+    return
+  }
+  // Bluestein: f*i = (f^2 + i^2 - (f-i)^2) / 2
+  a := make([]complex128, plan.m)
+  for i := 0; i < w; i += 1 {
+    a[i] = complex(x[i], 0) * plan.chirp[i]
+  }
+  fftRadix2(a, -1)
+  for i := range a {
+    a[i] *= plan.chirpFFT[i]
+  }
+  fftRadix2(a, 1)
+  scale := complex(1 / float64(plan.m), 0)
+  for f := 0; f < N; f += 1 {
+    result[f] = a[f] * scale * plan.chirp[f]
+  }
+}
+
+/* Same result as getDFTResult, computed with an FFT */
+func getFFTResult(plan *FFTPlan, sigma float64, avg float64, w int, N int,
+    xs *([]float64), result *([]complex128)) {
+  normalized := make([]float64, w)
+  if sigma == 0 {
+    // A constant window has no shape, all its normalized coefficients are 0
+    for f := 0; f < N; f += 1 {
+      (*result)[f] = 0
+    }
+    return
+  }
+  for i := 0; i < w; i += 1 {
+    normalized[i] = ((*xs)[i] - avg) / sigma
+  }
+  plan.transform(normalized, N, *result)
+  scale := complex(1 / math.Sqrt(float64(w)), 0)
+  for f := 0; f < N; f += 1 {
+    (*result)[f] *= scale
+  }
+}
+
+/* Get mean and sigma of a window, same as the basic window statistics */
+func getWindowMeanSigma(xs []float64) (float64, float64) {
+  var moments Moments
+  for _, x := range xs {
+    moments.addX(x)
+  }
+  return moments.meanX, moments.sigmaX()
+}
+
+/* Number of distinct coefficients of a real window of length w, coefficient w - f is the conjugate of f */
+func getDistinctCoefficientsNum(w int) int {
+  return w/2 + 1
+}
+
+/* Number of coefficients kept for a window of length w with a fixed ratio */
+func getCoefficientsNum(w int, ratio float64) int {
+  N := int(float64(w)*ratio)
+  if N > getDistinctCoefficientsNum(w) {
+    N = getDistinctCoefficientsNum(w)
+  }
+  return N
+}
+
+/* Scale coefficients of getDFTResult (total energy w) so that the full spectrum has energy 1.
+   Coefficient f also stands for its conjugate w - f, the euclidean distance of two scaled spectra is then
+   the distance of the z-normalized windows, and c = 1 - d^2/2 */
+func scaleSpectrum(coefficients []complex128, w int) {
+  for f := range coefficients {
+    weight := 2.0
+    if f == 0 || 2*f == w {
+      weight = 1
+    }
+    coefficients[f] *= complex(math.Sqrt(weight / float64(w)), 0)
+  }
+}
+
+/* Energy of the first n scaled coefficients */
+func getSpectrumEnergy(coefficients []complex128, n int) float64 {
+  var energy float64 = 0
+  for _, coefficient := range coefficients[:n] {
+    energy += real(coefficient)*real(coefficient) + imag(coefficient)*imag(coefficient)
+  }
+  return energy
+}
+
+/* Get the fewest leading coefficients whose energy reaches the target fraction */
+func getCoefficientsNumForEnergy(coefficients []complex128, energy float64) int {
+  var kept float64 = 0
+  for f, coefficient := range coefficients {
+    kept += real(coefficient)*real(coefficient) + imag(coefficient)*imag(coefficient)
+    if kept >= energy {
+      return f + 1
+    }
+  }
+  return len(coefficients)
+}
+
+/* Truncate the spectra of each basic window, indexed by [row][window], to the fewest coefficients reaching the energy
+   in every series. All series keep the same coefficients of a window, so the bound of a pair is at most 2 * (1 - energy) */
+func truncateSpectra(seriesDFTs [][][]complex128, energy float64) {
+  if len(seriesDFTs) == 0 {
+    return
+  }
+  for b := range seriesDFTs[0] {
+    N := 0
+    for row := range seriesDFTs {
+      if n := getCoefficientsNumForEnergy(seriesDFTs[row][b], energy); n > N {
+        N = n
+      }
+    }
+    for row := range seriesDFTs {
+      if len(seriesDFTs[row][b]) > N {
+        seriesDFTs[row][b] = seriesDFTs[row][b][:N]
+      }
+    }
+  }
+}
+
+/* Get the scaled coefficients of one window, keeping a fixed ratio or, with energy > 0, all distinct ones
+   (see truncateSpectra). A constant window has no coefficients */
+func getWindowSpectrum(plan *FFTPlan, window []float64, ratio float64, energy float64) []complex128 {
+  w := len(window)
+  mean, sigma := getWindowMeanSigma(window)
+  if sigma == 0 {
+    return []complex128{}
+  }
+  N := getCoefficientsNum(w, ratio)
+  if energy > 0 {
+    N = getDistinctCoefficientsNum(w)
+  }
+  coefficients := make([]complex128, N)
+  getFFTResult(plan, sigma, mean, w, N, &window, &coefficients)
+  scaleSpectrum(coefficients, w)
+  return coefficients
+}
+
+/* Distance of two scaled spectra over their common coefficients, and the bound of the error of c = 1 - d^2/2.
+   The discarded coefficients can only add to d^2, by at most (sqrt(Ex) + sqrt(Ey))^2 where E is the discarded energy,
+   so the estimate c' satisfies c <= c' <= c + bound */
+func getSpectralDistance(left []complex128, right []complex128) (float64, float64) {
+  n := len(left)
+  if len(right) < n {
+    n = len(right)
+  }
+  var res float64 = 0
+  for f := 0; f < n; f += 1 {
+    diff := cmplx.Abs(left[f] - right[f])
+    res += diff * diff
+  }
+  discardedX := getDiscardedEnergy(left, n)
+  discardedY := getDiscardedEnergy(right, n)
+  bound := 0.5 * (math.Sqrt(discardedX) + math.Sqrt(discardedY)) * (math.Sqrt(discardedX) + math.Sqrt(discardedY))
+  return math.Sqrt(res), bound
+}
+
+/* Energy of a scaled spectrum beyond its first n coefficients, a constant window has none */
+func getDiscardedEnergy(coefficients []complex128, n int) float64 {
+  if len(coefficients) == 0 {
+    return 0
+  }
+  return math.Max(0, 1 - getSpectrumEnergy(coefficients, n))
+}
+
+/* Bound of the error of a DFT query result, the window bounds are combined with the weights of updateMatrix */
+func getDFTQueryBound(seriesSketchX *SeriesSketch, seriesSketchY *SeriesSketch, slicesOfBound *([]float64)) float64 {
+  size := len(*slicesOfBound)
+  var meanX, meanY, count float64 = 0, 0, 0
+  for i := 0; i < size; i += 1 {
+    meanX += (*seriesSketchX.slicesOfCount)[i] * (*seriesSketchX.slicesOfMean)[i]
+    meanY += (*seriesSketchY.slicesOfCount)[i] * (*seriesSketchY.slicesOfMean)[i]
+    count += (*seriesSketchX.slicesOfCount)[i]
+  }
+  meanX /= count
+  meanY /= count
+  var numerator, demoninator1, demoninator2 float64 = 0, 0, 0
+  for i := 0; i < size; i += 1 {
+    weight := (*seriesSketchX.slicesOfCount)[i]
+    sigmaX := (*seriesSketchX.slicesOfSigma)[i]
+    sigmaY := (*seriesSketchY.slicesOfSigma)[i]
+    deltaX := (*seriesSketchX.slicesOfMean)[i] - meanX
+    deltaY := (*seriesSketchY.slicesOfMean)[i] - meanY
+    numerator += weight * sigmaX * sigmaY * (*slicesOfBound)[i]
+    demoninator1 += weight * (sigmaX*sigmaX + deltaX*deltaX)
+    demoninator2 += weight * (sigmaY*sigmaY + deltaY*deltaY)
+  }
+  if demoninator1 <= 0 || demoninator2 <= 0 {
+    return 0
+  }
+  return numerator / (math.Sqrt(demoninator1) * math.Sqrt(demoninator2))
+}
+
+/* Parse the accuracy target of method "d": energy=<fraction> keeps per window the fewest coefficients reaching
+   that fraction of the energy, errorbound=<eps> chooses the energy so that each window's cXY is off by at most eps.
+   0 keeps the fixed ratio */
+func parseDFTEnergy(options map[string]string) float64 {
+  if options["energy"] != "" && options["errorbound"] != "" {
+    panic("Only one of energy and errorbound can be set.")
+  }
+  if options["energy"] != "" {
+    floatVal, err := strconv.ParseFloat(options["energy"], 64)
+    if err != nil || floatVal <= 0 || floatVal > 1 {
+      panic("Invalid energy: " + options["energy"])
+    }
+    return floatVal
+  }
+  if options["errorbound"] != "" {
+    floatVal, err := strconv.ParseFloat(options["errorbound"], 64)
+    if err != nil || floatVal <= 0 {
+      panic("Invalid errorbound: " + options["errorbound"])
+    }
+    // Both windows discard at most 1 - energy, so the bound is at most 2 * (1 - energy)
+    return math.Max(1 - floatVal / 2, 1e-9)
+  }
+  return 0
+}
+
+/* Scaled DFT coefficients of every basic window of one series, planLast transforms the trailing partial window */
+func getSeriesDFT(plan *FFTPlan, planLast *FFTPlan, series []float64, granularity int, ratio float64, energy float64) [][]complex128 {
+  numberOfBasicwindows := getNumberOfBasicwindowsOfLength(len(series), granularity)
+  coefficients := make([][]complex128, numberOfBasicwindows)
+  for b := 0; b < numberOfBasicwindows; b += 1 {
+    window := series[b*granularity : int(math.Min(float64((b+1)*granularity), float64(len(series))))]
+    windowPlan := plan
+    if len(window) < granularity {
+      windowPlan = planLast
+    }
+    coefficients[b] = getWindowSpectrum(windowPlan, window, ratio, energy)
+  }
+  return coefficients
+}
+
+/* Compute the DFT coefficients of every series and basic window once, indexed by [row][window][f] */
+func getSeriesDFTs(dataset *Dataset, granularity int, ratio float64, energy float64) [][][]complex128 {
+  t0 := time.Now()
+  plan := newFFTPlan(granularity)
+  var planLast *FFTPlan
+  if remained := dataset.length() % granularity; remained > 0 {
+    planLast = newFFTPlan(remained)
+  }
+  seriesDFTs := make([][][]complex128, dataset.numOfLocations())
+  NCPU := getNumCPU()
+  sem := make(chan int, NCPU)
+  for taskNum := 0; taskNum < NCPU; taskNum += 1 {
+    go func(taskNum int) {
+      var buf []float64
+      for row := taskNum; row < len(seriesDFTs); row += NCPU {
+        seriesDFTs[row] = getSeriesDFT(plan, planLast, dataset.series(row, &buf), granularity, ratio, energy)
+      }
+      sem <- 1
+    }(taskNum)
+  }
+  for i := 0; i < NCPU; i += 1 {
+    <-sem
+  }
+  if energy > 0 {
+    truncateSpectra(seriesDFTs, energy)
+  }
+  fmt.Println("DFT time: ", time.Since(t0))
+  displayCoefficientsNum(seriesDFTs)
+  return seriesDFTs
+}
+
+/* Compute the DFT coefficients of the single basic window of every series of window, indexed by [row][0][f] */
+func getSeriesDFTsOfWindow(plan *FFTPlan, window *Dataset, ratio float64, energy float64) [][][]complex128 {
+  seriesDFTs := make([][][]complex128, window.numOfLocations())
+  var buf []float64
+  for row := range seriesDFTs {
+    seriesDFTs[row] = [][]complex128{getWindowSpectrum(plan, window.series(row, &buf), ratio, energy)}
+  }
+  if energy > 0 {
+    truncateSpectra(seriesDFTs, energy)
+  }
+  return seriesDFTs
+}
+
+/* Start a sliding DFT from a full window of w values */
+func newSlidingDFT(plan *FFTPlan, window []float64, N int) *SlidingDFT {
+  w := len(window)
+  sdft := SlidingDFT{w: w, N: N, window: make([]float64, w), coefficients: make([]complex128, N), twiddles: make([]complex128, N)}
+  copy(sdft.window, window)
+  plan.transform(window, N, sdft.coefficients)
+  setTwiddles(sdft.twiddles, w)
+  var moments Moments
+  for _, x := range window {
+    moments.addX(x)
+  }
+  sdft.mean = moments.meanX
+  sdft.m2 = moments.m2X
+  return &sdft
+}
+
+/* Helper function: set the twiddle factors exp(-i*2*pi*f/w) of the first len(twiddles) coefficients */
+func setTwiddles(twiddles []complex128, w int) {
+  for f := range twiddles {
+    twiddles[f] = cmplx.Rect(1, -2 * math.Pi * float64(f) / float64(w))
+  }
+}
+
+/* Slide the window by one value in O(N) */
+func (sdft *SlidingDFT) push(x float64) {
+  outgoing := sdft.window[sdft.head]
+  delta := complex(x - outgoing, 0)
+  for f := 0; f < sdft.N; f += 1 {
+    sdft.coefficients[f] = (sdft.coefficients[f] + delta) * sdft.twiddles[f]
+  }
+  sdft.window[sdft.head] = x
+  sdft.head = (sdft.head + 1) % sdft.w
+  // Welford update for replacing outgoing by x
+  mean := sdft.mean + (x - outgoing) / float64(sdft.w)
+  sdft.m2 += (x - outgoing) * (x - mean + outgoing - sdft.mean)
+  sdft.mean = mean
+}
+
+/* Get the scaled coefficients of the z-normalized current window, same as getWindowSpectrum */
+func (sdft *SlidingDFT) normalized() []complex128 {
+  n := float64(sdft.w)
+  // The drift of m2 over many slides stays far below the variance of a non-constant window
+  if sdft.m2 <= 1e-12 * n * (1 + sdft.mean*sdft.mean) {
+    return []complex128{}
+  }
+  sigma := math.Sqrt(sdft.m2 / n)
+  scale := complex(1 / (sigma * math.Sqrt(n)), 0)
+  result := make([]complex128, sdft.N)
+  // The mean only changes the 0th coefficient, which is 0 after normalization
+  for f := 1; f < sdft.N; f += 1 {
+    result[f] = sdft.coefficients[f] * scale
+  }
+  scaleSpectrum(result, sdft.w)
+  return result
+}
+
+/* Slide every series from the last basic window of dataset through datasetNew, returns the coefficients of the basic
+   windows of getComingDataset: the first one completes the trailing partial basic window of dataset, if any, and the
+   last one may be partial */
+func getSeriesDFTsSliding(dataset *Dataset, datasetNew *Dataset, granularity int, ratio float64, energy float64) [][][]complex128 {
+  if dataset.length() < granularity {
+    panic(fmt.Sprintf("ERROR: the sliding DFT starts from a full basic window of %d values, the dataset only has %d", granularity, dataset.length()))
+  }
+  N := getCoefficientsNum(granularity, ratio)
+  if energy > 0 {
+    N = getDistinctCoefficientsNum(granularity)
+  }
+  plan := newFFTPlan(granularity)
+  remained := dataset.length() % granularity
+  length := remained + datasetNew.length()
+  var planLast *FFTPlan
+  if length % granularity > 0 {
+    planLast = newFFTPlan(length % granularity)
+  }
+  numberOfBasicwindows := getNumberOfBasicwindowsOfLength(length, granularity)
+  seriesDFTs := make([][][]complex128, dataset.numOfLocations())
+  var buf, bufNew []float64
+  for row := range seriesDFTs {
+    series := dataset.series(row, &buf)
+    // Slide from the last granularity values, they end with the trailing partial basic window
+    sdft := newSlidingDFT(plan, series[len(series)-granularity:], N)
+    seriesNew := datasetNew.series(row, &bufNew)
+    seriesDFTs[row] = make([][]complex128, numberOfBasicwindows)
+    for k := range seriesNew {
+      sdft.push(seriesNew[k])
+      if (remained + k + 1) % granularity == 0 {
+        seriesDFTs[row][(remained + k)/granularity] = sdft.normalized()
+      }
+    }
+    if planLast != nil {
+      // The values of the trailing partial basic window are the last ones of the sliding window
+      window := make([]float64, length % granularity)
+      for k := range window {
+        window[k] = sdft.window[(sdft.head + granularity - len(window) + k) % granularity]
+      }
+      seriesDFTs[row][numberOfBasicwindows-1] = getWindowSpectrum(planLast, window, ratio, energy)
+    }
+  }
+  if energy > 0 {
+    truncateSpectra(seriesDFTs, energy)
+  }
+  return seriesDFTs
+}
+
+/* Report the average number of coefficients kept per basic window */
+func displayCoefficientsNum(seriesDFTs [][][]complex128) {
+  var sum, count float64 = 0, 0
+  for _, windows := range seriesDFTs {
+    for _, coefficients := range windows {
+      sum += float64(len(coefficients))
+      count += 1
+    }
+  }
+  if count > 0 {
+    fmt.Println(fmt.Sprintf("DFT coefficients: %.1f per basic window on average", sum/count))
+  }
+}
+
+/* Report the error bounds of the DFT results. The estimate c' of a pair satisfies c <= c' <= c + bound,
+   an edge is uncertain when the threshold decision differs within that interval */
+func displayDFTQueryBounds(accurateMatrix *([][]float64), boundMatrix *([][]float64), thres float64) {
+  var sum, max, count float64 = 0, 0, 0
+  var uncertain int = 0
+  for i := 0; i < len(*accurateMatrix); i += 1 {
+    for j := i + 1; j < len(*accurateMatrix); j += 1 {
+      corr := (*accurateMatrix)[i][j]
+      bound := (*boundMatrix)[i][j]
+      sum += bound
+      max = math.Max(max, bound)
+      count += 1
+      if (math.Abs(corr) >= thres) != (math.Abs(corr - bound) >= thres) || (corr >= thres && corr - bound <= -thres) {
+        uncertain += 1
+      }
+    }
+  }
+  if count > 0 {
+    fmt.Println(fmt.Sprintf("DFT error bound: mean %.4f, max %.4f, uncertain edges: %d", sum/count, max, uncertain))
+  }
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+  "bufio"
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "io"
+  "math"
+  "net/http"
+  "os"
+  "strings"
+  "time"
+)
+
+const (
+  edgeAdded = "added"
+  edgeRemoved = "removed"
+  webhookTimeout = 10 * time.Second
+)
+
+/* Change of an edge of the network by an update. Window is the index of the newest basic window of the update,
+   counted from the start of the data */
+type EdgeEvent struct {
+  Type string `json:"type"`
+  LeftLocation int `json:"leftLocation"`
+  RightLocation int `json:"rightLocation"`
+  Window int `json:"window"`
+  OldCorr float64 `json:"oldCorr"`
+  NewCorr float64 `json:"newCorr"`
+}
+
+/* Encode an event, a correlation that is not finite (e.g. of a pair whose sketch degenerated) is null since JSON has no
+   NaN or infinity */
+func (event EdgeEvent) MarshalJSON() ([]byte, error) {
+  type plainEdgeEvent EdgeEvent
+  return json.Marshal(struct {
+    plainEdgeEvent
+    OldCorr *float64 `json:"oldCorr"`
+    NewCorr *float64 `json:"newCorr"`
+  }{plainEdgeEvent(event), finiteOrNil(event.OldCorr), finiteOrNil(event.NewCorr)})
+}
+
+/* Helper function: nil for NaN and infinity, else a pointer to val */
+func finiteOrNil(val float64) *float64 {
+  if math.IsNaN(val) || math.IsInf(val, 0) {
+    return nil
+  }
+  return &val
+}
+
+/* Destination of the edge events of an update */
+type EdgeSink interface {
+  send(events []EdgeEvent)
+  close()
+}
+
+/* Writes one JSON object per line, to stdout or to a file */
+type JSONLinesSink struct {
+  writer *bufio.Writer
+  closer io.Closer // nil for stdout
+}
+
+/* Posts the events of every update as one JSON array */
+type WebhookSink struct {
+  url string
+  client *http.Client
+}
+
+/* Sends every event to a channel, for programs that embed the engine. The channel is not closed */
+type ChannelSink struct {
+  events chan<- EdgeEvent
+}
+
+/* Create a sink writing JSON lines to stdout, or to the file at path */
+func newJSONLinesSink(path string) *JSONLinesSink {
+  if path == "stdout" {
+    return &JSONLinesSink{writer: bufio.NewWriter(os.Stdout)}
+  }
+  file, err := os.Create(path)
+  if err != nil {
+    panic(err)
+  }
+  return &JSONLinesSink{writer: bufio.NewWriter(file), closer: file}
+}
+
+func (sink *JSONLinesSink) send(events []EdgeEvent) {
+  for _, event := range events {
+    line, err := json.Marshal(event)
+    if err != nil {
+      panic(err)
+    }
+    sink.writer.Write(line)
+    sink.writer.WriteString("\n")
+  }
+  if err := sink.writer.Flush(); err != nil {
+    panic(err)
+  }
+}
+
+func (sink *JSONLinesSink) close() {
+  sink.writer.Flush()
+  if sink.closer != nil {
+    sink.closer.Close()
+  }
+}
+
+/* Create a sink posting to url */
+func newWebhookSink(url string) *WebhookSink {
+  return &WebhookSink{url: url, client: &http.Client{Timeout: webhookTimeout}}
+}
+
+/* A failed post is reported and the events are dropped, the network is still updated */
+func (sink *WebhookSink) send(events []EdgeEvent) {
+  body, err := json.Marshal(events)
+  if err != nil {
+    panic(err)
+  }
+  response, err := sink.client.Post(sink.url, "application/json", bytes.NewReader(body))
+  if err != nil {
+    fmt.Println(fmt.Sprintf("Webhook: %d events dropped: %v", len(events), err))
+    return
+  }
+  response.Body.Close()
+  if response.StatusCode >= 300 {
+    fmt.Println(fmt.Sprintf("Webhook: %d events dropped: %s", len(events), response.Status))
+  }
+}
+
+func (sink *WebhookSink) close() {
+}
+
+/* Create a sink sending to events */
+func newChannelSink(events chan<- EdgeEvent) *ChannelSink {
+  return &ChannelSink{events: events}
+}
+
+func (sink *ChannelSink) send(events []EdgeEvent) {
+  for _, event := range events {
+    sink.events <- event
+  }
+}
+
+func (sink *ChannelSink) close() {
+}
+
+/* Parse the sink of the edge events, events=<stdout|http(s)://url|path of a file>. nil if not set */
+func parseEdgeSink(options map[string]string) EdgeSink {
+  destination := options["events"]
+  if destination == "" {
+    return nil
+  }
+  if strings.HasPrefix(destination, "http://") || strings.HasPrefix(destination, "https://") {
+    return newWebhookSink(destination)
+  }
+  return newJSONLinesSink(destination)
+}
+
+/* Helper function: copy a matrix, before an update changes it */
+func copyMatrix(matrix [][]int) [][]int {
+  matrixCopy := make([][]int, len(matrix))
+  for row := range matrix {
+    matrixCopy[row] = append([]int(nil), matrix[row]...)
+  }
+  return matrixCopy
+}
+
+/* Helper function: copy a matrix of correlations, before an update changes it */
+func copyFloatMatrix(matrix [][]float64) [][]float64 {
+  matrixCopy := make([][]float64, len(matrix))
+  for row := range matrix {
+    matrixCopy[row] = append([]float64(nil), matrix[row]...)
+  }
+  return matrixCopy
+}
+
+/* Compare the network before and after an update and send an event for every edge that was added or removed to sink */
+func sendEdgeChanges(sink EdgeSink, window int, oldLocations []int, oldMatrix [][]int, oldCorr [][]float64,
+  locations []int, matrix [][]int, corr [][]float64) {
+  if sink == nil {
+    return
+  }
+  if events := getEdgeChanges(window, oldLocations, oldMatrix, oldCorr, locations, matrix, corr); len(events) > 0 {
+    sink.send(events)
+  }
+}
+
+/* Get an event for every edge that was added or removed by an update. Pairs are matched by location, so the rows may
+   change in between; pairs of added or removed locations have no event */
+func getEdgeChanges(window int, oldLocations []int, oldMatrix [][]int, oldCorr [][]float64,
+  locations []int, matrix [][]int, corr [][]float64) []EdgeEvent {
+  oldRows := make(map[int]int, len(oldLocations))
+  for row, location := range oldLocations {
+    oldRows[location] = row
+  }
+  var events []EdgeEvent
+  numOfAdded, numOfRemoved := 0, 0
+  for i := range locations {
+    oldI, ok := oldRows[locations[i]]
+    if !ok {
+      continue
+    }
+    for j := i + 1; j < len(locations); j += 1 {
+      oldJ, ok := oldRows[locations[j]]
+      if !ok || oldMatrix[oldI][oldJ] == matrix[i][j] {
+        continue
+      }
+      event := EdgeEvent{Type: edgeAdded, LeftLocation: locations[i], RightLocation: locations[j], Window: window,
+        OldCorr: oldCorr[oldI][oldJ], NewCorr: corr[i][j]}
+      if matrix[i][j] == 1 {
+        numOfAdded += 1
+      } else {
+        event.Type = edgeRemoved
+        numOfRemoved += 1
+      }
+      events = append(events, event)
+    }
+  }
+  fmt.Println(fmt.Sprintf("Edge changes at basic window %d: %d added, %d removed", window, numOfAdded, numOfRemoved))
+  return events
+}
@@ -0,0 +1,8 @@
+module tsubasa
+
+go 1.25
+
+require (
+	github.com/klauspost/compress v1.20.1
+	github.com/lib/pq v1.12.3
+)
@@ -0,0 +1,259 @@
+package main
+
+import (
+  "fmt"
+  "strconv"
+  "time"
+)
+
+/* Dyadic hierarchy of the basic windows of one series. levels[l][i] merges basic windows [i*2^l, (i+1)*2^l),
+   only the x part of the Moments is used */
+type SeriesHierarchy struct {
+  levels [][]Moments
+  pruned []int // number of dropped nodes at the start of each level, levels[l][0] is node pruned[l]
+}
+
+/* Dyadic hierarchy of the cross terms of a pair, levels[l][i] is the sum of co-deviations of the node.
+   Nodes are pruned together with the hierarchy of the series */
+type PairHierarchy struct {
+  pair Pair
+  levels [][]float64
+}
+
+/* Build the hierarchy of a series from its basic window statistics */
+func newSeriesHierarchy(seriesSketch *SeriesSketch) *SeriesHierarchy {
+  size := len(*seriesSketch.slicesOfMean)
+  leaves := make([]Moments, size)
+  for b := 0; b < size; b += 1 {
+    count := (*seriesSketch.slicesOfCount)[b]
+    sigma := (*seriesSketch.slicesOfSigma)[b]
+    leaves[b] = Moments{count: count, meanX: (*seriesSketch.slicesOfMean)[b], m2X: count * sigma * sigma}
+  }
+  hierarchy := SeriesHierarchy{levels: [][]Moments{leaves}}
+  for level := leaves; len(level) > 1; {
+    // A node only exists when both of its children do
+    parents := make([]Moments, len(level)/2)
+    for i := range parents {
+      parents[i] = level[2*i]
+      parents[i].merge(&level[2*i+1])
+    }
+    hierarchy.levels = append(hierarchy.levels, parents)
+    level = parents
+  }
+  hierarchy.pruned = make([]int, len(hierarchy.levels))
+  return &hierarchy
+}
+
+/* Build the hierarchy of a pair from its per window cross statistics (cXY, or dXY with isDFT) */
+func newPairHierarchy(pair *Pair, hierarchyX *SeriesHierarchy, hierarchyY *SeriesHierarchy,
+  slicesOfCXY *([]float64), slicesOfDXY *([]float64), isDFT bool) *PairHierarchy {
+  leavesX := hierarchyX.levels[0]
+  leavesY := hierarchyY.levels[0]
+  leaves := make([]float64, len(leavesX))
+  for b := range leaves {
+    var cXY float64
+    if !isDFT {
+      cXY = (*slicesOfCXY)[b]
+    } else {
+      cXY = 1 - 0.5 * (*slicesOfDXY)[b] * (*slicesOfDXY)[b]
+    }
+    leaves[b] = leavesX[b].count * leavesX[b].sigmaX() * leavesY[b].sigmaX() * cXY
+  }
+  hierarchy := PairHierarchy{pair: *pair, levels: [][]float64{leaves}}
+  for l := 1; l < len(hierarchyX.levels); l += 1 {
+    children := hierarchy.levels[l-1]
+    parents := make([]float64, len(hierarchyX.levels[l]))
+    for i := range parents {
+      left := pairNode(hierarchyX.levels[l-1][2*i], hierarchyY.levels[l-1][2*i], children[2*i])
+      right := pairNode(hierarchyX.levels[l-1][2*i+1], hierarchyY.levels[l-1][2*i+1], children[2*i+1])
+      left.merge(&right)
+      parents[i] = left.cXY
+    }
+    hierarchy.levels = append(hierarchy.levels, parents)
+  }
+  return &hierarchy
+}
+
+/* Join the nodes of two series and their pair into the Moments of the pair */
+func pairNode(nodeX Moments, nodeY Moments, cXY float64) Moments {
+  return Moments{count: nodeX.count, meanX: nodeX.meanX, meanY: nodeY.meanX, m2X: nodeX.m2X, m2Y: nodeY.m2X, cXY: cXY}
+}
+
+/* Split [queryStart, queryEnd) into the fewest dyadic nodes, returns (level, index) of each node.
+   ok is false if the range needs nodes that were pruned */
+func getDyadicNodes(hierarchy *SeriesHierarchy, queryStart int, queryEnd int) ([][2]int, bool) {
+  var nodes [][2]int
+  for start := queryStart; start < queryEnd; {
+    level := len(hierarchy.levels) - 1
+    for ; level > 0; level -= 1 {
+      width := 1 << uint(level)
+      if start % width == 0 && start + width <= queryEnd && start/width < hierarchy.pruned[level] + len(hierarchy.levels[level]) {
+        break
+      }
+    }
+    index := start >> uint(level)
+    if index < hierarchy.pruned[level] {
+      return nodes, false
+    }
+    // Indexes into the kept nodes
+    index -= hierarchy.pruned[level]
+    nodes = append(nodes, [2]int{level, index})
+    start += 1 << uint(level)
+  }
+  return nodes, true
+}
+
+/* Correlation of a pair over basic windows [queryStart, queryEnd), touching O(log n) nodes */
+func queryHierarchy(hierarchyX *SeriesHierarchy, hierarchyY *SeriesHierarchy, pairHierarchy *PairHierarchy,
+  nodes [][2]int) float64 {
+  var moments Moments
+  for _, node := range nodes {
+    level, index := node[0], node[1]
+    part := pairNode(hierarchyX.levels[level][index], hierarchyY.levels[level][index], pairHierarchy.levels[level][index])
+    moments.merge(&part)
+  }
+  corr, _ := moments.correlation()
+  return corr
+}
+
+/* Get the number of nodes of a level that end at or before basic window before */
+func getPrunedNodes(before int, level int, numOfNodes int) int {
+  pruned := before >> uint(level)
+  if pruned > numOfNodes {
+    pruned = numOfNodes
+  }
+  return pruned
+}
+
+/* Get the first basic window that is kept at full resolution when nodes below minLevel are pruned: the older ones are
+   covered by complete nodes of level minLevel */
+func getPrunedBefore(numberOfBasicwindows int, minLevel int) int {
+  return (numberOfBasicwindows >> uint(minLevel)) << uint(minLevel)
+}
+
+/* Widen the bounds of a query that fall before prunedBefore to the nodes of level minLevel that cover them */
+func getPrunedQueryRange(queryStart int, queryEnd int, minLevel int, prunedBefore int) (int, int) {
+  width := 1 << uint(minLevel)
+  if queryStart < prunedBefore {
+    queryStart -= queryStart % width
+  }
+  if queryEnd < prunedBefore && queryEnd % width != 0 {
+    queryEnd += width - queryEnd % width
+  }
+  return queryStart, queryEnd
+}
+
+/* Drop the nodes below minLevel that end before basic window before, the coarse nodes covering them are kept.
+   Must be called on a hierarchy that was not pruned yet */
+func (hierarchy *SeriesHierarchy) prune(minLevel int, before int) {
+  for level := 0; level < minLevel && level < len(hierarchy.levels); level += 1 {
+    pruned := getPrunedNodes(before, level, len(hierarchy.levels[level]))
+    hierarchy.pruned[level] = pruned
+    hierarchy.levels[level] = append([]Moments(nil), hierarchy.levels[level][pruned:]...)
+  }
+}
+
+/* Drop the same nodes as the series hierarchy */
+func (hierarchy *PairHierarchy) prune(minLevel int, before int) {
+  for level := 0; level < minLevel && level < len(hierarchy.levels); level += 1 {
+    pruned := getPrunedNodes(before, level, len(hierarchy.levels[level]))
+    hierarchy.levels[level] = append([]float64(nil), hierarchy.levels[level][pruned:]...)
+  }
+}
+
+/* Number of nodes that are kept */
+func (hierarchy *SeriesHierarchy) numOfNodes() int {
+  var num int = 0
+  for level := range hierarchy.levels {
+    num += len(hierarchy.levels[level])
+  }
+  return num
+}
+
+/* In-memory network construction on the dyadic hierarchy of the basic windows.
+   With pruneLevel > 0, nodes below that level are dropped for the old basic windows (see getPrunedBefore), a query
+   over them is answered at the resolution of the kept nodes */
+func networkConstructionBWHierarchy(dataset *Dataset, matrix *([][]int), thres float64, granularity int,
+  isDFT bool, ratio float64, energy float64, queryStart int, queryEnd int, pruneLevel int) {
+  locationsNum := dataset.numOfLocations()
+  numberOfBasicwindows := getNumberOfBasicwindows(dataset, granularity)
+  queryStart, queryEnd = getQueryRange(queryStart, queryEnd, numberOfBasicwindows)
+  if queryEnd > numberOfBasicwindows || queryStart >= queryEnd {
+    panic("ERROR: invalid query range")
+  }
+
+  // Sketch part
+  t0 := time.Now()
+  seriesSketches := getSeriesSketches(dataset, granularity)
+  var seriesDFTs [][][]complex128
+  if isDFT {
+    seriesDFTs = getSeriesDFTs(dataset, granularity, ratio, energy)
+  }
+  seriesHierarchies := make([]*SeriesHierarchy, locationsNum)
+  for i := range seriesHierarchies {
+    seriesHierarchies[i] = newSeriesHierarchy(&seriesSketches[i])
+  }
+  var pairHierarchies []*PairHierarchy
+  for i := 0; i < locationsNum; i += 1 {
+    for j := i + 1; j < locationsNum; j += 1 {
+      pair := Pair{dataset.locations[i], dataset.locations[j], i, j}
+      var bwr BasicWindowResult
+      var bwrdft BasicWindowDFTResult
+      if !isDFT {
+        getBasicWindowResult(dataset, granularity, &pair, &bwr, nil, false, nil)
+      } else {
+        getBasicWindowResult(dataset, granularity, &pair, nil, &bwrdft, true, &seriesDFTs)
+      }
+      pairHierarchies = append(pairHierarchies, newPairHierarchy(&pair, seriesHierarchies[i], seriesHierarchies[j], bwr.slicesOfCXY, bwrdft.slicesOfDXY, isDFT))
+    }
+  }
+  prunedBefore := 0
+  if pruneLevel > 0 {
+    prunedBefore = getPrunedBefore(numberOfBasicwindows, pruneLevel)
+    for _, hierarchy := range seriesHierarchies {
+      hierarchy.prune(pruneLevel, prunedBefore)
+    }
+    for _, hierarchy := range pairHierarchies {
+      hierarchy.prune(pruneLevel, prunedBefore)
+    }
+  }
+  fmt.Println("Sketch time: ", time.Since(t0))
+  if locationsNum > 0 {
+    fmt.Println(fmt.Sprintf("Hierarchy: %d levels, %d nodes per series", len(seriesHierarchies[0].levels), seriesHierarchies[0].numOfNodes()))
+  }
+
+  // Query part, every series has the same windows so the nodes are found once
+  t1 := time.Now()
+  if locationsNum > 0 {
+    if prunedBefore > 0 {
+      // The pruned basic windows are only known at the resolution of their kept nodes
+      requestedStart, requestedEnd := queryStart, queryEnd
+      queryStart, queryEnd = getPrunedQueryRange(queryStart, queryEnd, pruneLevel, prunedBefore)
+      fmt.Println(fmt.Sprintf("Pruned: basic windows before %d at a resolution of %d basic windows, query [%d, %d) answered over [%d, %d)",
+        prunedBefore, 1 << uint(pruneLevel), requestedStart, requestedEnd, queryStart, queryEnd))
+    }
+    nodes, ok := getDyadicNodes(seriesHierarchies[0], queryStart, queryEnd)
+    if !ok {
+      panic(fmt.Sprintf("ERROR: basic windows before %d were pruned to level %d", prunedBefore, pruneLevel))
+    }
+    fmt.Println(fmt.Sprintf("Query: %d nodes for %d basic windows", len(nodes), queryEnd - queryStart))
+    for _, pairHierarchy := range pairHierarchies {
+      pair := pairHierarchy.pair
+      corr := queryHierarchy(seriesHierarchies[pair.indexOfRow], seriesHierarchies[pair.indexOfCol], pairHierarchy, nodes)
+      setCorrelation(matrix, thres, &pair, corr, nil)
+    }
+  }
+  fmt.Println("Query time: ", time.Since(t1))
+}
+
+/* Parse the level below which old basic windows are pruned, 0 keeps every node */
+func parsePruneLevel(options map[string]string) int {
+  if options["prune"] == "" {
+    return 0
+  }
+  intVal, err := strconv.Atoi(options["prune"])
+  if err != nil || intVal < 0 {
+    panic("Invalid prune level: " + options["prune"])
+  }
+  return intVal
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+  "math"
+  "math/rand"
+  "testing"
+)
+
+/* Random walks with a shared part and a large offset, the last basic window is shorter than granularity */
+func newWalksDataset(locationsNum int, length int, seed int64) *Dataset {
+  random := rand.New(rand.NewSource(seed))
+  dataset := newDataset(false)
+  for row := 0; row < locationsNum; row += 1 {
+    dataset.addLocation(100 + row, row, -row, length)
+  }
+  dataset.timestamps = make([]int, length)
+  shared := 0.0
+  own := make([]float64, locationsNum)
+  for k := 0; k < length; k += 1 {
+    dataset.timestamps[k] = k
+    shared += random.NormFloat64()
+    for row := range own {
+      own[row] += random.NormFloat64()
+      weight := float64(row) / float64(locationsNum)
+      dataset.set(row, k, 1e4 + weight * shared + (1 - weight) * own[row])
+    }
+  }
+  return dataset
+}
+
+/* Helper function: correlation of a pair over basic windows [queryStart, queryEnd) from the flat per window sketches */
+func getFlatCorrelation(seriesSketchX *SeriesSketch, seriesSketchY *SeriesSketch, slicesOfCXY *([]float64),
+  slicesOfDXY *([]float64), isDFT bool, queryStart int, queryEnd int) float64 {
+  sub := func(slices *([]float64)) *([]float64) {
+    if slices == nil {
+      return nil
+    }
+    res := (*slices)[queryStart:queryEnd]
+    return &res
+  }
+  return getCorrelationOfWindows(sub(seriesSketchX.slicesOfMean), sub(seriesSketchY.slicesOfMean), sub(seriesSketchX.slicesOfSigma),
+    sub(seriesSketchY.slicesOfSigma), sub(seriesSketchX.slicesOfCount), sub(slicesOfCXY), sub(slicesOfDXY), isDFT)
+}
+
+/* Query the hierarchy over every [start, end) of basic windows, with and without pruning, and compare each pair with the
+   flat combination of the same windows */
+func TestQueryHierarchyRanges(t *testing.T) {
+  const granularity, ratio, locationsNum = 16, 0.5, 4
+  dataset := newWalksDataset(locationsNum, 13 * granularity - 5, 11)
+  numberOfBasicwindows := getNumberOfBasicwindows(dataset, granularity)
+  seriesSketches := getSeriesSketches(dataset, granularity)
+  seriesDFTs := getSeriesDFTs(dataset, granularity, ratio, 0)
+  tests := []struct {
+    isDFT bool
+    pruneLevel int
+  }{
+    {false, 0},
+    {true, 0},
+    {false, 2},
+    {true, 3},
+  }
+  for _, test := range tests {
+    seriesHierarchies := make([]*SeriesHierarchy, locationsNum)
+    for i := range seriesHierarchies {
+      seriesHierarchies[i] = newSeriesHierarchy(&seriesSketches[i])
+    }
+    var pairHierarchies []*PairHierarchy
+    var bwrs []BasicWindowResult
+    var bwrdfts []BasicWindowDFTResult
+    for i := 0; i < locationsNum; i += 1 {
+      for j := i + 1; j < locationsNum; j += 1 {
+        pair := Pair{dataset.locations[i], dataset.locations[j], i, j}
+        var bwr BasicWindowResult
+        var bwrdft BasicWindowDFTResult
+        if !test.isDFT {
+          getBasicWindowResult(dataset, granularity, &pair, &bwr, nil, false, nil)
+        } else {
+          getBasicWindowResult(dataset, granularity, &pair, nil, &bwrdft, true, &seriesDFTs)
+        }
+        bwrs = append(bwrs, bwr)
+        bwrdfts = append(bwrdfts, bwrdft)
+        pairHierarchies = append(pairHierarchies, newPairHierarchy(&pair, seriesHierarchies[i], seriesHierarchies[j], bwr.slicesOfCXY, bwrdft.slicesOfDXY, test.isDFT))
+      }
+    }
+    prunedBefore := 0
+    if test.pruneLevel > 0 {
+      prunedBefore = getPrunedBefore(numberOfBasicwindows, test.pruneLevel)
+      for _, hierarchy := range seriesHierarchies {
+        hierarchy.prune(test.pruneLevel, prunedBefore)
+      }
+      for _, hierarchy := range pairHierarchies {
+        hierarchy.prune(test.pruneLevel, prunedBefore)
+      }
+    }
+    for start := 0; start < numberOfBasicwindows; start += 1 {
+      for end := start + 1; end <= numberOfBasicwindows; end += 1 {
+        queryStart, queryEnd := start, end
+        if prunedBefore > 0 {
+          queryStart, queryEnd = getPrunedQueryRange(start, end, test.pruneLevel, prunedBefore)
+        }
+        nodes, ok := getDyadicNodes(seriesHierarchies[0], queryStart, queryEnd)
+        if !ok {
+          t.Fatalf("dft %v, prune %d: [%d, %d) widened to [%d, %d) needs pruned nodes", test.isDFT, test.pruneLevel, start, end, queryStart, queryEnd)
+        }
+        if len(nodes) > 2 * len(seriesHierarchies[0].levels) {
+          t.Errorf("dft %v, prune %d: [%d, %d) needs %d nodes", test.isDFT, test.pruneLevel, start, end, len(nodes))
+        }
+        for p, pairHierarchy := range pairHierarchies {
+          pair := pairHierarchy.pair
+          corr := queryHierarchy(seriesHierarchies[pair.indexOfRow], seriesHierarchies[pair.indexOfCol], pairHierarchy, nodes)
+          expected := getFlatCorrelation(&seriesSketches[pair.indexOfRow], &seriesSketches[pair.indexOfCol], bwrs[p].slicesOfCXY,
+            bwrdfts[p].slicesOfDXY, test.isDFT, queryStart, queryEnd)
+          if math.Abs(corr - expected) > 1e-9 {
+            t.Errorf("dft %v, prune %d: pair (%d, %d) over [%d, %d) is %v, a flat query gives %v", test.isDFT, test.pruneLevel,
+              pair.leftLocation, pair.rightLocation, queryStart, queryEnd, corr, expected)
+          }
+        }
+      }
+    }
+  }
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+  "database/sql"
+  "fmt"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+)
+
+/* Locations added to and removed from a sketch after its first query. dataset and datasetNew hold the values of the
+   locations after the changes, ordered by location */
+type LocationChanges struct {
+  added []int
+  removed []int
+  dataset *Dataset
+  datasetNew *Dataset
+}
+
+/* Parse a list of locations separated by commas */
+func parseLocationList(value string) []int {
+  var locations []int
+  if value == "" {
+    return locations
+  }
+  for _, str := range strings.Split(value, ",") {
+    location, err := strconv.Atoi(strings.TrimSpace(str))
+    if err != nil {
+      panic("Invalid location: " + str)
+    }
+    locations = append(locations, location)
+  }
+  return locations
+}
+
+/* Parse addlocations=<id,...> and removelocations=<id,...> and load the values of the locations after the changes from
+   the file: before values (-1 for the whole series) and, if withNew, the values of an update. The climatology of every
+   location is the one of the timestamps before climatologyBefore, the <before> of the loaded dataset */
+func getLocationChanges(fileName string, singlePrecision bool, before int, climatologyBefore int, granularity int, dataset *Dataset,
+  withNew bool, options map[string]string) *LocationChanges {
+  changes := LocationChanges{added: parseLocationList(options["addlocations"]), removed: parseLocationList(options["removelocations"])}
+  isRemoved := make(map[int]bool)
+  for _, location := range changes.removed {
+    if _, ok := dataset.indexOfLocation[location]; !ok {
+      panic(fmt.Sprintf("ERROR: removed location %d is not loaded", location))
+    }
+    isRemoved[location] = true
+  }
+  var locations []int
+  for _, location := range dataset.locations {
+    if !isRemoved[location] {
+      locations = append(locations, location)
+    }
+  }
+  for _, location := range changes.added {
+    if _, ok := dataset.indexOfLocation[location]; ok {
+      panic(fmt.Sprintf("ERROR: added location %d is already loaded", location))
+    }
+    locations = append(locations, location)
+  }
+  if len(locations) < 2 {
+    panic("ERROR: the sketch needs at least two locations")
+  }
+  sort.Ints(locations)
+
+  // Every location of the file, preprocessed like the loaded ones
+  datasetAll := newDataset(singlePrecision)
+  getDataset(fileName, datasetAll, before, -1)
+  changes.dataset = prepareDataset(datasetAll, options, climatologyBefore).selectLocations(locations)
+  if withNew {
+    changes.datasetNew = getDatasetNew(fileName, singlePrecision, changes.dataset.length(), -1, granularity, climatologyBefore, options).selectLocations(locations)
+  }
+  fmt.Println(fmt.Sprintf("Location changes: %d added, %d removed, %d locations after the changes", len(changes.added), len(changes.removed), len(locations)))
+  return &changes
+}
+
+/* Helper function: resize the matrices to the number of locations after the changes */
+func resizeMatrix(matrix *([][]int), accurateMatrix *([][]float64), locationsNum int) {
+  *matrix = make([][]int, locationsNum)
+  *accurateMatrix = make([][]float64, locationsNum)
+  for i := range *matrix {
+    (*matrix)[i] = make([]int, locationsNum)
+    (*accurateMatrix)[i] = make([]float64, locationsNum)
+  }
+}
+
+/* Apply the changes to a stored sketch, removals first. The stored rows stay ordered by location */
+func applyStoredLocationChanges(db *sql.DB, tableNames []string, changes *LocationChanges, granularity int,
+  isDFT bool, ratio float64, energy float64, writeBlockSize int) {
+  for _, location := range changes.removed {
+    removeStoredLocation(db, tableNames, location)
+  }
+  for _, location := range changes.added {
+    // Values of the stored locations and of the added one
+    locations := append(queryLocationIndex(db), location)
+    sort.Ints(locations)
+    addStoredLocation(db, changes.dataset.selectLocations(locations), location, granularity, tableNames, isDFT, ratio, energy, writeBlockSize)
+  }
+  checkLocationIndex(db, changes.dataset)
+}
+
+/* Add a location to a stored sketch, its pairs with every stored location go to the table with the fewest pairs.
+   dataset holds the values of the stored basic windows of the stored locations and of the added one */
+func addStoredLocation(db *sql.DB, dataset *Dataset, location int, granularity int, tableNames []string,
+  isDFT bool, ratio float64, energy float64, writeBlockSize int) {
+  t0 := time.Now()
+  windows := querySketchState(db)
+  newRow := dataset.indexOfLocation[location]
+  storedLocations := append(append([]int(nil), dataset.locations[:newRow]...), dataset.locations[newRow+1:]...)
+  if !dataset.selectLocations(storedLocations).matchesIndex(queryLocationIndex(db)) {
+    panic("ERROR: stored location index does not match the loaded dataset")
+  }
+  if getNumberOfBasicwindows(dataset, granularity) != windows.end {
+    panic(fmt.Sprintf("ERROR: the values of location %d do not cover the %d stored basic windows", location, windows.end))
+  }
+  shiftStoredRows(db, tableNames, newRow, 1)
+  sqlStatement := fmt.Sprintf("INSERT INTO %s %s VALUES (%d, %d, %d, %d);", indextablename, indexheader,
+    newRow, location, dataset.latitudes[newRow], dataset.longitudes[newRow])
+  execDB(db, &sqlStatement)
+
+  // Windows [0, stored) go to the rows of the sketch, the later retained ones to the update tables
+  firstUpdated := windows.stored
+  if windows.first > firstUpdated {
+    firstUpdated = windows.first
+  }
+  seriesSketches := getSeriesSketches(dataset, granularity)
+  insertSeriesWindows(db, &seriesSketches[newRow], newRow, windows.stored, firstUpdated, windows.end)
+  var seriesDFTs [][][]complex128
+  if isDFT {
+    seriesDFTs = getSeriesDFTs(dataset, granularity, ratio, energy)
+  }
+
+  // The new pairs get the next ids of the table with the fewest pairs
+  tableName := tableNames[0]
+  id := countStoredPairs(db, tableName)
+  for _, name := range tableNames[1:] {
+    if count := countStoredPairs(db, name); count < id {
+      tableName = name
+      id = count
+    }
+  }
+  header := pairsbwrheader
+  if isDFT {
+    header = pairsbwrdftheader
+  }
+  if writeBlockSize <= 0 {
+    writeBlockSize = 1
+  }
+  var statementSB, updateSB strings.Builder
+  accumulate := 0
+  for row := range dataset.locations {
+    if row == newRow {
+      continue
+    }
+    pair := Pair{location, dataset.locations[row], newRow, row}
+    if row < newRow {
+      pair = Pair{dataset.locations[row], location, row, newRow}
+    }
+    var slices *([]float64)
+    var bwr BasicWindowResult
+    var bwrdft BasicWindowDFTResult
+    if !isDFT {
+      getBasicWindowResult(dataset, granularity, &pair, &bwr, nil, false, nil)
+      slices = bwr.slicesOfCXY
+      slicesStored := (*slices)[:windows.stored]
+      bwr.slicesOfCXY = &slicesStored
+    } else {
+      getBasicWindowResult(dataset, granularity, &pair, nil, &bwrdft, true, &seriesDFTs)
+      slices = bwrdft.slicesOfDXY
+      slicesStored := (*slices)[:windows.stored]
+      bwrdft.slicesOfDXY = &slicesStored
+    }
+    if accumulate == 0 {
+      statementSB.Reset()
+      statementSB.WriteString(fmt.Sprintf("INSERT INTO %s %s VALUES ", tableName, header))
+    } else {
+      statementSB.WriteString(",")
+    }
+    if !isDFT {
+      appendRowBWR(&statementSB, &bwr, id)
+    } else {
+      appendRowBWRDFT(&statementSB, &bwrdft, id)
+    }
+    appendWindowValues(&updateSB, id, slices, firstUpdated, windows.end)
+    accumulate += 1
+    id += 1
+    if accumulate == writeBlockSize {
+      statementSB.WriteString(";")
+      insertRowsBWR(db, &statementSB)
+      accumulate = 0
+    }
+  }
+  if accumulate > 0 {
+    statementSB.WriteString(";")
+    insertRowsBWR(db, &statementSB)
+  }
+  if updateSB.Len() > 0 {
+    column := "cxy"
+    updateHeader := pairsupdateheader
+    if isDFT {
+      column = "dxy"
+      updateHeader = pairsdftupdateheader
+    }
+    sqlStatement = fmt.Sprintf("INSERT INTO %s%s %s VALUES %s ON CONFLICT (id, windowindex) DO UPDATE SET %s = EXCLUDED.%s;",
+      tableName, updatetablesuffix, updateHeader, updateSB.String(), column, column)
+    execDB(db, &sqlStatement)
+  }
+  fmt.Println(fmt.Sprintf("Location %d added at row %d: %d pairs written to %s, time: %v", location, newRow, dataset.numOfLocations() - 1, tableName, time.Since(t0)))
+}
+
+/* Remove a location from a stored sketch with its series, its pairs and their updates. The ids of every table stay
+   consecutive and the rows after the location move by one */
+func removeStoredLocation(db *sql.DB, tableNames []string, location int) {
+  t0 := time.Now()
+  removedRow := -1
+  for row, storedLocation := range queryLocationIndex(db) {
+    if storedLocation == location {
+      removedRow = row
+    }
+  }
+  if removedRow < 0 {
+    panic(fmt.Sprintf("ERROR: location %d is not in the stored sketch", location))
+  }
+  for _, tableName := range tableNames {
+    // Pairs are stored as "leftLocation,rightLocation,indexOfRow,indexOfCol"
+    condition := fmt.Sprintf("split_part(pair, ',', 1) = '%d' OR split_part(pair, ',', 2) = '%d'", location, location)
+    sqlStatement := fmt.Sprintf("DELETE FROM %s%s WHERE id IN (SELECT id FROM %s WHERE %s);", tableName, updatetablesuffix, tableName, condition)
+    execDB(db, &sqlStatement)
+    sqlStatement = fmt.Sprintf("DELETE FROM %s WHERE %s;", tableName, condition)
+    execDB(db, &sqlStatement)
+    compactStoredPairs(db, tableName)
+  }
+  for _, tableName := range []string{seriestablename, seriestablename + updatetablesuffix, indextablename} {
+    sqlStatement := fmt.Sprintf("DELETE FROM %s WHERE rowindex = %d;", tableName, removedRow)
+    execDB(db, &sqlStatement)
+  }
+  shiftStoredRows(db, tableNames, removedRow + 1, -1)
+  fmt.Println(fmt.Sprintf("Location %d removed from row %d, time: %v", location, removedRow, time.Since(t0)))
+}
+
+/* Helper function: move the stored rows from row on by shift, in the series, location index and pair tables. Rows are
+   negated first so that the unique row indexes never collide */
+func shiftStoredRows(db *sql.DB, tableNames []string, row int, shift int) {
+  for _, tableName := range []string{seriestablename, seriestablename + updatetablesuffix, indextablename} {
+    sqlStatement := fmt.Sprintf("UPDATE %s SET rowindex = -1 - (rowindex + %d) WHERE rowindex >= %d;", tableName, shift, row)
+    execDB(db, &sqlStatement)
+    sqlStatement = fmt.Sprintf("UPDATE %s SET rowindex = -1 - rowindex WHERE rowindex < 0;", tableName)
+    execDB(db, &sqlStatement)
+  }
+  for _, tableName := range tableNames {
+    sqlStatement := fmt.Sprintf("UPDATE %s SET pair = concat_ws(',', split_part(pair, ',', 1), split_part(pair, ',', 2), "+
+      "split_part(pair, ',', 3)::int + CASE WHEN split_part(pair, ',', 3)::int >= %d THEN %d ELSE 0 END, "+
+      "split_part(pair, ',', 4)::int + CASE WHEN split_part(pair, ',', 4)::int >= %d THEN %d ELSE 0 END);",
+      tableName, row, shift, row, shift)
+    execDB(db, &sqlStatement)
+  }
+}
+
+/* Helper function: renumber the pairs of a table and their updates to consecutive ids from 0, in the order of their ids */
+func compactStoredPairs(db *sql.DB, tableName string) {
+  renumbered := fmt.Sprintf("(SELECT id, ROW_NUMBER() OVER (ORDER BY id) - 1 AS newid FROM %s) renumbered", tableName)
+  sqlStatement := fmt.Sprintf("UPDATE %s%s SET id = -1 - renumbered.newid FROM %s WHERE %s%s.id = renumbered.id;",
+    tableName, updatetablesuffix, renumbered, tableName, updatetablesuffix)
+  execDB(db, &sqlStatement)
+  sqlStatement = fmt.Sprintf("UPDATE %s SET id = -1 - renumbered.newid FROM %s WHERE %s.id = renumbered.id;", tableName, renumbered, tableName)
+  execDB(db, &sqlStatement)
+  for _, name := range []string{tableName + updatetablesuffix, tableName} {
+    sqlStatement = fmt.Sprintf("UPDATE %s SET id = -1 - id WHERE id < 0;", name)
+    execDB(db, &sqlStatement)
+  }
+}
+
+/* Insert the windows [0, stored) of a series to the series table and the windows [firstUpdated, end) to its update table */
+func insertSeriesWindows(db *sql.DB, seriesSketch *SeriesSketch, row int, stored int, firstUpdated int, end int) {
+  slicesOfMean := (*seriesSketch.slicesOfMean)[:stored]
+  slicesOfSigma := (*seriesSketch.slicesOfSigma)[:stored]
+  slicesOfSumSquared := (*seriesSketch.slicesOfSumSquared)[:stored]
+  slicesOfCount := (*seriesSketch.slicesOfCount)[:stored]
+  seriesSketchStored := SeriesSketch{seriesSketch.location, &slicesOfMean, &slicesOfSigma, &slicesOfSumSquared, &slicesOfCount}
+  var rowSeries RowSeries
+  serializeSeriesSketch(&seriesSketchStored, row, &rowSeries)
+  sqlStatement := fmt.Sprintf("INSERT INTO %s %s VALUES (%d, %d, '%s', '%s', '%s', '%s');", seriestablename, seriesheader,
+    rowSeries.row, rowSeries.location, rowSeries.mean, rowSeries.sigma, rowSeries.sumSquared, rowSeries.count)
+  execDB(db, &sqlStatement)
+  if firstUpdated >= end {
+    return
+  }
+  var statementSB strings.Builder
+  statementSB.WriteString(fmt.Sprintf("INSERT INTO %s%s %s VALUES ", seriestablename, updatetablesuffix, seriesupdateheader))
+  for b := firstUpdated; b < end; b += 1 {
+    if b > firstUpdated {
+      statementSB.WriteString(",")
+    }
+    statementSB.WriteString(fmt.Sprintf(" (%d, %d, %s, %s, %s, %s)", row, b,
+      formatFloat((*seriesSketch.slicesOfMean)[b]), formatFloat((*seriesSketch.slicesOfSigma)[b]),
+      formatFloat((*seriesSketch.slicesOfSumSquared)[b]), formatFloat((*seriesSketch.slicesOfCount)[b])))
+  }
+  statementSB.WriteString(";")
+  insertRowsBWR(db, &statementSB)
+}
+
+/* Helper function: append the update rows of windows [start, end) of a pair */
+func appendWindowValues(statementSB *strings.Builder, id int, slices *([]float64), start int, end int) {
+  for b := start; b < end; b += 1 {
+    if statementSB.Len() > 0 {
+      statementSB.WriteString(",")
+    }
+    statementSB.WriteString(fmt.Sprintf(" (%d, %d, %s)", id, b, formatFloat((*slices)[b])))
+  }
+}
+
+/* Read the pairs of a table ordered by id, pair n has id n */
+func queryStoredPairs(db *sql.DB, tableName string) []Pair {
+  sqlStatement := fmt.Sprintf("SELECT pair FROM %s ORDER BY id", tableName)
+  rows, err := db.Query(sqlStatement)
+  if err != nil {
+    panic(err)
+  }
+  defer rows.Close()
+  var pairs []Pair
+  for rows.Next() {
+    var serializedPair string
+    if err = rows.Scan(&serializedPair); err != nil {
+      panic(err)
+    }
+    var pair Pair
+    if _, err = fmt.Sscanf(serializedPair, "%d,%d,%d,%d", &pair.leftLocation, &pair.rightLocation, &pair.indexOfRow, &pair.indexOfCol); err != nil {
+      panic(err)
+    }
+    pairs = append(pairs, pair)
+  }
+  return pairs
+}
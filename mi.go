@@ -0,0 +1,264 @@
+package main
+
+import (
+  "fmt"
+  "math"
+  "strconv"
+  "time"
+)
+
+const defaultMIBins = 8
+
+/* Joint histograms of the bins of a pair, one bins x bins histogram per basic window */
+type HistogramSketch struct {
+  pair Pair
+  slicesOfJoint [][]float64
+}
+
+/* Parse the number of bins of the mutual information, bins=<n> */
+func parseMIBins(options map[string]string) int {
+  if options["bins"] == "" {
+    return defaultMIBins
+  }
+  intVal, err := strconv.Atoi(options["bins"])
+  if err != nil || intVal < 2 {
+    panic("Invalid number of bins: " + options["bins"])
+  }
+  return intVal
+}
+
+/* Parse the significance level of the independence test, significance=<alpha>. 0 disables the test */
+func parseSignificance(options map[string]string) float64 {
+  if options["significance"] == "" {
+    return 0
+  }
+  floatVal, err := strconv.ParseFloat(options["significance"], 64)
+  if err != nil || floatVal <= 0 || floatVal >= 1 {
+    panic("Invalid significance: " + options["significance"])
+  }
+  return floatVal
+}
+
+/* Assign every value of a series to one of the equal-frequency bins of the whole series, NaN values get -1.
+   Bins only depend on ranks, so the histograms of the basic windows add up over any query range */
+func getBins(series []float64, bins int, result []int) {
+  ranks := make([]float64, len(series))
+  getRanks(series, ranks)
+  var n float64 = 0
+  for _, rank := range ranks {
+    if !math.IsNaN(rank) {
+      n += 1
+    }
+  }
+  for k, rank := range ranks {
+    if math.IsNaN(rank) {
+      result[k] = -1
+      continue
+    }
+    result[k] = int((rank - 1) * float64(bins) / n)
+    if result[k] >= bins {
+      result[k] = bins - 1
+    }
+  }
+}
+
+/* Get the bins of every series, indexed by row */
+func getSeriesBins(dataset *Dataset, bins int) [][]int {
+  seriesBins := make([][]int, dataset.numOfLocations())
+  var buf []float64
+  for row := range seriesBins {
+    seriesBins[row] = make([]int, dataset.length())
+    getBins(dataset.series(row, &buf), bins, seriesBins[row])
+  }
+  return seriesBins
+}
+
+/* Add the values [start, end) of a pair to a joint histogram */
+func addToHistogram(leftBins []int, rightBins []int, start int, end int, bins int, joint []float64) {
+  for k := start; k < end; k += 1 {
+    if leftBins[k] >= 0 && rightBins[k] >= 0 {
+      joint[leftBins[k]*bins + rightBins[k]] += 1
+    }
+  }
+}
+
+/* Get the joint histogram of every basic window of a pair */
+func getHistogramSketch(seriesBins *([][]int), pair *Pair, granularity int, bins int, sketch *HistogramSketch) {
+  leftBins := (*seriesBins)[pair.indexOfRow]
+  rightBins := (*seriesBins)[pair.indexOfCol]
+  numberOfBasicwindows := getNumberOfBasicwindowsOfLength(len(leftBins), granularity)
+  sketch.pair = *pair
+  sketch.slicesOfJoint = make([][]float64, numberOfBasicwindows)
+  for b := range sketch.slicesOfJoint {
+    sketch.slicesOfJoint[b] = make([]float64, bins*bins)
+    end := int(math.Min(float64((b+1)*granularity), float64(len(leftBins))))
+    addToHistogram(leftBins, rightBins, b*granularity, end, bins, sketch.slicesOfJoint[b])
+  }
+}
+
+/* Plug-in mutual information (nats) of a joint histogram, with its number of values and degrees of freedom */
+func getMutualInformation(joint []float64, bins int) (float64, float64, int) {
+  marginalX := make([]float64, bins)
+  marginalY := make([]float64, bins)
+  var n float64 = 0
+  for i := 0; i < bins; i += 1 {
+    for j := 0; j < bins; j += 1 {
+      marginalX[i] += joint[i*bins + j]
+      marginalY[j] += joint[i*bins + j]
+      n += joint[i*bins + j]
+    }
+  }
+  var mi float64 = 0
+  for i := 0; i < bins; i += 1 {
+    for j := 0; j < bins; j += 1 {
+      if count := joint[i*bins + j]; count > 0 {
+        mi += count / n * math.Log(count * n / (marginalX[i] * marginalY[j]))
+      }
+    }
+  }
+  var binsX, binsY int = 0, 0
+  for i := 0; i < bins; i += 1 {
+    if marginalX[i] > 0 {
+      binsX += 1
+    }
+    if marginalY[i] > 0 {
+      binsY += 1
+    }
+  }
+  return math.Max(0, mi), n, (binsX - 1) * (binsY - 1)
+}
+
+/* Information coefficient of correlation, the |corr| of a Gaussian pair with the same mutual information */
+func getInformationCoefficient(mi float64) float64 {
+  return math.Sqrt(1 - math.Exp(-2 * mi))
+}
+
+/* P-value of the G-test of independence, 2 n MI follows a chi-square distribution with dof degrees of freedom */
+func getIndependencePValue(mi float64, n float64, dof int) float64 {
+  if dof <= 0 {
+    return 1
+  }
+  return getUpperIncompleteGamma(float64(dof) / 2, n * mi)
+}
+
+/* Regularized upper incomplete gamma function Q(a, x), by its series or its continued fraction */
+func getUpperIncompleteGamma(a float64, x float64) float64 {
+  if x <= 0 {
+    return 1
+  }
+  lgamma, _ := math.Lgamma(a)
+  logPrefix := a * math.Log(x) - x - lgamma
+  if x < a + 1 {
+    sum := 1 / a
+    term := sum
+    for n := 1; n < 1000; n += 1 {
+      term *= x / (a + float64(n))
+      sum += term
+      if math.Abs(term) < math.Abs(sum) * 1e-15 {
+        break
+      }
+    }
+    return math.Max(0, 1 - sum * math.Exp(logPrefix))
+  }
+  // Modified Lentz's method
+  tiny := 1e-300
+  b := x + 1 - a
+  c := 1 / tiny
+  d := 1 / b
+  h := d
+  for n := 1; n < 1000; n += 1 {
+    an := -float64(n) * (float64(n) - a)
+    b += 2
+    d = an * d + b
+    if math.Abs(d) < tiny {
+      d = tiny
+    }
+    c = b + an / c
+    if math.Abs(c) < tiny {
+      c = tiny
+    }
+    d = 1 / d
+    delta := d * c
+    h *= delta
+    if math.Abs(delta - 1) < 1e-15 {
+      break
+    }
+  }
+  return math.Exp(logPrefix) * h
+}
+
+/* Helper function: connect a pair if its information coefficient reaches thres and, with alpha > 0,
+   the independence test is rejected at level alpha. Returns whether the pair is significant */
+func updateMatrixMI(matrix *([][]int), thres float64, pair *Pair, joint []float64, bins int, alpha float64, sumOfMI *float64) bool {
+  mi, n, dof := getMutualInformation(joint, bins)
+  *sumOfMI += mi
+  significant := alpha <= 0 || getIndependencePValue(mi, n, dof) < alpha
+  if significant {
+    setCorrelation(matrix, thres, pair, getInformationCoefficient(mi), nil)
+  }
+  return significant
+}
+
+/* In-memory mutual information network. Naive uses the whole series, otherwise the per basic window
+   histograms are summed over [queryStart, queryEnd) */
+func networkConstructionMI(dataset *Dataset, matrix *([][]int), thres float64, granularity int, bins int, alpha float64,
+  queryStart int, queryEnd int, useSketch bool) {
+  locationsNum := dataset.numOfLocations()
+  t0 := time.Now()
+  seriesBins := getSeriesBins(dataset, bins)
+  var sketches []HistogramSketch
+  if useSketch {
+    for i := 0; i < locationsNum; i += 1 {
+      for j := i + 1; j < locationsNum; j += 1 {
+        pair := Pair{dataset.locations[i], dataset.locations[j], i, j}
+        var sketch HistogramSketch
+        getHistogramSketch(&seriesBins, &pair, granularity, bins, &sketch)
+        sketches = append(sketches, sketch)
+      }
+    }
+    fmt.Println("Sketch time: ", time.Since(t0))
+  }
+
+  t1 := time.Now()
+  var sumOfMI float64 = 0
+  var significantPairs int = 0
+  joint := make([]float64, bins*bins)
+  if useSketch {
+    numberOfBasicwindows := getNumberOfBasicwindows(dataset, granularity)
+    queryStart, queryEnd = getQueryRange(queryStart, queryEnd, numberOfBasicwindows)
+    if queryEnd > numberOfBasicwindows || queryStart >= queryEnd {
+      panic("ERROR: invalid query range")
+    }
+    for _, sketch := range sketches {
+      for k := range joint {
+        joint[k] = 0
+      }
+      for b := queryStart; b < queryEnd; b += 1 {
+        for k, count := range sketch.slicesOfJoint[b] {
+          joint[k] += count
+        }
+      }
+      if updateMatrixMI(matrix, thres, &sketch.pair, joint, bins, alpha, &sumOfMI) {
+        significantPairs += 1
+      }
+    }
+  } else {
+    for i := 0; i < locationsNum; i += 1 {
+      for j := i + 1; j < locationsNum; j += 1 {
+        pair := Pair{dataset.locations[i], dataset.locations[j], i, j}
+        for k := range joint {
+          joint[k] = 0
+        }
+        addToHistogram(seriesBins[i], seriesBins[j], 0, dataset.length(), bins, joint)
+        if updateMatrixMI(matrix, thres, &pair, joint, bins, alpha, &sumOfMI) {
+          significantPairs += 1
+        }
+      }
+    }
+  }
+  numOfPairs := locationsNum * (locationsNum - 1) / 2
+  if numOfPairs > 0 {
+    fmt.Println(fmt.Sprintf("Mutual information: %d bins, mean %.4f nats, %d of %d pairs significant", bins, sumOfMI / float64(numOfPairs), significantPairs, numOfPairs))
+  }
+  fmt.Println("Query time: ", time.Since(t1))
+}
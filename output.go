@@ -0,0 +1,76 @@
+package main
+
+import (
+  "fmt"
+  "os"
+  "bufio"
+)
+
+/* Write the location index (row -> location) as csv */
+func writeLocationIndex(dataset *Dataset, fileName string) {
+  f, err := os.Create(fileName)
+  if err != nil {
+    panic(err)
+  }
+  defer f.Close()
+  bfWr := bufio.NewWriter(f)
+  bfWr.WriteString("row,location,latitude,longitude\n")
+  for row, location := range dataset.locations {
+    bfWr.WriteString(fmt.Sprintf("%d,%d,%d,%d\n", row, location, dataset.latitudes[row], dataset.longitudes[row]))
+  }
+  if err = bfWr.Flush(); err != nil {
+    panic(err)
+  }
+}
+
+/* Write the adjacency matrix as csv, row i and column i are row i of the location index */
+func writeMatrix(matrix *([][]int), fileName string) {
+  f, err := os.Create(fileName)
+  if err != nil {
+    panic(err)
+  }
+  defer f.Close()
+  bfWr := bufio.NewWriter(f)
+  for i := 0; i < len(*matrix); i += 1 {
+    for j := 0; j < len((*matrix)[i]); j += 1 {
+      if j > 0 {
+        bfWr.WriteString(",")
+      }
+      bfWr.WriteString(fmt.Sprintf("%d", (*matrix)[i][j]))
+    }
+    bfWr.WriteString("\n")
+  }
+  if err = bfWr.Flush(); err != nil {
+    panic(err)
+  }
+}
+
+/* Write a matrix of values as csv, in the row order of the location index */
+func writeFloatMatrix(matrix *([][]float64), fileName string) {
+  f, err := os.Create(fileName)
+  if err != nil {
+    panic(err)
+  }
+  defer f.Close()
+  bfWr := bufio.NewWriter(f)
+  for i := 0; i < len(*matrix); i += 1 {
+    for j := 0; j < len((*matrix)[i]); j += 1 {
+      if j > 0 {
+        bfWr.WriteString(",")
+      }
+      bfWr.WriteString(fmt.Sprintf("%.6f", (*matrix)[i][j]))
+    }
+    bfWr.WriteString("\n")
+  }
+  if err = bfWr.Flush(); err != nil {
+    panic(err)
+  }
+  fmt.Println("Matrix written: ", fileName)
+}
+
+/* Write the network to <prefix>.matrix.csv and its location index to <prefix>.index.csv */
+func writeNetwork(prefix string, dataset *Dataset, matrix *([][]int)) {
+  writeMatrix(matrix, prefix + ".matrix.csv")
+  writeLocationIndex(dataset, prefix + ".index.csv")
+  fmt.Println("Network written: ", prefix + ".matrix.csv", prefix + ".index.csv")
+}
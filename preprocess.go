@@ -0,0 +1,301 @@
+package main
+
+import (
+  "fmt"
+  "math"
+  "strconv"
+  "time"
+)
+
+const (
+  defaultStartDate = "2010-01-01" // date of timestamp 0, the decade of getinfo.py
+  dateLayout       = "2006-01-02"
+)
+
+/* A period of the resampled time axis */
+type Period struct {
+  id int       // increasing id of the period
+  length int   // number of days in a complete period
+}
+
+/* Parse the date of timestamp 0 */
+func parseStartDate(options map[string]string) time.Time {
+  startStr := options["start"]
+  if startStr == "" {
+    startStr = defaultStartDate
+  }
+  start, err := time.Parse(dateLayout, startStr)
+  if err != nil {
+    panic(err)
+  }
+  return start
+}
+
+/* Get the date of a daily timestamp */
+func dateOfTimestamp(start time.Time, timestamp int) time.Time {
+  return start.AddDate(0, 0, timestamp)
+}
+
+/* Get the day of the year of a date in [0, 365), 29 February shares the day of 28 February so that a day keeps its
+   index in leap years */
+func dayOfNoLeapYear(date time.Time) int {
+  dayOfYear := date.YearDay() - 1
+  if isLeapYear(date.Year()) && dayOfYear >= 59 {
+    dayOfYear -= 1
+  }
+  return dayOfYear
+}
+
+/* Helper function: whether year has a 29 February */
+func isLeapYear(year int) bool {
+  return year % 4 == 0 && (year % 100 != 0 || year % 400 == 0)
+}
+
+/* Get the period of a date, resolution is "week", "pentad", "month" or a number of days */
+func periodOf(date time.Time, start time.Time, resolution string) Period {
+  days := int(date.Sub(start).Hours() / 24)
+  switch resolution {
+    case "week":
+      return Period{days / 7, 7}
+    case "pentad":
+      // 73 pentads per year, 29 February belongs to the pentad of 28 February
+      pentad := dayOfNoLeapYear(date) / 5
+      length := 5
+      if isLeapYear(date.Year()) && pentad == 11 {
+        length = 6
+      }
+      return Period{date.Year() * 73 + pentad, length}
+    case "month":
+      firstOfNextMonth := time.Date(date.Year(), date.Month() + 1, 1, 0, 0, 0, 0, time.UTC)
+      return Period{date.Year() * 12 + int(date.Month()) - 1, firstOfNextMonth.AddDate(0, 0, -1).Day()}
+  }
+  numOfDays, err := strconv.Atoi(resolution)
+  if err != nil || numOfDays <= 0 {
+    panic("Invalid resampling resolution: " + resolution)
+  }
+  return Period{days / numOfDays, numOfDays}
+}
+
+/* Aggregate the valid (not NaN) values of one period */
+func aggregateValues(values []float64, aggregate string) float64 {
+  var res float64 = 0
+  switch aggregate {
+    case "mean", "sum":
+      for _, val := range values {
+        res += val
+      }
+      if aggregate == "mean" {
+        res /= float64(len(values))
+      }
+    case "min":
+      res = math.Inf(1)
+      for _, val := range values {
+        res = math.Min(res, val)
+      }
+    case "max":
+      res = math.Inf(-1)
+      for _, val := range values {
+        res = math.Max(res, val)
+      }
+    default:
+      panic("Invalid aggregate: " + aggregate)
+  }
+  return res
+}
+
+/* Resample every series to the given resolution.
+   partial decides what happens with periods the time axis does not fully cover (only the first and the last one):
+   "drop" removes them, "keep" aggregates the days available. Inside a kept period, a series gets NaN if less than
+   minFraction of its days are valid. */
+func resampleDataset(dataset *Dataset, start time.Time, resolution string, aggregate string, partial string, minFraction float64) *Dataset {
+  // Split the time axis into periods
+  var periods []Period
+  var periodStarts []int // index of the first timestamp of each period, plus the end
+  for k, timestamp := range dataset.timestamps {
+    period := periodOf(dateOfTimestamp(start, timestamp), start, resolution)
+    if len(periods) == 0 || periods[len(periods)-1].id != period.id {
+      periods = append(periods, period)
+      periodStarts = append(periodStarts, k)
+    }
+  }
+  periodStarts = append(periodStarts, dataset.length())
+
+  var keptPeriods []int
+  for p := range periods {
+    if partial == "drop" && periodStarts[p+1] - periodStarts[p] < periods[p].length {
+      continue
+    }
+    keptPeriods = append(keptPeriods, p)
+  }
+
+  resampled := newDataset(dataset.singlePrecision)
+  resampled.timestamps = make([]int, len(keptPeriods))
+  for k := range resampled.timestamps {
+    resampled.timestamps[k] = k
+  }
+  var buf []float64
+  values := make([]float64, 0, 31)
+  for row, location := range dataset.locations {
+    resampled.addLocation(location, dataset.latitudes[row], dataset.longitudes[row], len(keptPeriods))
+    series := dataset.series(row, &buf)
+    for k, p := range keptPeriods {
+      values = values[:0]
+      for _, val := range series[periodStarts[p]:periodStarts[p+1]] {
+        if !math.IsNaN(val) {
+          values = append(values, val)
+        }
+      }
+      if len(values) == 0 || float64(len(values)) < minFraction * float64(periods[p].length) {
+        continue // stays NaN
+      }
+      resampled.set(row, k, aggregateValues(values, aggregate))
+    }
+  }
+  fmt.Println(fmt.Sprintf("Resampled to %s (%s): %d periods, %d dropped", resolution, aggregate, len(keptPeriods), len(periods) - len(keptPeriods)))
+  return resampled
+}
+
+/* Smooth a day-of-year curve by keeping its mean and first harmonics */
+func smoothByHarmonics(curve []float64, harmonics int) []float64 {
+  n := float64(len(curve))
+  smoothed := make([]float64, len(curve))
+  mean := getAvg(&curve)
+  for d := range smoothed {
+    smoothed[d] = mean
+  }
+  for h := 1; h <= harmonics; h += 1 {
+    var a, b float64 = 0, 0
+    for d, val := range curve {
+      angle := 2 * math.Pi * float64(h * d) / n
+      a += val * math.Cos(angle)
+      b += val * math.Sin(angle)
+    }
+    a *= 2 / n
+    b *= 2 / n
+    for d := range smoothed {
+      angle := 2 * math.Pi * float64(h * d) / n
+      smoothed[d] += a * math.Cos(angle) + b * math.Sin(angle)
+    }
+  }
+  return smoothed
+}
+
+/* Get the day-of-year mean and standard deviation of a series, daysOfYear in [0, 365). NaN values are skipped */
+func getClimatology(series []float64, daysOfYear []int) ([]float64, []float64) {
+  counts := make([]float64, 365)
+  means := make([]float64, 365)
+  m2s := make([]float64, 365)
+  for k, val := range series {
+    if math.IsNaN(val) {
+      continue
+    }
+    d := daysOfYear[k]
+    counts[d] += 1
+    delta := val - means[d]
+    means[d] += delta / counts[d]
+    m2s[d] += delta * (val - means[d])
+  }
+  sigmas := make([]float64, 365)
+  firstDay := -1
+  for d := range means {
+    if counts[d] == 0 {
+      means[d] = math.NaN()
+      sigmas[d] = math.NaN()
+      continue
+    }
+    sigmas[d] = math.Sqrt(m2s[d] / counts[d])
+    if firstDay < 0 {
+      firstDay = d
+    }
+  }
+  if firstDay < 0 {
+    return means, sigmas
+  }
+  // Days without data (e.g. in a series shorter than a year) take the value of the last day before them with data,
+  // going around the year from a day with data so that no NaN is copied
+  for i := 1; i < len(means); i += 1 {
+    d := (firstDay + i) % len(means)
+    if counts[d] == 0 {
+      prev := (d + len(means) - 1) % len(means)
+      means[d] = means[prev]
+      sigmas[d] = sigmas[prev]
+    }
+  }
+  return means, sigmas
+}
+
+/* Subtract each location's day-of-year climatology, optionally smoothed with the first harmonics,
+   and optionally divide by the day-of-year standard deviation. The climatology is computed from the timestamps before
+   climatologyBefore (all of them if it is not positive), so that values loaded later get the same baseline */
+func removeClimatology(dataset *Dataset, start time.Time, harmonics int, standardize bool, climatologyBefore int) {
+  daysOfYear := make([]int, dataset.length())
+  climatologyLength := 0
+  for k, timestamp := range dataset.timestamps {
+    daysOfYear[k] = dayOfNoLeapYear(dateOfTimestamp(start, timestamp))
+    if climatologyBefore <= 0 || timestamp < climatologyBefore {
+      climatologyLength = k + 1
+    }
+  }
+  var buf []float64
+  for row := range dataset.locations {
+    series := dataset.series(row, &buf)
+    means, sigmas := getClimatology(series[:climatologyLength], daysOfYear[:climatologyLength])
+    if harmonics > 0 {
+      means = smoothByHarmonics(means, harmonics)
+      sigmas = smoothByHarmonics(sigmas, harmonics)
+    }
+    for k, val := range series {
+      anomaly := val - means[daysOfYear[k]]
+      if standardize {
+        if sigmas[daysOfYear[k]] > 0 {
+          anomaly /= sigmas[daysOfYear[k]]
+        } else {
+          anomaly = 0
+        }
+      }
+      dataset.set(row, k, anomaly)
+    }
+  }
+  fmt.Println(fmt.Sprintf("Climatology removed: harmonics: %d, standardize: %v, computed from %d timestamps", harmonics, standardize, climatologyLength))
+}
+
+/* Apply the preprocessing steps selected by options to the loaded dataset. The climatology of anomaly=t is computed from
+   the timestamps before climatologyBefore, the <before> of the sketched values, see removeClimatology */
+func prepareDataset(dataset *Dataset, options map[string]string, climatologyBefore int) *Dataset {
+  start := parseStartDate(options)
+  // Anomalies are computed on daily values, so before resampling
+  if options["anomaly"] == "t" {
+    var harmonics int = 0
+    if options["harmonics"] != "" {
+      intVal, err := strconv.Atoi(options["harmonics"])
+      if err != nil {
+        panic(err)
+      }
+      harmonics = intVal
+    }
+    removeClimatology(dataset, start, harmonics, options["standardize"] == "t", climatologyBefore)
+  }
+  if resolution := options["resample"]; resolution != "" {
+    aggregate := options["aggregate"]
+    if aggregate == "" {
+      aggregate = "mean"
+    }
+    partial := options["partial"]
+    if partial == "" {
+      partial = "drop"
+    }
+    if partial != "drop" && partial != "keep" {
+      panic("Invalid partial: " + partial)
+    }
+    var minFraction float64 = 0
+    if options["minfraction"] != "" {
+      floatVal, err := strconv.ParseFloat(options["minfraction"], 64)
+      if err != nil {
+        panic(err)
+      }
+      minFraction = floatVal
+    }
+    dataset = resampleDataset(dataset, start, resolution, aggregate, partial, minFraction)
+  }
+  return dropEmptyLocations(dataset, fillMissingValues(dataset))
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+  "math"
+  "testing"
+  "time"
+)
+
+/* Helper function: parse a date of a test */
+func parseTestDate(t *testing.T, date string) time.Time {
+  parsed, err := time.Parse(dateLayout, date)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return parsed
+}
+
+/* Daily dataset of one location, value(k) at timestamp k */
+func newDailyDataset(length int, value func(k int) float64) *Dataset {
+  dataset := newDataset(false)
+  dataset.addLocation(1, 0, 1, length)
+  dataset.timestamps = make([]int, length)
+  for k := range dataset.timestamps {
+    dataset.timestamps[k] = k
+    dataset.set(0, k, value(k))
+  }
+  return dataset
+}
+
+/* Period boundaries around 29 February, at the end of a year and of weeks and N days */
+func TestPeriodOf(t *testing.T) {
+  start := parseTestDate(t, "2010-01-01")
+  tests := []struct {
+    date string
+    resolution string
+    period Period
+  }{
+    {"2012-02-24", "pentad", Period{2012*73 + 10, 5}},
+    {"2012-02-25", "pentad", Period{2012*73 + 11, 6}}, // pentad 12 of a leap year has 29 February
+    {"2012-02-29", "pentad", Period{2012*73 + 11, 6}},
+    {"2012-03-01", "pentad", Period{2012*73 + 11, 6}},
+    {"2012-03-02", "pentad", Period{2012*73 + 12, 5}},
+    {"2011-03-01", "pentad", Period{2011*73 + 11, 5}},
+    {"2011-03-02", "pentad", Period{2011*73 + 12, 5}},
+    {"2012-12-31", "pentad", Period{2012*73 + 72, 5}},
+    {"2013-01-01", "pentad", Period{2013*73, 5}},
+    {"2012-02-29", "month", Period{2012*12 + 1, 29}},
+    {"2011-02-28", "month", Period{2011*12 + 1, 28}},
+    {"2011-03-01", "month", Period{2011*12 + 2, 31}},
+    {"2010-01-07", "week", Period{0, 7}},
+    {"2010-01-08", "week", Period{1, 7}},
+    {"2010-01-10", "10", Period{0, 10}},
+    {"2010-01-11", "10", Period{1, 10}},
+  }
+  for _, test := range tests {
+    period := periodOf(parseTestDate(t, test.date), start, test.resolution)
+    if period != test.period {
+      t.Errorf("%s %s: period %v, expected %v", test.date, test.resolution, period, test.period)
+    }
+  }
+}
+
+/* Resample a leap year (and a partial period) to pentads and check the periods by their first and last days */
+func TestResampleDataset(t *testing.T) {
+  start := parseTestDate(t, "2012-01-03") // the first pentad is partial
+  dataset := newDailyDataset(364, func(k int) float64 { return float64(k) })
+  dataset.set(0, 100, math.NaN())
+  dataset.set(0, 101, math.NaN())
+  tests := []struct {
+    partial string
+    minFraction float64
+    length int
+    first float64 // mean of the first period
+    pentad12 float64 // mean of pentad 12, 25 February to 1 March
+    withGap float64 // mean of the pentad of 11 to 15 April, 12 and 13 April are NaN
+  }{
+    {"drop", 0, 72, 5, 55.5, (99 + 102 + 103) / 3.0},
+    {"keep", 0, 73, 1, 55.5, (99 + 102 + 103) / 3.0},
+    {"drop", 0.8, 72, 5, 55.5, math.NaN()},
+  }
+  for _, test := range tests {
+    resampled := resampleDataset(dataset, start, "pentad", "mean", test.partial, test.minFraction)
+    if resampled.length() != test.length {
+      t.Fatalf("partial %s: %d periods, expected %d", test.partial, resampled.length(), test.length)
+    }
+    offset := test.length - 72 // index of the first complete pentad
+    expected := map[int]float64{0: test.first, 10 + offset: test.pentad12, 19 + offset: test.withGap}
+    for k, val := range expected {
+      got := resampled.at(0, k)
+      if math.IsNaN(val) != math.IsNaN(got) || (!math.IsNaN(val) && math.Abs(got - val) > 1e-12) {
+        t.Errorf("partial %s, minFraction %v: period %d is %v, expected %v", test.partial, test.minFraction, k, got, val)
+      }
+    }
+  }
+}
+
+/* A series made of a seasonal cycle has no anomaly in a leap year either, and later values keep the climatology of the
+   timestamps before climatologyBefore */
+func TestRemoveClimatologyLeapYear(t *testing.T) {
+  start := parseTestDate(t, "2011-01-01")
+  end2012 := 2 * 365 + 1 // 2011 and the leap year 2012
+  seasonal := func(k int) float64 {
+    return 10 * math.Sin(2 * math.Pi * float64(dayOfNoLeapYear(dateOfTimestamp(start, k))) / 365)
+  }
+  tests := []struct {
+    climatologyBefore int
+    shift float64 // added to the values of 2013
+    expected float64 // anomaly of the values of 2013
+  }{
+    {-1, 0, 0},
+    {end2012, 0, 0},
+    {end2012, 5, 5},
+  }
+  for _, test := range tests {
+    dataset := newDailyDataset(end2012 + 365, func(k int) float64 {
+      if k >= end2012 {
+        return seasonal(k) + test.shift
+      }
+      return seasonal(k)
+    })
+    removeClimatology(dataset, start, 0, false, test.climatologyBefore)
+    for k := 0; k < dataset.length(); k += 1 {
+      expected := 0.0
+      if k >= end2012 {
+        expected = test.expected
+      }
+      if math.Abs(dataset.at(0, k) - expected) > 1e-9 {
+        t.Fatalf("climatologyBefore %d, shift %v: %s has anomaly %v, expected %v", test.climatologyBefore, test.shift,
+          dateOfTimestamp(start, k).Format(dateLayout), dataset.at(0, k), expected)
+      }
+    }
+  }
+}
+
+/* Days of the year without data take the climatology of the last day before them with data, around the year */
+func TestGetClimatologyEmptyDays(t *testing.T) {
+  tests := []struct {
+    firstDay int
+    lastDay int
+    day int
+    expectedDay int // day whose climatology the day takes
+  }{
+    {100, 199, 50, 199},
+    {100, 199, 250, 199},
+    {0, 0, 364, 0},
+    {364, 364, 0, 364},
+    {300, 20, 200, 20},
+  }
+  for _, test := range tests {
+    var series []float64
+    var daysOfYear []int
+    for d := test.firstDay; ; d = (d + 1) % 365 {
+      series = append(series, float64(d))
+      daysOfYear = append(daysOfYear, d)
+      if d == test.lastDay {
+        break
+      }
+    }
+    means, sigmas := getClimatology(series, daysOfYear)
+    for d := range means {
+      if math.IsNaN(means[d]) || math.IsNaN(sigmas[d]) {
+        t.Fatalf("days %d to %d: day %d has no climatology", test.firstDay, test.lastDay, d)
+      }
+    }
+    if means[test.day] != float64(test.expectedDay) {
+      t.Errorf("days %d to %d: day %d has mean %v, expected that of day %d", test.firstDay, test.lastDay, test.day, means[test.day], test.expectedDay)
+    }
+  }
+}
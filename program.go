@@ -3,8 +3,6 @@ package main
 import (
   "fmt"
   "os"
-  "bufio"
-  "io"
   "time"
   "strings"
   "strconv"
@@ -25,10 +23,27 @@ const (
   dbname            = "climatedb"
   tablename         = "pairsbwr"
   tablenamedft      = "pairsbwrdft"
-  pairsbwrschema    = "id INT UNIQUE NOT NULL, pair VARCHAR(30) UNIQUE NOT NULL, meanx VARCHAR(10000), meany VARCHAR(10000), sigmax VARCHAR(10000), sigmay VARCHAR(10000), cxy VARCHAR(10000)"
-  pairsbwrheader    = "(id, pair, meanx, meany, sigmax, sigmay, cxy)"
-  pairsbwrdftschema = "id INT UNIQUE NOT NULL, pair VARCHAR(30) UNIQUE NOT NULL, meanx VARCHAR(10000), meany VARCHAR(10000), sigmax VARCHAR(10000), sigmay VARCHAR(10000), dxy VARCHAR(10000)"
-  pairsbwrdftheader = "(id, pair, meanx, meany, sigmax, sigmay, dxy)"
+  seriestablename   = "seriesbw"
+  pairsbwrschema    = "id INT UNIQUE NOT NULL, pair VARCHAR(30) UNIQUE NOT NULL, cxy VARCHAR(10000)"
+  pairsbwrheader    = "(id, pair, cxy)"
+  pairsbwrdftschema = "id INT UNIQUE NOT NULL, pair VARCHAR(30) UNIQUE NOT NULL, dxy VARCHAR(10000)"
+  pairsbwrdftheader = "(id, pair, dxy)"
+  seriesschema      = "rowindex INT UNIQUE NOT NULL, location INT UNIQUE NOT NULL, mean VARCHAR(10000), sigma VARCHAR(10000), sumsquared VARCHAR(10000), count VARCHAR(10000)"
+  seriesheader      = "(rowindex, location, mean, sigma, sumsquared, count)"
+  indextablename    = "locationindex"
+  indexschema       = "rowindex INT UNIQUE NOT NULL, location INT UNIQUE NOT NULL, latitude INT, longitude INT"
+  indexheader       = "(rowindex, location, latitude, longitude)"
+  // Updates of stored sketches, one row per basic window, see dbupdate.go
+  updatetablesuffix    = "_update"
+  pairsupdateschema    = "id INT NOT NULL, windowindex INT NOT NULL, cxy DOUBLE PRECISION, PRIMARY KEY (id, windowindex)"
+  pairsupdateheader    = "(id, windowindex, cxy)"
+  pairsdftupdateschema = "id INT NOT NULL, windowindex INT NOT NULL, dxy DOUBLE PRECISION, PRIMARY KEY (id, windowindex)"
+  pairsdftupdateheader = "(id, windowindex, dxy)"
+  seriesupdateschema   = "rowindex INT NOT NULL, windowindex INT NOT NULL, mean DOUBLE PRECISION, sigma DOUBLE PRECISION, sumsquared DOUBLE PRECISION, count DOUBLE PRECISION, PRIMARY KEY (rowindex, windowindex)"
+  seriesupdateheader   = "(rowindex, windowindex, mean, sigma, sumsquared, count)"
+  statetablename       = "sketchstate"
+  stateschema          = "stored INT NOT NULL, firstwindow INT NOT NULL, endwindow INT NOT NULL"
+  stateheader          = "(stored, firstwindow, endwindow)"
 )
 
 type Pair struct {
@@ -47,27 +62,29 @@ type Point struct {
   temperature float64
 }
 
-/* Struct to store basic window statistics */
+/* Struct to store basic window statistics of one series, shared by all pairs of the series */
+type SeriesSketch struct {
+  location int
+  slicesOfMean *([]float64)
+  slicesOfSigma *([]float64)
+  // For DFT updates
+  slicesOfSumSquared *([]float64)
+  // Number of values of each basic window, the last one may be shorter than granularity
+  slicesOfCount *([]float64)
+}
+
+/* Struct to store basic window statistics of a pair, means and sigmas are in the SeriesSketch of each series */
 type BasicWindowResult struct {
   pair Pair
-  slicesOfMeanX *([]float64)
-  slicesOfMeanY *([]float64)
-  slicesOfSigmaX *([]float64)
-  slicesOfSigmaY *([]float64)
   slicesOfCXY *([]float64)
 }
 
-/* Struct to store basic window dft statistics */
+/* Struct to store basic window dft statistics of a pair */
 type BasicWindowDFTResult struct {
   pair Pair
-  slicesOfMeanX *([]float64)
-  slicesOfMeanY *([]float64)
-  slicesOfSigmaX *([]float64)
-  slicesOfSigmaY *([]float64)
   slicesOfDXY *([]float64)
-  // For updates
-  slicesOfSumSquaredX *([]float64)
-  slicesOfSumSquaredY *([]float64)
+  // Bound of the error of each window's cXY from the discarded coefficients, not stored in the database
+  slicesOfBound *([]float64)
 }
 
 /* Struct for insertion to db, unique to each other */
@@ -75,23 +92,25 @@ type SerializedPair struct {
   value string
 }
 
+/* Serialized SeriesSketch */
+type RowSeries struct {
+  row int
+  location int
+  mean string         // mean_1,mean_2,mean_3...
+  sigma string        // sigma_1,sigma_2,sigma_3...
+  sumSquared string   // sumsquared_1,sumsquared_2,sumsquared_3...
+  count string        // count_1,count_2,count_3...
+}
+
 /* Serialized BasicWindowResult */
 type RowBWR struct {
   pair SerializedPair // leftLocation,rightLocation,indexOfRow,indexOfCol
-  meanX string        // mean_x_1,mean_x_2,mean_x_3...
-  meanY string        // mean_y_1,mean_y_2,mean_y_3...
-  sigmaX string       // sigma_x_1,sigma_x_2,sigma_x_3...
-  sigmaY string       // sigma_y_1,sigma_y_2,sigma_y_3...
   cXY string          // cxy_1,cxy_2,cxy_3...
 }
 
 /* Serialized BasicWindowDFTResult */
 type RowBWRDFT struct {
   pair SerializedPair // leftLocation,rightLocation,indexOfRow,indexOfCol
-  meanX string        // mean_x_1,mean_x_2,mean_x_3...
-  meanY string        // mean_y_1,mean_y_2,mean_y_3...
-  sigmaX string       // sigma_x_1,sigma_x_2,sigma_x_3...
-  sigmaY string       // sigma_y_1,sigma_y_2,sigma_y_3...
   dXY string          // dxy_1,dxy_2,dxy_3...
 }
 
@@ -197,36 +216,81 @@ func deleteTable(db *sql.DB, tableName string) {
 
 /* Insert one row (basic window result) to db */
 func insertRowBWR(db *sql.DB, bwr *BasicWindowResult, id int, tableName string) {
-  rowBWR := RowBWR{SerializedPair{""}, "", "", "", "", ""}
+  rowBWR := RowBWR{SerializedPair{""}, ""}
   serializeBWR(bwr, &rowBWR)
-  sqlStatement := fmt.Sprintf("INSERT INTO %s %s VALUES (%d, '%s', '%s', '%s', '%s', '%s', '%s');", 
-  tableName, pairsbwrheader, id, rowBWR.pair.value, rowBWR.meanX, rowBWR.meanY, rowBWR.sigmaX, rowBWR.sigmaY, rowBWR.cXY)
+  sqlStatement := fmt.Sprintf("INSERT INTO %s %s VALUES (%d, '%s', '%s');", 
+  tableName, pairsbwrheader, id, rowBWR.pair.value, rowBWR.cXY)
   execDB(db, &sqlStatement)
 }
 
 /* Insert one row (basic window result + dft) to db */
 func insertRowBWRDFT(db *sql.DB, bwrdft *BasicWindowDFTResult, id int, tableName string) {
-  rowBWRDFT := RowBWRDFT{SerializedPair{""}, "", "", "", "", ""}
+  rowBWRDFT := RowBWRDFT{SerializedPair{""}, ""}
   serializeBWRDFT(bwrdft, &rowBWRDFT)
-  sqlStatement := fmt.Sprintf("INSERT INTO %s %s VALUES (%d, '%s', '%s', '%s', '%s', '%s', '%s');", 
-  tableName, pairsbwrdftheader, id, rowBWRDFT.pair.value, rowBWRDFT.meanX, rowBWRDFT.meanY, rowBWRDFT.sigmaX, rowBWRDFT.sigmaY, rowBWRDFT.dXY)
+  sqlStatement := fmt.Sprintf("INSERT INTO %s %s VALUES (%d, '%s', '%s');", 
+  tableName, pairsbwrdftheader, id, rowBWRDFT.pair.value, rowBWRDFT.dXY)
   execDB(db, &sqlStatement)
 }
 
 /* Append row statistics to rows statement */
 func appendRowBWR(statement *strings.Builder, bwr *BasicWindowResult, id int) {
-  rowBWR := RowBWR{SerializedPair{""}, "", "", "", "", ""}
+  rowBWR := RowBWR{SerializedPair{""}, ""}
   serializeBWR(bwr, &rowBWR)
-  (*statement).WriteString(fmt.Sprintf(" (%d, '%s', '%s', '%s', '%s', '%s', '%s')",
-  id, rowBWR.pair.value, rowBWR.meanX, rowBWR.meanY, rowBWR.sigmaX, rowBWR.sigmaY, rowBWR.cXY))
+  (*statement).WriteString(fmt.Sprintf(" (%d, '%s', '%s')",
+  id, rowBWR.pair.value, rowBWR.cXY))
 }
 
 /* Append row statistics to rows statement (with dft) */
 func appendRowBWRDFT(statement *strings.Builder, bwrdft *BasicWindowDFTResult, id int) {
-  rowBWRDFT := RowBWRDFT{SerializedPair{""}, "", "", "", "", ""}
+  rowBWRDFT := RowBWRDFT{SerializedPair{""}, ""}
   serializeBWRDFT(bwrdft, &rowBWRDFT)
-  (*statement).WriteString(fmt.Sprintf(" (%d, '%s', '%s', '%s', '%s', '%s', '%s')",
-  id, rowBWRDFT.pair.value, rowBWRDFT.meanX, rowBWRDFT.meanY, rowBWRDFT.sigmaX, rowBWRDFT.sigmaY, rowBWRDFT.dXY))
+  (*statement).WriteString(fmt.Sprintf(" (%d, '%s', '%s')",
+  id, rowBWRDFT.pair.value, rowBWRDFT.dXY))
+}
+
+/* Insert the statistics of every series to db, once per series instead of once per pair */
+func insertSeriesSketches(db *sql.DB, seriesSketches *([]SeriesSketch)) {
+  var statementSB strings.Builder
+  statementSB.WriteString(fmt.Sprintf("INSERT INTO %s %s VALUES ", seriestablename, seriesheader))
+  for row := 0; row < len(*seriesSketches); row += 1 {
+    rowSeries := RowSeries{0, 0, "", "", "", ""}
+    serializeSeriesSketch(&((*seriesSketches)[row]), row, &rowSeries)
+    if row > 0 {
+      statementSB.WriteString(",")
+    }
+    statementSB.WriteString(fmt.Sprintf(" (%d, %d, '%s', '%s', '%s', '%s')",
+    rowSeries.row, rowSeries.location, rowSeries.mean, rowSeries.sigma, rowSeries.sumSquared, rowSeries.count))
+  }
+  statementSB.WriteString(";")
+  insertRowsBWR(db, &statementSB)
+}
+
+/* Read the statistics of every series for stored basic windows start to end - 1, ordered by row */
+func querySeriesSketches(db *sql.DB, start int, end int) []SeriesSketch {
+  sqlStatement := fmt.Sprintf("SELECT * FROM %s ORDER BY rowindex", seriestablename)
+  rows, err := db.Query(sqlStatement)
+  if err != nil {
+    panic(err)
+  }
+  defer rows.Close()
+  var seriesSketches []SeriesSketch
+  for rows.Next() {
+    var rowSeries RowSeries
+    err = rows.Scan(&rowSeries.row, &rowSeries.location, &rowSeries.mean, &rowSeries.sigma, &rowSeries.sumSquared, &rowSeries.count)
+    if err != nil {
+      panic(err)
+    }
+    slicesOfMean := make([]float64, end - start)
+    slicesOfSigma := make([]float64, end - start)
+    slicesOfSumSquared := make([]float64, end - start)
+    slicesOfCount := make([]float64, end - start)
+    seriesSketch := SeriesSketch{rowSeries.location, &slicesOfMean, &slicesOfSigma, &slicesOfSumSquared, &slicesOfCount}
+    deserializRowSeries(&rowSeries, &seriesSketch, start, end)
+    seriesSketches = append(seriesSketches, seriesSketch)
+  }
+  // Windows written by updates replace the stored ones
+  querySeriesUpdates(db, start, end, &seriesSketches)
+  return seriesSketches
 }
 
 /* Insert rows to db in strings.Builder */
@@ -265,10 +329,6 @@ func serializeBWR(bwr *BasicWindowResult, rowBWR *RowBWR) {
   }
   serializedPair := SerializedPair{serializedPairString}
   rowBWR.pair = serializedPair
-  slicesToString(bwr.slicesOfMeanX, &rowBWR.meanX)
-  slicesToString(bwr.slicesOfMeanY, &rowBWR.meanY)
-  slicesToString(bwr.slicesOfSigmaX, &rowBWR.sigmaX)
-  slicesToString(bwr.slicesOfSigmaY, &rowBWR.sigmaY)
   slicesToString(bwr.slicesOfCXY, &rowBWR.cXY)
 }
 
@@ -282,13 +342,19 @@ func serializeBWRDFT(bwrdft *BasicWindowDFTResult, rowBWRDFT *RowBWRDFT) {
   }
   serializedPair := SerializedPair{serializedPairString}
   rowBWRDFT.pair = serializedPair
-  slicesToString(bwrdft.slicesOfMeanX, &rowBWRDFT.meanX)
-  slicesToString(bwrdft.slicesOfMeanY, &rowBWRDFT.meanY)
-  slicesToString(bwrdft.slicesOfSigmaX, &rowBWRDFT.sigmaX)
-  slicesToString(bwrdft.slicesOfSigmaY, &rowBWRDFT.sigmaY)
   slicesToString(bwrdft.slicesOfDXY, &rowBWRDFT.dXY)
 }
 
+/* Serialize SeriesSketch to RowSeries in case for insertion */
+func serializeSeriesSketch(seriesSketch *SeriesSketch, row int, rowSeries *RowSeries) {
+  rowSeries.row = row
+  rowSeries.location = seriesSketch.location
+  slicesToString(seriesSketch.slicesOfMean, &rowSeries.mean)
+  slicesToString(seriesSketch.slicesOfSigma, &rowSeries.sigma)
+  slicesToString(seriesSketch.slicesOfSumSquared, &rowSeries.sumSquared)
+  slicesToString(seriesSketch.slicesOfCount, &rowSeries.count)
+}
+
 /* Helper function: transfer a row of string to slices of float64 (index is from start to end - 1) */
 func stringToSlices(row *string, slices *([]float64), start int, end int) {
   strSlices := strings.Split(*row, ",")
@@ -313,10 +379,6 @@ func deserializRowBWR(rowBWR *RowBWR, bwr *BasicWindowResult, start int, end int
   if err != nil {
     panic(err)
   }
-  stringToSlices(&rowBWR.meanX, bwr.slicesOfMeanX, start, end)
-  stringToSlices(&rowBWR.meanY, bwr.slicesOfMeanY, start, end)
-  stringToSlices(&rowBWR.sigmaX, bwr.slicesOfSigmaX, start, end)
-  stringToSlices(&rowBWR.sigmaY, bwr.slicesOfSigmaY, start, end)
   stringToSlices(&rowBWR.cXY, bwr.slicesOfCXY, start, end)
 }
 
@@ -326,156 +388,204 @@ func deserializRowBWRDFT(rowBWRDFT *RowBWRDFT, bwrdft *BasicWindowDFTResult, sta
   if err != nil {
     panic(err)
   }
-  stringToSlices(&rowBWRDFT.meanX, bwrdft.slicesOfMeanX, start, end)
-  stringToSlices(&rowBWRDFT.meanY, bwrdft.slicesOfMeanY, start, end)
-  stringToSlices(&rowBWRDFT.sigmaX, bwrdft.slicesOfSigmaX, start, end)
-  stringToSlices(&rowBWRDFT.sigmaY, bwrdft.slicesOfSigmaY, start, end)
   stringToSlices(&rowBWRDFT.dXY, bwrdft.slicesOfDXY, start, end)
 }
 
-/* Helper function: update matrix */
+/* Serialize RowSeries to SeriesSketch */
+func deserializRowSeries(rowSeries *RowSeries, seriesSketch *SeriesSketch, start int, end int) {
+  seriesSketch.location = rowSeries.location
+  stringToSlices(&rowSeries.mean, seriesSketch.slicesOfMean, start, end)
+  stringToSlices(&rowSeries.sigma, seriesSketch.slicesOfSigma, start, end)
+  stringToSlices(&rowSeries.sumSquared, seriesSketch.slicesOfSumSquared, start, end)
+  stringToSlices(&rowSeries.count, seriesSketch.slicesOfCount, start, end)
+}
+
+/* Store the location index (row -> location) next to the sketch */
+func insertLocationIndex(db *sql.DB, dataset *Dataset) {
+  var statementSB strings.Builder
+  statementSB.WriteString(fmt.Sprintf("INSERT INTO %s %s VALUES ", indextablename, indexheader))
+  for row, location := range dataset.locations {
+    if row > 0 {
+      statementSB.WriteString(",")
+    }
+    statementSB.WriteString(fmt.Sprintf(" (%d, %d, %d, %d)", row, location, dataset.latitudes[row], dataset.longitudes[row]))
+  }
+  statementSB.WriteString(";")
+  insertRowsBWR(db, &statementSB)
+}
+
+/* Read the stored location index, ordered by row */
+func queryLocationIndex(db *sql.DB) []int {
+  sqlStatement := fmt.Sprintf("SELECT location FROM %s ORDER BY rowindex", indextablename)
+  rows, err := db.Query(sqlStatement)
+  if err != nil {
+    panic(err)
+  }
+  defer rows.Close()
+  var locations []int
+  for rows.Next() {
+    var location int
+    if err = rows.Scan(&location); err != nil {
+      panic(err)
+    }
+    locations = append(locations, location)
+  }
+  return locations
+}
+
+/* Make sure the sketch in db was built with the same rows as the dataset */
+func checkLocationIndex(db *sql.DB, dataset *Dataset) {
+  if !dataset.matchesIndex(queryLocationIndex(db)) {
+    panic("ERROR: stored location index does not match the loaded dataset")
+  }
+}
+
+/* Helper function: update matrix. Each basic window is weighted by its number of values */
 func updateMatrix(matrix *([][]int), thres float64, pair *Pair, slicesOfMeanX *([]float64), slicesOfMeanY *([]float64), 
-  slicesOfSigmaX *([]float64), slicesOfSigmaY *([]float64), slicesOfCXY *([]float64), slicesOfDXY *([]float64), isDFT bool, accurateMatrix *([][]float64)) {
+  slicesOfSigmaX *([]float64), slicesOfSigmaY *([]float64), slicesOfCount *([]float64), slicesOfCXY *([]float64), slicesOfDXY *([]float64), isDFT bool, accurateMatrix *([][]float64)) {
+  corr := getCorrelationOfWindows(slicesOfMeanX, slicesOfMeanY, slicesOfSigmaX, slicesOfSigmaY, slicesOfCount, slicesOfCXY, slicesOfDXY, isDFT)
+  setCorrelation(matrix, thres, pair, corr, accurateMatrix)
+}
+
+/* Helper function: combine the basic window statistics of a pair into its correlation */
+func getCorrelationOfWindows(slicesOfMeanX *([]float64), slicesOfMeanY *([]float64), slicesOfSigmaX *([]float64), slicesOfSigmaY *([]float64),
+  slicesOfCount *([]float64), slicesOfCXY *([]float64), slicesOfDXY *([]float64), isDFT bool) float64 {
   var corr float64 = 0
   var numerator float64 = 0
   var demoninator1 float64 = 0
   var demoninator2 float64 = 0
-  meanXValue := getAvg(slicesOfMeanX)
-  meanYValue := getAvg(slicesOfMeanY)
-  slicesOfDeltaX := make([]float64, len(*slicesOfMeanX))
-  slicesOfDeltaY := make([]float64, len(*slicesOfMeanY))
-  size := len(slicesOfDeltaX)
+  size := len(*slicesOfMeanX)
+  var meanXValue, meanYValue, count float64 = 0, 0, 0
+  for i := 0; i < size; i += 1 {
+    meanXValue += (*slicesOfCount)[i] * (*slicesOfMeanX)[i]
+    meanYValue += (*slicesOfCount)[i] * (*slicesOfMeanY)[i]
+    count += (*slicesOfCount)[i]
+  }
+  meanXValue /= count
+  meanYValue /= count
+  slicesOfDeltaX := make([]float64, size)
+  slicesOfDeltaY := make([]float64, size)
   for i := 0; i < size; i += 1 {
     slicesOfDeltaX[i] = (*slicesOfMeanX)[i] - meanXValue
     slicesOfDeltaY[i] = (*slicesOfMeanY)[i] - meanYValue
   }
   for i := 0; i < size; i += 1 {
+    weight := (*slicesOfCount)[i]
     if !isDFT {
-      numerator += (*slicesOfSigmaX)[i] * (*slicesOfSigmaY)[i] * (*slicesOfCXY)[i] + slicesOfDeltaX[i] * slicesOfDeltaY[i]
+      numerator += weight * ((*slicesOfSigmaX)[i] * (*slicesOfSigmaY)[i] * (*slicesOfCXY)[i] + slicesOfDeltaX[i] * slicesOfDeltaY[i])
     } else {
-      numerator += (*slicesOfSigmaX)[i] * (*slicesOfSigmaY)[i] * (*slicesOfDXY)[i] * (*slicesOfDXY)[i] - 2 * (*slicesOfSigmaX)[i] * (*slicesOfSigmaY)[i] - 2 * slicesOfDeltaX[i] * slicesOfDeltaY[i]
+      numerator += weight * ((*slicesOfSigmaX)[i] * (*slicesOfSigmaY)[i] * (*slicesOfDXY)[i] * (*slicesOfDXY)[i] - 2 * (*slicesOfSigmaX)[i] * (*slicesOfSigmaY)[i] - 2 * slicesOfDeltaX[i] * slicesOfDeltaY[i])
     }
-    demoninator1 += (*slicesOfSigmaX)[i] * (*slicesOfSigmaX)[i] + slicesOfDeltaX[i] * slicesOfDeltaX[i]
-    demoninator2 += (*slicesOfSigmaY)[i] * (*slicesOfSigmaY)[i] + slicesOfDeltaY[i] * slicesOfDeltaY[i]
+    demoninator1 += weight * ((*slicesOfSigmaX)[i] * (*slicesOfSigmaX)[i] + slicesOfDeltaX[i] * slicesOfDeltaX[i])
+    demoninator2 += weight * ((*slicesOfSigmaY)[i] * (*slicesOfSigmaY)[i] + slicesOfDeltaY[i] * slicesOfDeltaY[i])
   }
-  if !isDFT {
+  if demoninator1 <= 0 || demoninator2 <= 0 {
+    // Constant over the query window, see displayConstantSeries
+    corr = 0
+  } else if !isDFT {
     corr = numerator/(math.Sqrt(demoninator1) * math.Sqrt(demoninator2))
   } else {
     var dSquare float64 = 2 + numerator / (math.Sqrt(demoninator1) * math.Sqrt(demoninator2))
     corr = 1 - 0.5 * dSquare
   }
+  return corr
+}
+
+/* Helper function: store the correlation of a pair, it is connected if it reaches thres and disconnected otherwise */
+func setCorrelation(matrix *([][]int), thres float64, pair *Pair, corr float64, accurateMatrix *([][]float64)) {
   if accurateMatrix != nil {
     (*accurateMatrix)[pair.indexOfRow][pair.indexOfCol] = corr
     (*accurateMatrix)[pair.indexOfCol][pair.indexOfRow] = corr
   }
+  var connected int = 0
   if math.Abs(corr) >= thres {
-    (*matrix)[pair.indexOfRow][pair.indexOfCol] = 1
-    (*matrix)[pair.indexOfCol][pair.indexOfRow] = 1
+    connected = 1
   }
+  (*matrix)[pair.indexOfRow][pair.indexOfCol] = connected
+  (*matrix)[pair.indexOfCol][pair.indexOfRow] = connected
 }
 
-/* Helper function: update matrix for DFT incremental method */
-func updateMatrixUpdate(matrix *([][]int), thres float64, pair *Pair, slicesOfMeanX *([]float64), slicesOfMeanY *([]float64), 
-  slicesOfSigmaX *([]float64), slicesOfSigmaY *([]float64), slicesOfCXY *([]float64), slicesOfDXY *([]float64), slicesOfSumSquaredX *([]float64), slicesOfSumSquaredY *([]float64),
-  granularity int, bwrNew *BasicWindowDFTResult, accurateMatrix *([][]float64)) {
-  var corr float64 = 0
-  meanXValue := getAvg(slicesOfMeanX)
-  meanYValue := getAvg(slicesOfMeanY)
-  size := len(*slicesOfMeanX)
-  slicesOfDeltaX := make([]float64, size)
-  slicesOfDeltaY := make([]float64, size)
-  for i := 0; i < 1; i += 1 { // Only compute index 0
-    slicesOfDeltaX[i] = (*slicesOfMeanX)[i] - meanXValue
-    slicesOfDeltaY[i] = (*slicesOfMeanY)[i] - meanYValue
-  }
-
-  var stdX, stdY float64
-  var sumOfXSquared float64 = getSum(slicesOfSumSquaredX)
-  var sumOfYSquared float64 = getSum(slicesOfSumSquaredY)
-  var sumOfX float64 = meanXValue * float64(size)
-  var sumOfY float64 = meanYValue * float64(size)
-  var n float64 = float64(granularity * size)
-  stdX = math.Sqrt((sumOfXSquared/n)-((sumOfX*sumOfX)/(n*n)))
-  stdY = math.Sqrt((sumOfYSquared/n)-((sumOfY*sumOfY)/(n*n)))
-
-  var alphaX float64 = ((*bwrNew.slicesOfMeanX)[0] - (*slicesOfMeanX)[0]) / float64(size)
-  var alphaY float64 = ((*bwrNew.slicesOfMeanY)[0] - (*slicesOfMeanY)[0]) / float64(size)
-
-  var deltaXNew float64 = (*bwrNew.slicesOfMeanX)[0] - meanXValue
-  var deltaYNew float64 = (*bwrNew.slicesOfMeanY)[0] - meanYValue
-
-  var dNew float64 = (*bwrNew.slicesOfDXY)[0]
-  var cNew float64 = 1 - 0.5 * dNew * dNew
+/* Helper function: update matrix with the statistics of a pair and the sketches of its two series */
+func updateMatrixBWR(matrix *([][]int), thres float64, pair *Pair, seriesSketches *([]SeriesSketch),
+  slicesOfCXY *([]float64), slicesOfDXY *([]float64), isDFT bool, accurateMatrix *([][]float64)) {
+  seriesSketchX := &((*seriesSketches)[pair.indexOfRow])
+  seriesSketchY := &((*seriesSketches)[pair.indexOfCol])
+  updateMatrix(matrix, thres, pair, seriesSketchX.slicesOfMean, seriesSketchY.slicesOfMean, seriesSketchX.slicesOfSigma, seriesSketchY.slicesOfSigma,
+    seriesSketchX.slicesOfCount, slicesOfCXY, slicesOfDXY, isDFT, accurateMatrix)
+}
 
-  var A float64 = math.Sqrt(float64(size) * stdX*stdX - (*slicesOfSigmaX)[0]*(*slicesOfSigmaX)[0]) - slicesOfDeltaX[0]*slicesOfDeltaX[0] + (*bwrNew.slicesOfSigmaX)[0]*(*bwrNew.slicesOfSigmaX)[0] - float64(size)*alphaX*alphaX + deltaXNew*deltaXNew
-  var B float64 = math.Sqrt(float64(size) * stdY*stdY - (*slicesOfSigmaY)[0]*(*slicesOfSigmaY)[0]) - slicesOfDeltaY[0]*slicesOfDeltaY[0] + (*bwrNew.slicesOfSigmaY)[0]*(*bwrNew.slicesOfSigmaY)[0] - float64(size)*alphaY*alphaY + deltaYNew*deltaYNew
-  var oldCorr float64 = (*accurateMatrix)[pair.indexOfRow][pair.indexOfCol]
-  corr = (float64(size)*stdX*stdY*oldCorr + (*bwrNew.slicesOfSigmaX)[0]*(*bwrNew.slicesOfSigmaY)[0]*cNew - (*slicesOfSigmaX)[0]*(*slicesOfSigmaY)[0]*(1-0.5*(*slicesOfDXY)[0]*(*slicesOfDXY)[0]) - slicesOfDeltaX[0]*slicesOfDeltaY[0] - float64(size)*alphaX*alphaY + deltaXNew*deltaYNew) / (A*B)
+/* Helper function: update matrix for the DFT incremental method. The running sums of the pair slide by the expired and
+   coming basic windows in O(1) per window, with every cXY estimated from dXY like in the query, so the result equals a
+   query of the shifted sketch. The series aggregates are already slid. The new correlation is stored in accurateMatrix
+   and the slid sums are kept in pairAggregate, the next update continues from them */
+func updateMatrixUpdate(matrix *([][]int), thres float64, pair *Pair, seriesAggregateX *SeriesAggregate, seriesAggregateY *SeriesAggregate,
+  pairAggregate *PairAggregate, seriesSketchXOld *SeriesSketch, seriesSketchYOld *SeriesSketch, bwrdftOld *BasicWindowDFTResult,
+  seriesSketchXComing *SeriesSketch, seriesSketchYComing *SeriesSketch, bwrdftComing *BasicWindowDFTResult, replaceLast bool,
+  accurateMatrix *([][]float64)) {
+  pairAggregate.slide(seriesAggregateX, seriesAggregateY, seriesSketchXOld, seriesSketchYOld, bwrdftOld.slicesOfDXY,
+    seriesSketchXComing, seriesSketchYComing, bwrdftComing.slicesOfDXY, replaceLast, true)
+  setCorrelation(matrix, thres, pair, getRunningCorrelation(seriesAggregateX, seriesAggregateY, pairAggregate), accurateMatrix)
+}
 
-  if math.Abs(corr) >= thres {
-    (*matrix)[pair.indexOfRow][pair.indexOfCol] = 1
-    (*matrix)[pair.indexOfCol][pair.indexOfRow] = 1
+/* Get the range of basic windows to query, a negative queryEnd means all basic windows */
+func getQueryRange(queryStart int, queryEnd int, numberOfBasicwindows int) (int, int) {
+  if queryEnd < 0 {
+    return 0, numberOfBasicwindows
   }
+  return queryStart, queryEnd
 }
 
-/* Query by the range of ids, updates matrix meanwhile */
+/* Query by the range of ids, updates matrix meanwhile. seriesSketches hold the statistics of the queried basic windows only */
 func queryRowsDB(db *sql.DB, tableName string, 
-  startID int, endID int, matrix *([][]int), thres float64, numberOfBasicwindows int, isDFT bool, 
-  queryStart int, queryEnd int) string {
+  startID int, endID int, matrix *([][]int), accurateMatrix *([][]float64), thres float64, windows *StoredWindows, isDFT bool, 
+  queryStart int, queryEnd int, seriesSketches *([]SeriesSketch)) string {
+  queryStart, queryEnd = windows.getQueryRange(queryStart, queryEnd)
+  lengthOfSlices := queryEnd - queryStart
   sqlStatement := fmt.Sprintf("SELECT * FROM %s WHERE id >= %d AND id < %d",
     tableName, startID, endID)
   t0 := time.Now()
+  // Windows written by updates replace the stored ones
+  updates := queryPairUpdates(db, tableName, startID, endID, queryStart, queryEnd, isDFT)
   rows, err := db.Query(sqlStatement)
   elapsed := time.Since(t0)
   if err != nil {
     panic(err)
   }
   defer rows.Close()
-  lengthOfSlices := queryEnd - queryStart
-  if queryEnd < 0 {
-    lengthOfSlices = numberOfBasicwindows
-    queryStart = 0
-    queryEnd = numberOfBasicwindows
-  }
   var rowBWR RowBWR
   var rowBWRDFT RowBWRDFT
   for rows.Next() {
     var id int
     var pair string
-    var meanX string
-    var meanY string
-    var sigmaX string
-    var sigmaY string
     var cXY string
     var dXY string
     if !isDFT {
-      err = rows.Scan(&id, &pair, &meanX, &meanY, &sigmaX, &sigmaY, &cXY)
+      err = rows.Scan(&id, &pair, &cXY)
     } else {
-      err = rows.Scan(&id, &pair, &meanX, &meanY, &sigmaX, &sigmaY, &dXY)
+      err = rows.Scan(&id, &pair, &dXY)
     }
     if err != nil {
       panic(err)
     }
-    rowBWR = RowBWR{SerializedPair{pair}, meanX, meanY, sigmaX, sigmaY, cXY}
+    rowBWR = RowBWR{SerializedPair{pair}, cXY}
     if isDFT {
-      rowBWRDFT = RowBWRDFT{SerializedPair{pair}, meanX, meanY, sigmaX, sigmaY, dXY}
+      rowBWRDFT = RowBWRDFT{SerializedPair{pair}, dXY}
     }
-    slicesOfMeanX := make([]float64, lengthOfSlices)
-    slicesOfMeanY := make([]float64, lengthOfSlices)
-    slicesOfSigmaX := make([]float64, lengthOfSlices)
-    slicesOfSigmaY := make([]float64, lengthOfSlices)
     slicesOfCXY := make([]float64, lengthOfSlices)
     slicesOfDXY := make([]float64, lengthOfSlices)
-    var bwr BasicWindowResult = BasicWindowResult{Pair{0, 0, 0, 0}, &slicesOfMeanX, &slicesOfMeanY, &slicesOfSigmaX, &slicesOfSigmaY, &slicesOfCXY}
-    var bwrdft BasicWindowDFTResult = BasicWindowDFTResult{Pair{0, 0, 0, 0}, &slicesOfMeanX, &slicesOfMeanY, &slicesOfSigmaX, &slicesOfSigmaY, &slicesOfDXY, nil, nil}
+    var bwr BasicWindowResult = BasicWindowResult{Pair{0, 0, 0, 0}, &slicesOfCXY}
+    var bwrdft BasicWindowDFTResult = BasicWindowDFTResult{Pair{0, 0, 0, 0}, &slicesOfDXY, nil}
+    // Join the pair statistics with the statistics of its two series
     if !isDFT {
       deserializRowBWR(&rowBWR, &bwr, queryStart, queryEnd)
+      applyWindowValues(bwr.slicesOfCXY, updates[id], queryStart)
       // Update matrix
-      updateMatrix(matrix, thres, &(bwr.pair), bwr.slicesOfMeanX, bwr.slicesOfMeanY, bwr.slicesOfSigmaX, bwr.slicesOfSigmaY, bwr.slicesOfCXY, nil, false, nil)
+      updateMatrixBWR(matrix, thres, &(bwr.pair), seriesSketches, bwr.slicesOfCXY, nil, false, accurateMatrix)
     } else {
       deserializRowBWRDFT(&rowBWRDFT, &bwrdft, queryStart, queryEnd)
+      applyWindowValues(bwrdft.slicesOfDXY, updates[id], queryStart)
       // Update matrix
-      updateMatrix(matrix, thres, &(bwrdft.pair), bwrdft.slicesOfMeanX, bwrdft.slicesOfMeanY, bwrdft.slicesOfSigmaX, bwrdft.slicesOfSigmaY, nil, bwrdft.slicesOfDXY, true, nil)
+      updateMatrixBWR(matrix, thres, &(bwrdft.pair), seriesSketches, nil, bwrdft.slicesOfDXY, true, accurateMatrix)
     }
   }
   return fmt.Sprintf("%v", elapsed)
@@ -584,116 +694,6 @@ func stringToSecondsHelper(time string, indexPtr *int) float64 {
   return 0
 }
 
-/* Transfer a line ([]byte) to Point */
-func processLine(line []byte) Point {
-  var lineString string = string(line[:])
-  strSlices := strings.Split(lineString, ",")
-  dataPoint := Point{-1, -1, -1, -1, 0}
-  for index, str := range strSlices {
-    intVal, intErr := strconv.Atoi(str)
-    if (index < 3 && intErr != nil) {
-      break
-    }
-    switch index {
-      case 0:
-        dataPoint.timestamp = intVal
-      case 1:
-        dataPoint.latitude = intVal
-      case 2:
-        dataPoint.longitude = intVal
-      case 3:
-        str = strings.TrimRight(str, "\n")
-        str = strings.TrimRight(str, "\r")
-        floatVal, _ := strconv.ParseFloat(str, 64)
-        dataPoint.location = dataPoint.longitude + 1000 * dataPoint.latitude
-        dataPoint.temperature = floatVal
-      default:
-        fmt.Println("WARNING: Invalid number of items!")
-        break
-    }
-  }
-  return dataPoint
-}
-
-/* Arguments: before: set timestamp limit, count: set number of locations limit */
-func ReadLine(filePth string, dataMap *(map[int][]Point), 
-              before int, count int) error {
-  f, err := os.Open(filePth)
-  if err != nil {
-    return err
-  }
-  fmt.Println("Open file: SUCCESS")
-  //defer f.Close()
-
-  memo := map[int]bool{}
-
-  bfRd := bufio.NewReader(f)
-  //i := 0
-  for {
-    line, err := bfRd.ReadBytes('\n')
-    if err != nil {
-      if err == io.EOF {
-        fmt.Println(len((*dataMap)[1]))
-        f.Close()
-        return nil
-      }
-      fmt.Println(err)
-      f.Close()
-      return err
-    }
-    dataPoint := processLine(line)
-    if dataPoint.timestamp < 0 {
-      continue
-    }
-
-    if before > 0 && dataPoint.timestamp >= before {
-      break
-    }
-
-    //
-    if count < 0 {
-      _, ok := (*dataMap)[dataPoint.location]
-      if !ok {
-        var points []Point
-        points = append(points, dataPoint)
-        (*dataMap)[dataPoint.location] = points
-      } else {
-        (*dataMap)[dataPoint.location] = append((*dataMap)[dataPoint.location], dataPoint)
-      }
-      continue
-    }
-    _, ok_memo := memo[dataPoint.location]
-    _, ok := (*dataMap)[dataPoint.location]
-    if len(memo) < count {
-      if ok_memo || ok {
-        panic("ERROR")
-      }
-      var points []Point
-      points = append(points, dataPoint)
-      (*dataMap)[dataPoint.location] = points
-      // Update memo
-      memo[dataPoint.location] = true
-      //fmt.Println("location: ", dataPoint.location)
-    } else {
-      if (!ok_memo) {
-        continue
-      }
-      if !ok {
-        panic("ERROR!")
-      }
-      if (ok) {
-        (*dataMap)[dataPoint.location] = append((*dataMap)[dataPoint.location], dataPoint)
-        //fmt.Println("location_1: ", dataPoint.location)
-      }
-    }
-
-    //displayPoint(dataPoint) // For debugging
-    //i += 1
-  }
-  f.Close()
-  return nil
-}
-
 /* Set all items in the mastrix as 0 */
 func clearMatrix(matrix *([][]int)) {
   for i := 0; i < len(*matrix); i += 1 {
@@ -724,13 +724,9 @@ func checkMatrix(matrix *([][]int)) int {
   return sumOfConnectedPairs
 }
 
-/* Get locations from given dataMap */
-func getLocations(dataMap *(map[int][]Point), locations *([]int)) {
-  i := 0
-  for key := range *dataMap {
-    (*locations)[i] = key
-    i += 1
-  }
+/* Get locations from given dataset, in row order */
+func getLocations(dataset *Dataset, locations *([]int)) {
+  copy(*locations, dataset.locations)
 }
 
 // N <= w
@@ -747,138 +743,99 @@ func getDFTResult(sigma float64, avg float64, w int, N int,
   }
 }
 
-/* Get euclidean distance */
-func getEuclideanDistance(left *([]complex128), right *([]complex128)) float64 {
-  var res float64 = 0
-  for i := 0; i < len(*left); i += 1 {
-    diff := cmplx.Abs((*left)[i] - (*right)[i])
-    res += diff * diff
+/* Get the number of basic windows, a trailing partial window counts as one */
+func getNumberOfBasicwindows(dataset *Dataset, granularity int) int {
+  return getNumberOfBasicwindowsOfLength(dataset.length(), granularity)
+}
+
+/* Get the number of basic windows of a series of given length */
+func getNumberOfBasicwindowsOfLength(length int, granularity int) int {
+  return (length + granularity - 1)/granularity
+}
+
+/* Helper function: get the statistics of every basic window of one series */
+func getSeriesSketch(series []float64, location int, granularity int, seriesSketch *SeriesSketch) {
+  numberOfBasicwindows := getNumberOfBasicwindowsOfLength(len(series), granularity)
+  slicesOfMean := make([]float64, numberOfBasicwindows)
+  slicesOfSigma := make([]float64, numberOfBasicwindows)
+  slicesOfSumSquared := make([]float64, numberOfBasicwindows)
+  slicesOfCount := make([]float64, numberOfBasicwindows)
+  for basicWindowIndex := 0; basicWindowIndex < numberOfBasicwindows; basicWindowIndex += 1 {
+    var moments Moments
+    for k := basicWindowIndex * granularity; k < (basicWindowIndex + 1) * granularity && k < len(series); k += 1 {
+      moments.addX(series[k])
+    }
+    slicesOfMean[basicWindowIndex] = moments.meanX
+    slicesOfSigma[basicWindowIndex] = moments.sigmaX()
+    slicesOfSumSquared[basicWindowIndex] = moments.sumSquaredX()
+    slicesOfCount[basicWindowIndex] = moments.count
   }
-  return math.Sqrt(res)
+  seriesSketch.location = location
+  seriesSketch.slicesOfMean = &slicesOfMean
+  seriesSketch.slicesOfSigma = &slicesOfSigma
+  seriesSketch.slicesOfSumSquared = &slicesOfSumSquared
+  seriesSketch.slicesOfCount = &slicesOfCount
 }
 
-/* Get the number of basic windows */
-func getNumberOfBasicwindows(dataMap *(map[int][]Point), granularity int) int {
-  locationsNum := len(*dataMap)
-  locations := make([]int, locationsNum)
-  getLocations(dataMap, &locations)
-  return len((*dataMap)[locations[0]])/granularity
+/* Sketch every series once, indexed by row */
+func getSeriesSketches(dataset *Dataset, granularity int) []SeriesSketch {
+  seriesSketches := make([]SeriesSketch, dataset.numOfLocations())
+  var buf []float64
+  for row := range seriesSketches {
+    getSeriesSketch(dataset.series(row, &buf), dataset.locations[row], granularity, &seriesSketches[row])
+  }
+  return seriesSketches
 }
 
-/* Helper function: get bwr from a specific pair, also get number of basic windows and store the value to the reference */
-func getBasicWindowResult(dataMap *(map[int][]Point), granularity int,
-  pair *Pair, bwr *BasicWindowResult, bwrdft *BasicWindowDFTResult, isDFT bool, ratio float64) {
+/* Helper function: get bwr from a specific pair. Only the cross statistics (cXY or dXY) are kept, see getSeriesSketches for the rest */
+func getBasicWindowResult(dataset *Dataset, granularity int,
+  pair *Pair, bwr *BasicWindowResult, bwrdft *BasicWindowDFTResult, isDFT bool, seriesDFTs *([][][]complex128)) {
   // Pair{leftLocation, rightLocation, i, j}
-  leftPointsSlices := (*dataMap)[pair.leftLocation]
-  rightPointsSlices := (*dataMap)[pair.rightLocation]
-  numberOfBasicwindows := len(leftPointsSlices)/granularity
+  numberOfBasicwindows := getNumberOfBasicwindows(dataset, granularity)
+  if isDFT {
+    slicesOfDXY := make([]float64, numberOfBasicwindows)
+    slicesOfBound := make([]float64, numberOfBasicwindows)
+    for basicWindowIndex := 0; basicWindowIndex < numberOfBasicwindows; basicWindowIndex += 1 {
+      // Coefficients are computed once per series and basic window, see getSeriesDFTs
+      slicesOfDXY[basicWindowIndex], slicesOfBound[basicWindowIndex] = getSpectralDistance((*seriesDFTs)[pair.indexOfRow][basicWindowIndex], (*seriesDFTs)[pair.indexOfCol][basicWindowIndex])
+    }
+    bwrdft.pair = *pair
+    bwrdft.slicesOfDXY = &slicesOfDXY
+    bwrdft.slicesOfBound = &slicesOfBound
+    return
+  }
+  var bufX, bufY []float64
+  leftSeries := dataset.series(pair.indexOfRow, &bufX)
+  rightSeries := dataset.series(pair.indexOfCol, &bufY)
   var basicWindowIndex int = 0
   // Statistics for basic windows
-  var count float64 = 0
-  var sumOfX float64 = 0
-  var sumOfY float64 = 0
-  var sumSquaredX float64 = 0
-  var sumSquaredY float64 = 0
-  var sumOfXY float64 = 0
-  var countOfRemained float64 = 0
-  var sumOfXRemained float64 = 0
-  var sumOfYRemained float64 = 0
-  var sumSquaredXRemained float64 = 0
-  var sumSquaredYRemained float64 = 0
-  var sumOfXYRemained float64 = 0
-  slicesOfMeanX := make([]float64, numberOfBasicwindows)
-  slicesOfMeanY := make([]float64, numberOfBasicwindows)
-  slicesOfSigmaX := make([]float64, numberOfBasicwindows)
-  slicesOfSigmaY := make([]float64, numberOfBasicwindows)
+  var moments Moments
   slicesOfCXY := make([]float64, numberOfBasicwindows)
-  slicesOfDXY := make([]float64, numberOfBasicwindows)
-  // Slices for DFT
-  slicesOfRemainedX := make([]float64, granularity)
-  slicesOfRemainedY := make([]float64, granularity)
-  slicesOfSumSquaredX := make([]float64, numberOfBasicwindows)
-  slicesOfSumSquaredY := make([]float64, numberOfBasicwindows)
   // Compute basic window statistics
-  for k := 0; k < len(leftPointsSlices); k += 1 {
-    if isDFT {
-      slicesOfRemainedX[int(countOfRemained)] = leftPointsSlices[k].temperature
-      slicesOfRemainedY[int(countOfRemained)] = rightPointsSlices[k].temperature
-    }
-    countOfRemained += 1
-    sumOfXRemained += leftPointsSlices[k].temperature
-    sumOfYRemained += rightPointsSlices[k].temperature
-    sumSquaredXRemained += leftPointsSlices[k].temperature * leftPointsSlices[k].temperature
-    sumSquaredYRemained += rightPointsSlices[k].temperature * rightPointsSlices[k].temperature
-    sumOfXYRemained += leftPointsSlices[k].temperature * rightPointsSlices[k].temperature
-    if int(countOfRemained) == granularity {
-      var sigmaX float64 = math.Sqrt((sumSquaredXRemained/countOfRemained) - (sumOfXRemained*sumOfXRemained)/(countOfRemained*countOfRemained))
-      var sigmaY float64 = math.Sqrt((sumSquaredYRemained/countOfRemained) - (sumOfYRemained*sumOfYRemained)/(countOfRemained*countOfRemained))
-      var cXY float64 = (countOfRemained*sumOfXYRemained - sumOfXRemained*sumOfYRemained)/
-                        (math.Sqrt(countOfRemained*sumSquaredXRemained - sumOfXRemained*sumOfXRemained)*
-                        math.Sqrt(countOfRemained*sumSquaredYRemained - sumOfYRemained*sumOfYRemained))
-      if (countOfRemained*sumOfXYRemained - sumOfXRemained*sumOfYRemained) == 0 {
-        cXY = 0
-      }
-      // Update statistics
-      count += countOfRemained
-      sumOfX += sumOfXRemained
-      sumOfY += sumOfYRemained
-      sumSquaredX += sumSquaredXRemained
-      sumSquaredY += sumSquaredYRemained
-      sumOfXY += sumOfXYRemained
-      slicesOfMeanX[basicWindowIndex] = sumOfXRemained/countOfRemained
-      slicesOfMeanY[basicWindowIndex] = sumOfYRemained/countOfRemained
-      slicesOfSigmaX[basicWindowIndex] = sigmaX
-      slicesOfSigmaY[basicWindowIndex] = sigmaY
+  for k := 0; k < len(leftSeries); k += 1 {
+    moments.add(leftSeries[k], rightSeries[k])
+    // The last basic window keeps the remaining values
+    if int(moments.count) == granularity || k == len(leftSeries) - 1 {
+      // A constant window has no correlation, it only contributes through its mean
+      cXY, _ := moments.correlation()
       slicesOfCXY[basicWindowIndex] = cXY
-      if isDFT {
-        N := int(float64(granularity)*ratio)
-        slicesDFTX := make([]complex128, N)
-        slicesDFTY := make([]complex128, N)
-        getDFTResult(sigmaX, sumOfXRemained/countOfRemained, granularity, N, &slicesOfRemainedX, &slicesDFTX)
-        getDFTResult(sigmaY, sumOfYRemained/countOfRemained, granularity, N, &slicesOfRemainedY, &slicesDFTY)
-        d := getEuclideanDistance(&slicesDFTX, &slicesDFTY)
-        slicesOfDXY[basicWindowIndex] = d
-        // For DFT updates
-        slicesOfSumSquaredX[basicWindowIndex] = sumSquaredXRemained
-        slicesOfSumSquaredY[basicWindowIndex] = sumSquaredYRemained
-      }
       // Reset remained values
-      countOfRemained = 0
-      sumOfXRemained = 0
-      sumOfYRemained = 0
-      sumSquaredXRemained = 0
-      sumSquaredYRemained = 0
-      sumOfXYRemained = 0
+      moments = Moments{}
       // Basic Window Index increment
       basicWindowIndex += 1
     }
   }
-  if !isDFT {
-    bwr.pair = *pair
-    bwr.slicesOfMeanX = &slicesOfMeanX
-    bwr.slicesOfMeanY = &slicesOfMeanY
-    bwr.slicesOfSigmaX = &slicesOfSigmaX
-    bwr.slicesOfSigmaY = &slicesOfSigmaY
-    bwr.slicesOfCXY = &slicesOfCXY
-  } else {
-    bwrdft.pair = *pair
-    bwrdft.slicesOfMeanX = &slicesOfMeanX
-    bwrdft.slicesOfMeanY = &slicesOfMeanY
-    bwrdft.slicesOfSigmaX = &slicesOfSigmaX
-    bwrdft.slicesOfSigmaY = &slicesOfSigmaY
-    bwrdft.slicesOfDXY = &slicesOfDXY
-    bwrdft.slicesOfSumSquaredX = &slicesOfSumSquaredX
-    bwrdft.slicesOfSumSquaredY = &slicesOfSumSquaredY
-  }
+  bwr.pair = *pair
+  bwr.slicesOfCXY = &slicesOfCXY
 }
 
 /* Sketching part for TSUBASA */
-func getBasicWindows(dataMap *(map[int][]Point), granularity int, 
-  db *sql.DB, id *int, blockSize int, tableName string, header string, isDFT bool, ratio float64) {
+func getBasicWindows(dataset *Dataset, granularity int, 
+  db *sql.DB, id *int, blockSize int, tableName string, header string, isDFT bool, ratio float64, energy float64) {
   // Get locations
-  locationsNum := len(*dataMap)
+  locationsNum := dataset.numOfLocations()
   locations := make([]int, locationsNum)
-  getLocations(dataMap, &locations)
+  getLocations(dataset, &locations)
   // Nested loops
   var i, j int
   *id = 0 // Set *id to 0
@@ -886,6 +843,10 @@ func getBasicWindows(dataMap *(map[int][]Point), granularity int,
   blockInsertionSQLStarter := fmt.Sprintf("INSERT INTO %s %s VALUES ", tableName, header)
   var statementSB strings.Builder
   statementSB.WriteString(blockInsertionSQLStarter)
+  var seriesDFTs [][][]complex128
+  if isDFT {
+    seriesDFTs = getSeriesDFTs(dataset, granularity, ratio, energy)
+  }
   for i = 0; i < locationsNum; i += 1 {
     for j = i + 1; j < locationsNum; j += 1 {
       var leftLocation int = locations[i]
@@ -894,9 +855,9 @@ func getBasicWindows(dataMap *(map[int][]Point), granularity int,
       var bwr BasicWindowResult
       var bwrdft BasicWindowDFTResult
       if !isDFT {
-        getBasicWindowResult(dataMap, granularity, &pair, &bwr, nil, isDFT, ratio)
+        getBasicWindowResult(dataset, granularity, &pair, &bwr, nil, isDFT, nil)
       } else {
-        getBasicWindowResult(dataMap, granularity, &pair, nil, &bwrdft, isDFT, ratio)
+        getBasicWindowResult(dataset, granularity, &pair, nil, &bwrdft, isDFT, &seriesDFTs)
       }
       if blockSize <= 0 {
         if !isDFT {
@@ -936,12 +897,10 @@ func getBasicWindows(dataMap *(map[int][]Point), granularity int,
 }
 
 /* TSUBASA */
-func networkConstructionBW(dataMap *(map[int][]Point), matrix *([][]int), thres float64, granularity int, 
-  writeBlockSize int, readBlockSize int, isDFT bool, ratio float64, queryStart int, queryEnd int) {
-  // Create a new database
-  createNewDB(dbname)
+func networkConstructionBW(dataset *Dataset, matrix *([][]int), thres float64, granularity int, 
+  writeBlockSize int, readBlockSize int, isDFT bool, ratio float64, energy float64, queryStart int, queryEnd int, datasetNew *Dataset,
+  changes *LocationChanges, sink EdgeSink, useDB bool, keepDB bool) {
   dbName := dbname
-  db := openDB(&dbName) // Open and get the new database
   var tableName, schema, header string
   if (!isDFT) {
     tableName = tablename
@@ -952,16 +911,37 @@ func networkConstructionBW(dataMap *(map[int][]Point), matrix *([][]int), thres
     schema = pairsbwrdftschema
     header = pairsbwrdftheader
   }
-  createTable(db, tableName, schema) // Create a new table for mapping pairs to statistics
-  
-  /* Sketch part */
-  t0 := time.Now()
+  var db *sql.DB
+  var numberOfBasicwindows int
   var id int = 0
-  var numberOfBasicwindows int = getNumberOfBasicwindows(dataMap, granularity)
-  // Store basic window statistics into database
-  getBasicWindows(dataMap, granularity, db, &id, writeBlockSize, tableName, header, isDFT, ratio)
-  elapsed := time.Since(t0)
-  fmt.Println("Sketch time: ", elapsed)
+  if useDB {
+    // The sketch kept by an earlier run is queried and updated without sketching, see updateStoredSketch
+    db = openDB(&dbName)
+    windows := querySketchState(db)
+    numberOfBasicwindows = windows.retained()
+    id = countStoredPairs(db, tableName)
+    fmt.Println(fmt.Sprintf("Stored sketch reused: basic windows [%d, %d), %d pairs", windows.first, windows.end, id))
+  } else {
+    // Create a new database
+    createNewDB(dbname)
+    db = openDB(&dbName) // Open and get the new database
+    createTable(db, tableName, schema) // Create a new table for mapping pairs to statistics
+    createTable(db, seriestablename, seriesschema) // Create a new table for mapping series to statistics
+    createTable(db, indextablename, indexschema) // Create a new table for mapping rows to locations
+    insertLocationIndex(db, dataset)
+    numberOfBasicwindows = getNumberOfBasicwindows(dataset, granularity)
+    createUpdateTable(db, tableName, isDFT) // Create a new table for the basic windows written by updates
+    createSketchState(db, numberOfBasicwindows)
+
+    /* Sketch part */
+    t0 := time.Now()
+    // Store statistics of each series once
+    seriesSketches := getSeriesSketches(dataset, granularity)
+    insertSeriesSketches(db, &seriesSketches)
+    // Store basic window statistics into database
+    getBasicWindows(dataset, granularity, db, &id, writeBlockSize, tableName, header, isDFT, ratio, energy)
+    fmt.Println("Sketch time: ", time.Since(t0))
+  }
 
   // Check queryStart and queryEnd
   if queryEnd >= 0 {
@@ -971,62 +951,96 @@ func networkConstructionBW(dataMap *(map[int][]Point), matrix *([][]int), thres
   }
 
   /* Query part */
+  checkLocationIndex(db, dataset)
+  accurateMatrix := make([][]float64, dataset.numOfLocations())
+  for i := range accurateMatrix {
+    accurateMatrix[i] = make([]float64, dataset.numOfLocations())
+  }
   t1 := time.Now()
+  queryStoredSketch(db, tableName, id, readBlockSize, matrix, &accurateMatrix, thres, isDFT, queryStart, queryEnd)
+  fmt.Println("Query time: ", time.Since(t1))
+  oldLocations := dataset.locations
+  oldMatrix := copyMatrix(*matrix)
+  oldCorr := copyFloatMatrix(accurateMatrix)
+
+  /* Location changes, the update and the next query use the locations after the changes */
+  if changes != nil {
+    t5 := time.Now()
+    applyStoredLocationChanges(db, []string{tableName}, changes, granularity, isDFT, ratio, energy, writeBlockSize)
+    dataset = changes.dataset
+    datasetNew = changes.datasetNew
+    id = countStoredPairs(db, tableName)
+    resizeMatrix(matrix, &accurateMatrix, dataset.numOfLocations())
+    fmt.Println("Location changes time: ", time.Since(t5))
+  }
+
+  /* Update part, only the statistics of the new basic windows are written */
+  if datasetNew != nil {
+    t2 := time.Now()
+    listOfPairs := [][]Pair{queryStoredPairs(db, tableName)} // pair n has id n
+    updateStoredSketch(db, dataset, datasetNew, granularity, []string{tableName}, listOfPairs, isDFT, ratio, energy, writeBlockSize)
+    fmt.Println("Update time: ", time.Since(t2))
+    clearMatrix(matrix)
+    t3 := time.Now()
+    queryStoredSketch(db, tableName, id, readBlockSize, matrix, &accurateMatrix, thres, isDFT, queryStart, queryEnd)
+    fmt.Println("Query time: ", time.Since(t3))
+    windows := querySketchState(db)
+    sendEdgeChanges(sink, windows.end - 1, oldLocations, oldMatrix, oldCorr, dataset.locations, *matrix, accurateMatrix)
+  }
+  if keepDB {
+    // A later run extends the sketch with usedb=t
+    closeDB(db)
+    fmt.Println("DATABASE KEPT: ", dbname)
+    return
+  }
+  deleteTable(db, tableName) // Delete the table
+  deleteTable(db, tableName + updatetablesuffix)
+  deleteTable(db, seriestablename)
+  deleteTable(db, indextablename)
+  deleteSketchState(db)
+  closeDB(db) // Close the database
+
+  // Delete the database
+  deleteDB(dbname)
+}
+
+/* Query the stored sketch of numOfRows pairs by blocks, returns the time spent reading */
+func queryStoredSketch(db *sql.DB, tableName string, numOfRows int, readBlockSize int, matrix *([][]int), accurateMatrix *([][]float64), thres float64, isDFT bool,
+  queryStart int, queryEnd int) float64 {
   var readTime float64 = 0
+  windows := querySketchState(db)
+  startOfQuery, endOfQuery := windows.getQueryRange(queryStart, queryEnd)
+  seriesSketchesQuery := querySeriesSketches(db, startOfQuery, endOfQuery)
   // Read by blocks
   startID := 0
   endID := 0
-  for startID < id {
-    if startID + readBlockSize > id {
-      endID = id
+  for startID < numOfRows {
+    if startID + readBlockSize > numOfRows {
+      endID = numOfRows
     } else {
       endID = startID + readBlockSize
     }
-    readTimeStr := queryRowsDB(db, tableName, startID, endID, matrix, thres, numberOfBasicwindows, isDFT, queryStart, queryEnd)
+    readTimeStr := queryRowsDB(db, tableName, startID, endID, matrix, accurateMatrix, thres, &windows, isDFT, queryStart, queryEnd, &seriesSketchesQuery)
     readTime += stringToSeconds(readTimeStr)
     startID = endID
   }
-  elapsed = time.Since(t1)
-  fmt.Println("Query time: ", elapsed)
-  deleteTable(db, tableName) // Delete the table
-  closeDB(db) // Close the database
-
-  // Delete the database
-  deleteDB(dbname)
+  return readTime
 }
 
 /* Direct calculation network construction */
-func networkConstructionNaive(dataMap *(map[int][]Point), matrix *([][]int), thres float64) {
-  locationsNum := len(*dataMap)
+func networkConstructionNaive(dataset *Dataset, matrix *([][]int), thres float64, measure string) {
+  locationsNum := dataset.numOfLocations()
   locations := make([]int, locationsNum)
-  getLocations(dataMap, &locations)
+  getLocations(dataset, &locations)
   sumOfConnectedPairs := 0
+  var bufX, bufY []float64
   var i, j int
   for i = 0; i < locationsNum; i += 1 {
     for j = i + 1; j < locationsNum; j += 1 {
-      var leftLocation int = locations[i]
-      var rightLocation int = locations[j]
-      leftPointsSlices := (*dataMap)[leftLocation]
-      rightPointsSlices := (*dataMap)[rightLocation]
-      var count float64 = 0
-      var sumOfX float64 = 0
-      var sumOfY float64 = 0
-      var sumSquaredX float64 = 0
-      var sumSquaredY float64 = 0
-      var sumOfXY float64 = 0
-      var k int
-      for k = 0; k < len(leftPointsSlices); k += 1 {
-        count += 1
-        sumOfX += leftPointsSlices[k].temperature
-        sumOfY += rightPointsSlices[k].temperature
-        sumSquaredX += leftPointsSlices[k].temperature * leftPointsSlices[k].temperature
-        sumSquaredY += rightPointsSlices[k].temperature * rightPointsSlices[k].temperature
-        sumOfXY += leftPointsSlices[k].temperature * rightPointsSlices[k].temperature
-      }
-      std := ((sumOfXY/count) - (sumOfX*sumOfY)/(count*count))/
-      (math.Sqrt((sumSquaredX/count) - ((sumOfX*sumOfX)/(count*count)))*
-        math.Sqrt((sumSquaredY/count) - ((sumOfY*sumOfY)/(count*count))))
-      if math.Abs(std) >= thres {
+      leftSeries := dataset.series(i, &bufX)
+      rightSeries := dataset.series(j, &bufY)
+      std, ok := getCorrelationOfSeries(measure, leftSeries, rightSeries)
+      if ok && math.Abs(std) >= thres {
         (*matrix)[i][j] = 1
         (*matrix)[j][i] = 1
         sumOfConnectedPairs += 1
@@ -1037,35 +1051,62 @@ func networkConstructionNaive(dataMap *(map[int][]Point), matrix *([][]int), thr
 }
 
 /* In-memory network construction */
-func networkConstructionBWInMemo(dataMap *(map[int][]Point), matrix *([][]int), 
-  thres float64, granularity int, isDFT bool, ratio float64, sktechTime *float64, queryTime *float64) {
+func networkConstructionBWInMemo(dataset *Dataset, matrix *([][]int), 
+  thres float64, granularity int, isDFT bool, ratio float64, energy float64, projection *RandomProjection, boundMatrix *([][]float64),
+  checkpointName string, restoreName string, sktechTime *float64, queryTime *float64) {
   var pairWindowsMap map[Pair]BasicWindowResult
   pairWindowsMap = make(map[Pair]BasicWindowResult)
   var pairWindowsMapDFT map[Pair]BasicWindowDFTResult
   pairWindowsMapDFT = make(map[Pair]BasicWindowDFTResult)
 
   // Get locations
-  locationsNum := len(*dataMap)
+  locationsNum := dataset.numOfLocations()
   locations := make([]int, locationsNum)
-  getLocations(dataMap, &locations)
+  getLocations(dataset, &locations)
 
   // Sketch Part
   // Nested loops
   t0 := time.Now()
+  var seriesSketches []SeriesSketch
   var i, j int
-  for i = 0; i < locationsNum; i += 1 {
-    for j = i + 1; j < locationsNum; j += 1 {
-      var leftLocation int = locations[i]
-      var rightLocation int = locations[j]
-      var pair Pair = Pair{leftLocation, rightLocation, i, j}
-      var bwr BasicWindowResult
-      var bwrdft BasicWindowDFTResult
-      if !isDFT {
-        getBasicWindowResult(dataMap, granularity, &pair, &bwr, nil, isDFT, ratio)
-        pairWindowsMap[pair] = bwr
-      } else {
-        getBasicWindowResult(dataMap, granularity, &pair, nil, &bwrdft, isDFT, ratio)
-        pairWindowsMapDFT[pair] = bwrdft
+  if restoreName != "" {
+    // The sketch of a checkpoint of the same locations and values
+    checkpoint := readCheckpoint(restoreName)
+    checkpoint.checkParameters(granularity, isDFT, ratio, energy, 0)
+    if !dataset.matchesIndex(checkpoint.locations) || len(*checkpoint.seriesSketches[0].slicesOfMean) != getNumberOfBasicwindows(dataset, granularity) {
+      panic(fmt.Sprintf("ERROR: checkpoint %s is not a sketch of the loaded locations and values", restoreName))
+    }
+    seriesSketches = checkpoint.seriesSketches
+    pairWindowsMap = checkpoint.pairWindowsMap
+    pairWindowsMapDFT = checkpoint.pairWindowsMapDFT
+  } else {
+    seriesSketches = getSeriesSketches(dataset, granularity)
+    var seriesDFTs [][][]complex128
+    if isDFT {
+      seriesDFTs = getSeriesDFTs(dataset, granularity, ratio, energy)
+    }
+    // With a projection, cXY of each basic window is estimated from the projected windows
+    var seriesProjections [][][]float64
+    if projection != nil {
+      seriesProjections = getSeriesProjections(dataset, granularity, projection)
+    }
+    for i = 0; i < locationsNum; i += 1 {
+      for j = i + 1; j < locationsNum; j += 1 {
+        var leftLocation int = locations[i]
+        var rightLocation int = locations[j]
+        var pair Pair = Pair{leftLocation, rightLocation, i, j}
+        var bwr BasicWindowResult
+        var bwrdft BasicWindowDFTResult
+        if projection != nil {
+          getProjectionResult(&pair, &bwr, &seriesProjections)
+          pairWindowsMap[pair] = bwr
+        } else if !isDFT {
+          getBasicWindowResult(dataset, granularity, &pair, &bwr, nil, isDFT, nil)
+          pairWindowsMap[pair] = bwr
+        } else {
+          getBasicWindowResult(dataset, granularity, &pair, nil, &bwrdft, isDFT, &seriesDFTs)
+          pairWindowsMapDFT[pair] = bwrdft
+        }
       }
     }
   }
@@ -1075,95 +1116,149 @@ func networkConstructionBWInMemo(dataMap *(map[int][]Point), matrix *([][]int),
 
   // Query Part
   t1 := time.Now()
+  accurateMatrix := make([][]float64, locationsNum)
+  for i = 0; i < locationsNum; i += 1 {
+    accurateMatrix[i] = make([]float64, locationsNum)
+  }
   if !isDFT {
     for pair := range pairWindowsMap {
       bwr := pairWindowsMap[pair]
-      updateMatrix(matrix, thres, &(bwr.pair), bwr.slicesOfMeanX, bwr.slicesOfMeanY, bwr.slicesOfSigmaX, bwr.slicesOfSigmaY, bwr.slicesOfCXY, nil, false, nil)
+      updateMatrixBWR(matrix, thres, &(bwr.pair), &seriesSketches, bwr.slicesOfCXY, nil, false, &accurateMatrix)
     }
   } else {
+    if boundMatrix == nil {
+      bounds := make([][]float64, locationsNum)
+      boundMatrix = &bounds
+    }
+    for i = 0; i < locationsNum; i += 1 {
+      (*boundMatrix)[i] = make([]float64, locationsNum)
+    }
     for pair := range pairWindowsMapDFT {
       bwrdft := pairWindowsMapDFT[pair]
-      updateMatrix(matrix, thres, &(bwrdft.pair), bwrdft.slicesOfMeanX, bwrdft.slicesOfMeanY, bwrdft.slicesOfSigmaX, bwrdft.slicesOfSigmaY, nil, bwrdft.slicesOfDXY, true, nil)
+      updateMatrixBWR(matrix, thres, &(bwrdft.pair), &seriesSketches, nil, bwrdft.slicesOfDXY, true, &accurateMatrix)
+      // Each result carries the bound implied by the discarded coefficients
+      bound := getDFTQueryBound(&seriesSketches[pair.indexOfRow], &seriesSketches[pair.indexOfCol], bwrdft.slicesOfBound)
+      (*boundMatrix)[pair.indexOfRow][pair.indexOfCol] = bound
+      (*boundMatrix)[pair.indexOfCol][pair.indexOfRow] = bound
     }
+    displayDFTQueryBounds(&accurateMatrix, boundMatrix, thres)
   }
   elapsed = time.Since(t1)
   *queryTime = stringToSeconds(fmt.Sprintf("%v", elapsed))
   fmt.Println("Query time: ", elapsed)
+  if projection != nil {
+    displayProjectionErrorBound(projection, getNumberOfBasicwindows(dataset, granularity), dataset.numOfLocations())
+  }
+  if checkpointName != "" {
+    writeCheckpoint(checkpointName, &SketchCheckpoint{granularity: granularity, isDFT: isDFT, ratio: ratio, energy: energy,
+      locations: locations, latitudes: dataset.latitudes, longitudes: dataset.longitudes, seriesSketches: seriesSketches,
+      pairWindowsMap: pairWindowsMap, pairWindowsMapDFT: pairWindowsMapDFT, accurateMatrix: accurateMatrix})
+  }
 }
 
-func updateSlices(new *([]float64), old *([]float64), coming *([]float64)) {
-  for i := 0; i < len(*old) - 1; i += 1 {
-    (*new)[i] = (*old)[i+1]
+/* Shift the slices by the coming basic windows, the oldest ones are dropped so that the number of basic windows stays the same.
+   With replaceLast, the first coming basic window completes the last (partial) one instead of being appended */
+func updateSlices(new *([]float64), old *([]float64), coming *([]float64), replaceLast bool) {
+  kept := len(*old)
+  if replaceLast {
+    kept -= 1
   }
-  (*new)[len(*old)-1] = (*coming)[0]
+  combined := make([]float64, 0, kept + len(*coming))
+  combined = append(combined, (*old)[:kept]...)
+  combined = append(combined, (*coming)...)
+  copy(*new, combined[len(combined)-len(*old):])
 }
 
 func updateBWR(bwrNew *BasicWindowResult, bwrOld *BasicWindowResult, 
-  bwrComing *BasicWindowResult) {
-  numberOfBasicwindows := len(*(bwrOld.slicesOfMeanX))
-  slicesOfMeanX := make([]float64, numberOfBasicwindows)
-  slicesOfMeanY := make([]float64, numberOfBasicwindows)
-  slicesOfSigmaX := make([]float64, numberOfBasicwindows)
-  slicesOfSigmaY := make([]float64, numberOfBasicwindows)
+  bwrComing *BasicWindowResult, replaceLast bool) {
+  numberOfBasicwindows := len(*(bwrOld.slicesOfCXY))
   slicesOfCXY := make([]float64, numberOfBasicwindows)
-  //slicesOfDXY := make([]float64, numberOfBasicwindows)
-  updateSlices(&slicesOfMeanX, bwrOld.slicesOfMeanX, bwrComing.slicesOfMeanX)
-  updateSlices(&slicesOfMeanY, bwrOld.slicesOfMeanY, bwrComing.slicesOfMeanY)
-  updateSlices(&slicesOfSigmaX, bwrOld.slicesOfSigmaX, bwrComing.slicesOfSigmaX)
-  updateSlices(&slicesOfSigmaY, bwrOld.slicesOfSigmaY, bwrComing.slicesOfSigmaY)
-  updateSlices(&slicesOfCXY, bwrOld.slicesOfCXY, bwrComing.slicesOfCXY)
+  updateSlices(&slicesOfCXY, bwrOld.slicesOfCXY, bwrComing.slicesOfCXY, replaceLast)
 
   bwrNew.pair = bwrComing.pair
-  bwrNew.slicesOfMeanX = &slicesOfMeanX
-  bwrNew.slicesOfMeanY = &slicesOfMeanY
-  bwrNew.slicesOfSigmaX = &slicesOfSigmaX
-  bwrNew.slicesOfSigmaY = &slicesOfSigmaY
   bwrNew.slicesOfCXY = &slicesOfCXY
 }
 
 func updateBWRDFT(bwrNew *BasicWindowDFTResult, bwrOld *BasicWindowDFTResult, 
-  bwrComing *BasicWindowDFTResult) {
-  numberOfBasicwindows := len(*(bwrOld.slicesOfMeanX))
-  slicesOfMeanX := make([]float64, numberOfBasicwindows)
-  slicesOfMeanY := make([]float64, numberOfBasicwindows)
-  slicesOfSigmaX := make([]float64, numberOfBasicwindows)
-  slicesOfSigmaY := make([]float64, numberOfBasicwindows)
+  bwrComing *BasicWindowDFTResult, replaceLast bool) {
+  numberOfBasicwindows := len(*(bwrOld.slicesOfDXY))
   slicesOfDXY := make([]float64, numberOfBasicwindows)
-  slicesOfSumSquaredX := make([]float64, numberOfBasicwindows)
-  slicesOfSumSquaredY := make([]float64, numberOfBasicwindows)
-  updateSlices(&slicesOfMeanX, bwrOld.slicesOfMeanX, bwrComing.slicesOfMeanX)
-  updateSlices(&slicesOfMeanY, bwrOld.slicesOfMeanY, bwrComing.slicesOfMeanY)
-  updateSlices(&slicesOfSigmaX, bwrOld.slicesOfSigmaX, bwrComing.slicesOfSigmaX)
-  updateSlices(&slicesOfSigmaY, bwrOld.slicesOfSigmaY, bwrComing.slicesOfSigmaY)
-  updateSlices(&slicesOfDXY, bwrOld.slicesOfDXY, bwrComing.slicesOfDXY)
-  updateSlices(&slicesOfSumSquaredX, bwrOld.slicesOfSumSquaredX, bwrComing.slicesOfSumSquaredX)
-  updateSlices(&slicesOfSumSquaredY, bwrOld.slicesOfSumSquaredY, bwrComing.slicesOfSumSquaredY)
+  updateSlices(&slicesOfDXY, bwrOld.slicesOfDXY, bwrComing.slicesOfDXY, replaceLast)
   bwrNew.pair = bwrComing.pair
-  bwrNew.slicesOfMeanX = &slicesOfMeanX
-  bwrNew.slicesOfMeanY = &slicesOfMeanY
-  bwrNew.slicesOfSigmaX = &slicesOfSigmaX
-  bwrNew.slicesOfSigmaY = &slicesOfSigmaY
   bwrNew.slicesOfDXY = &slicesOfDXY
-  bwrNew.slicesOfSumSquaredX = &slicesOfSumSquaredX
-  bwrNew.slicesOfSumSquaredY = &slicesOfSumSquaredY
+  if bwrOld.slicesOfBound != nil && bwrComing.slicesOfBound != nil {
+    slicesOfBound := make([]float64, numberOfBasicwindows)
+    updateSlices(&slicesOfBound, bwrOld.slicesOfBound, bwrComing.slicesOfBound, replaceLast)
+    bwrNew.slicesOfBound = &slicesOfBound
+  }
+}
+
+/* Shift the statistics of one series by the coming basic windows, once for all pairs of the series */
+func updateSeriesSketch(seriesSketchNew *SeriesSketch, seriesSketchOld *SeriesSketch,
+  seriesSketchComing *SeriesSketch, replaceLast bool) {
+  numberOfBasicwindows := len(*(seriesSketchOld.slicesOfMean))
+  slicesOfMean := make([]float64, numberOfBasicwindows)
+  slicesOfSigma := make([]float64, numberOfBasicwindows)
+  slicesOfSumSquared := make([]float64, numberOfBasicwindows)
+  slicesOfCount := make([]float64, numberOfBasicwindows)
+  updateSlices(&slicesOfMean, seriesSketchOld.slicesOfMean, seriesSketchComing.slicesOfMean, replaceLast)
+  updateSlices(&slicesOfSigma, seriesSketchOld.slicesOfSigma, seriesSketchComing.slicesOfSigma, replaceLast)
+  updateSlices(&slicesOfSumSquared, seriesSketchOld.slicesOfSumSquared, seriesSketchComing.slicesOfSumSquared, replaceLast)
+  updateSlices(&slicesOfCount, seriesSketchOld.slicesOfCount, seriesSketchComing.slicesOfCount, replaceLast)
+  seriesSketchNew.location = seriesSketchComing.location
+  seriesSketchNew.slicesOfMean = &slicesOfMean
+  seriesSketchNew.slicesOfSigma = &slicesOfSigma
+  seriesSketchNew.slicesOfSumSquared = &slicesOfSumSquared
+  seriesSketchNew.slicesOfCount = &slicesOfCount
+}
+
+/* Get the values that update the sketch of dataset: its trailing partial basic window followed by datasetNew.
+   replaceLast is true when the first basic window of the result completes the last basic window of the sketch */
+func getComingDataset(dataset *Dataset, datasetNew *Dataset, granularity int) (*Dataset, bool) {
+  remained := dataset.length() % granularity
+  length := remained + datasetNew.length()
+  datasetComing := newDataset(dataset.singlePrecision)
+  var buf, bufNew []float64
+  for row := range dataset.locations {
+    datasetComing.addLocation(dataset.locations[row], dataset.latitudes[row], dataset.longitudes[row], length)
+    series := dataset.series(row, &buf)
+    for k := 0; k < remained; k += 1 {
+      datasetComing.set(row, k, series[len(series)-remained+k])
+    }
+    for k, val := range datasetNew.series(row, &bufNew) {
+      datasetComing.set(row, remained+k, val)
+    }
+  }
+  datasetComing.timestamps = make([]int, length)
+  for k := range datasetComing.timestamps {
+    datasetComing.timestamps[k] = dataset.length() - remained + k
+  }
+  return datasetComing, remained > 0
 }
 
-/* In-memory network construction update */
-func networkConstructionBWInMemoUpdate(dataMap *(map[int][]Point), matrix *([][]int), 
-  thres float64, granularity int, isDFT bool, ratio float64, dataMapNew *(map[int][]Point)) {
+/* In-memory network construction update. datasetNew may hold any number of new values, the sketch slides
+   by the basic windows they fill and a trailing partial basic window is kept like in getSeriesSketch.
+   With halfLife > 0, "t" weighs the basic windows by their age instead and no window expires */
+func networkConstructionBWInMemoUpdate(dataset *Dataset, matrix *([][]int), 
+  thres float64, granularity int, isDFT bool, ratio float64, energy float64, halfLife float64, datasetNew *Dataset, parallel bool, sink EdgeSink) {
   var pairWindowsMap map[Pair]BasicWindowResult
   pairWindowsMap = make(map[Pair]BasicWindowResult)
   var pairWindowsMapDFT map[Pair]BasicWindowDFTResult
   pairWindowsMapDFT = make(map[Pair]BasicWindowDFTResult)
 
   // Get locations
-  locationsNum := len(*dataMap)
+  locationsNum := dataset.numOfLocations()
   locations := make([]int, locationsNum)
-  getLocations(dataMap, &locations)
+  getLocations(dataset, &locations)
 
   // Sketch Part
   // Nested loops
   t0 := time.Now()
+  seriesSketches := getSeriesSketches(dataset, granularity)
+  var seriesDFTs [][][]complex128
+  if isDFT {
+    seriesDFTs = getSeriesDFTs(dataset, granularity, ratio, energy)
+  }
   var i, j int
   for i = 0; i < locationsNum; i += 1 {
     for j = i + 1; j < locationsNum; j += 1 {
@@ -1173,61 +1268,154 @@ func networkConstructionBWInMemoUpdate(dataMap *(map[int][]Point), matrix *([][]
       var bwr BasicWindowResult
       var bwrdft BasicWindowDFTResult
       if !isDFT {
-        getBasicWindowResult(dataMap, granularity, &pair, &bwr, nil, isDFT, ratio)
+        getBasicWindowResult(dataset, granularity, &pair, &bwr, nil, isDFT, nil)
         pairWindowsMap[pair] = bwr
       } else {
-        getBasicWindowResult(dataMap, granularity, &pair, nil, &bwrdft, isDFT, ratio)
+        getBasicWindowResult(dataset, granularity, &pair, nil, &bwrdft, isDFT, &seriesDFTs)
         pairWindowsMapDFT[pair] = bwrdft
       }
     }
   }
+  var seriesAggregates []SeriesAggregate
+  pairAggregates := make(map[Pair]*PairAggregate)
+  var decayFactor float64
+  if !isDFT && halfLife > 0 {
+    // Decayed sums of every pair, the update decays them and adds the coming windows
+    decayFactor = getDecayFactor(granularity, halfLife)
+    seriesAggregates = getDecayedSeriesAggregates(&seriesSketches, decayFactor)
+    for pair, bwr := range pairWindowsMap {
+      pairAggregate := getDecayedPairAggregate(&pair, &seriesSketches, seriesAggregates, bwr.slicesOfCXY, decayFactor)
+      pairAggregates[pair] = &pairAggregate
+    }
+  } else if !isDFT {
+    // Running sums of every pair, the update changes them by the expired and coming windows only
+    seriesAggregates = getSeriesAggregates(&seriesSketches)
+    for pair, bwr := range pairWindowsMap {
+      pairAggregate := getPairAggregate(&pair, &seriesSketches, seriesAggregates, bwr.slicesOfCXY, false)
+      pairAggregates[pair] = &pairAggregate
+    }
+  } else {
+    // The same running sums with cXY estimated from dXY, see updateMatrixUpdate
+    seriesAggregates = getSeriesAggregates(&seriesSketches)
+    for pair, bwrdft := range pairWindowsMapDFT {
+      pairAggregate := getPairAggregate(&pair, &seriesSketches, seriesAggregates, bwrdft.slicesOfDXY, true)
+      pairAggregates[pair] = &pairAggregate
+    }
+  }
   elapsed := time.Since(t0)
   fmt.Println("Sketch time: ", elapsed)
 
-  accurateMatrix := make([][]float64, len(*dataMap))
+  accurateMatrix := make([][]float64, dataset.numOfLocations())
   for i := range accurateMatrix {
-    accurateMatrix[i] = make([]float64, len(*dataMap))
+    accurateMatrix[i] = make([]float64, dataset.numOfLocations())
   }
 
   // Query Part
   t1 := time.Now()
-  if !isDFT {
+  if !isDFT && halfLife > 0 {
+    for pair, pairAggregate := range pairAggregates {
+      corr := getRunningCorrelation(&seriesAggregates[pair.indexOfRow], &seriesAggregates[pair.indexOfCol], pairAggregate)
+      setCorrelation(matrix, thres, &pair, corr, &accurateMatrix)
+    }
+  } else if !isDFT {
     for pair := range pairWindowsMap {
       bwr := pairWindowsMap[pair]
-      updateMatrix(matrix, thres, &(bwr.pair), bwr.slicesOfMeanX, bwr.slicesOfMeanY, bwr.slicesOfSigmaX, bwr.slicesOfSigmaY, bwr.slicesOfCXY, nil, false, nil)
+      updateMatrixBWR(matrix, thres, &(bwr.pair), &seriesSketches, bwr.slicesOfCXY, nil, false, &accurateMatrix)
     }
   } else {
     for pair := range pairWindowsMapDFT {
       bwrdft := pairWindowsMapDFT[pair]
-      updateMatrix(matrix, thres, &(bwrdft.pair), bwrdft.slicesOfMeanX, bwrdft.slicesOfMeanY, bwrdft.slicesOfSigmaX, bwrdft.slicesOfSigmaY, nil, bwrdft.slicesOfDXY, true, &accurateMatrix)
+      updateMatrixBWR(matrix, thres, &(bwrdft.pair), &seriesSketches, nil, bwrdft.slicesOfDXY, true, &accurateMatrix)
     }
   }
   elapsed = time.Since(t1)
   fmt.Println("Query time: ", elapsed)
 
   t2 := time.Now()
-  for i = 0; i < locationsNum; i += 1 {
-    for j = i + 1; j < locationsNum; j += 1 {
-      var leftLocation int = locations[i]
-      var rightLocation int = locations[j]
-      var pair Pair = Pair{leftLocation, rightLocation, i, j}
-      var bwr, bwrNew BasicWindowResult
-      var bwrdft BasicWindowDFTResult
-      if !isDFT {
-        getBasicWindowResult(dataMapNew, granularity, &pair, &bwr, nil, isDFT, ratio)
-        oldBWR := pairWindowsMap[pair]
-        updateBWR(&bwrNew, &oldBWR, &bwr)
-        updateMatrix(matrix, thres, &(bwrNew.pair), bwrNew.slicesOfMeanX, bwrNew.slicesOfMeanY, bwrNew.slicesOfSigmaX, bwrNew.slicesOfSigmaY, bwrNew.slicesOfCXY, nil, false, nil)
+  oldMatrix := copyMatrix(*matrix)
+  oldCorr := copyFloatMatrix(accurateMatrix)
+  datasetComing, replaceLast := getComingDataset(dataset, datasetNew, granularity)
+  seriesSketchesComing := getSeriesSketches(datasetComing, granularity)
+  seriesAggregatesNew := make([]SeriesAggregate, len(seriesAggregates))
+  for i = range seriesAggregates {
+    seriesAggregatesNew[i] = seriesAggregates[i]
+    if halfLife > 0 {
+      seriesAggregatesNew[i].decay(&seriesSketches[i], &seriesSketchesComing[i], replaceLast, decayFactor)
+    } else {
+      seriesAggregatesNew[i].slide(&seriesSketches[i], &seriesSketchesComing[i], replaceLast)
+    }
+  }
+  numberOfComingBasicwindows := getNumberOfBasicwindows(datasetComing, granularity)
+  fmt.Println(fmt.Sprintf("Update: %d new values, %d basic windows (last one replaced: %t)", datasetNew.length(), numberOfComingBasicwindows, replaceLast))
+  var seriesDFTsNew [][][]complex128
+  if isDFT {
+    // Slide each series' DFT through the new data instead of transforming every new window
+    seriesDFTsNew = getSeriesDFTsSliding(dataset, datasetNew, granularity, ratio, energy)
+  }
+  // Every pair only writes its own two cells of matrix and accurateMatrix, the pairs can be updated concurrently
+  updatePair := func(pair Pair) {
+    var bwr BasicWindowResult
+    var bwrdft BasicWindowDFTResult
+    if !isDFT {
+      // Exact and O(1) per expired and coming window, the retained windows are not combined again
+      getBasicWindowResult(datasetComing, granularity, &pair, &bwr, nil, isDFT, nil)
+      oldBWR := pairWindowsMap[pair]
+      pairAggregate := pairAggregates[pair]
+      seriesAggregateX := &seriesAggregatesNew[pair.indexOfRow]
+      seriesAggregateY := &seriesAggregatesNew[pair.indexOfCol]
+      if halfLife > 0 {
+        pairAggregate.decay(seriesAggregateX, seriesAggregateY, &seriesSketches[pair.indexOfRow], &seriesSketches[pair.indexOfCol], oldBWR.slicesOfCXY,
+          &seriesSketchesComing[pair.indexOfRow], &seriesSketchesComing[pair.indexOfCol], bwr.slicesOfCXY, replaceLast, decayFactor)
       } else {
-        getBasicWindowResult(dataMapNew, granularity, &pair, nil, &bwrdft, isDFT, ratio)
-        oldBWRDFT := pairWindowsMapDFT[pair]
-        updateMatrixUpdate(matrix, thres, &(oldBWRDFT.pair), oldBWRDFT.slicesOfMeanX, oldBWRDFT.slicesOfMeanY, oldBWRDFT.slicesOfSigmaX, oldBWRDFT.slicesOfSigmaY, nil, oldBWRDFT.slicesOfDXY, oldBWRDFT.slicesOfSumSquaredX, oldBWRDFT.slicesOfSumSquaredY, granularity, &bwrdft, &accurateMatrix)
+        pairAggregate.slide(seriesAggregateX, seriesAggregateY, &seriesSketches[pair.indexOfRow], &seriesSketches[pair.indexOfCol], oldBWR.slicesOfCXY,
+          &seriesSketchesComing[pair.indexOfRow], &seriesSketchesComing[pair.indexOfCol], bwr.slicesOfCXY, replaceLast, false)
+      }
+      setCorrelation(matrix, thres, &pair, getRunningCorrelation(seriesAggregateX, seriesAggregateY, pairAggregate), &accurateMatrix)
+    } else {
+      // Any number of coming (or partial) basic windows, also O(1) per expired and coming window
+      getBasicWindowResult(datasetComing, granularity, &pair, nil, &bwrdft, isDFT, &seriesDFTsNew)
+      oldBWRDFT := pairWindowsMapDFT[pair]
+      updateMatrixUpdate(matrix, thres, &pair, &seriesAggregatesNew[pair.indexOfRow], &seriesAggregatesNew[pair.indexOfCol], pairAggregates[pair],
+        &seriesSketches[pair.indexOfRow], &seriesSketches[pair.indexOfCol], &oldBWRDFT, &seriesSketchesComing[pair.indexOfRow],
+        &seriesSketchesComing[pair.indexOfCol], &bwrdft, replaceLast, &accurateMatrix)
+    }
+  }
+  if parallel {
+    NCPU := getNumCPU()
+    fmt.Println("CPU Num: ", NCPU)
+    runtime.GOMAXPROCS(NCPU)
+    listOfPairs := make([][]Pair, NCPU)
+    partitionData(NCPU, dataset, &listOfPairs)
+    sem := make(chan int, NCPU)
+    for taskNum := 0; taskNum < NCPU; taskNum += 1 {
+      go func(pairs []Pair) {
+        for _, pair := range pairs {
+          updatePair(pair)
+        }
+        sem <-1
+      }(listOfPairs[taskNum])
+    }
+    // Waiting for NCPU tasks to be finished
+    for taskNum := 0; taskNum < NCPU; taskNum += 1 {
+      <-sem
+    }
+  } else {
+    for i = 0; i < locationsNum; i += 1 {
+      for j = i + 1; j < locationsNum; j += 1 {
+        updatePair(Pair{locations[i], locations[j], i, j})
       }
     }
   }
 
   elapsed = time.Since(t2)
   fmt.Println("Update time: ", elapsed)
+
+  // The newest basic window of the update, counted from the start of the data
+  window := getNumberOfBasicwindows(dataset, granularity) + numberOfComingBasicwindows - 1
+  if replaceLast {
+    window -= 1
+  }
+  sendEdgeChanges(sink, window, locations, oldMatrix, oldCorr, locations, *matrix, accurateMatrix)
 }
 
 /* ---|--------------------|--- */
@@ -1240,12 +1428,12 @@ func getNumCPU() int {
 }
 
 /* Partition data to NCPU lists */
-func partitionData(NCPU int, dataMap *(map[int][]Point), listOfPairs *([][]Pair)) {
+func partitionData(NCPU int, dataset *Dataset, listOfPairs *([][]Pair)) {
   // Separate the data map by NCPU
   // The pairs of locations locations are assigned to the list evenly
-  locationsNum := len(*dataMap)
+  locationsNum := dataset.numOfLocations()
   locations := make([]int, locationsNum)
-  getLocations(dataMap, &locations)
+  getLocations(dataset, &locations)
   numOfPairs := (locationsNum * (locationsNum - 1)) / 2
   quotient := numOfPairs / NCPU
   remained := numOfPairs % NCPU
@@ -1305,17 +1493,17 @@ func writeDBFromChan(partitionsNum int, dataChan chan DataOfChannel, sem_2 chan
 }
 
 /* DoAll for naive implementation */
-func doAllNaive(NCPU int, dataMap *(map[int][]Point), matrix *([][]int), thres float64) {
+func doAllNaive(NCPU int, dataset *Dataset, matrix *([][]int), thres float64, measure string) {
   sem := make(chan int, NCPU)
 
   // Separate the data map by NCPU
   // The pairs of locations locations are assigned to the list evenly
   listOfPairs := make([][]Pair, NCPU)
-  partitionData(NCPU, dataMap, &listOfPairs)
+  partitionData(NCPU, dataset, &listOfPairs)
 
   // doPart
   for i := 0; i < NCPU; i += 1 {
-    go doPartNaive(sem, i, &listOfPairs, dataMap, matrix, thres)
+    go doPartNaive(sem, i, &listOfPairs, dataset, matrix, thres, measure)
   }
 
   // Waiting for NCPU tasks to be finished
@@ -1326,30 +1514,14 @@ func doAllNaive(NCPU int, dataMap *(map[int][]Point), matrix *([][]int), thres f
 }
 
 /* DoPart for naive implementation */
-func doPartNaive(sem chan int, taskNum int, listOfPairs *([][]Pair), dataMap *(map[int][]Point), matrix *([][]int), thres float64) {
+func doPartNaive(sem chan int, taskNum int, listOfPairs *([][]Pair), dataset *Dataset, matrix *([][]int), thres float64, measure string) {
+  var bufX, bufY []float64
   for i := 0; i < len((*listOfPairs)[taskNum]); i += 1 {
     pair := (*listOfPairs)[taskNum][i]
-    leftPointsSlices := (*dataMap)[pair.leftLocation]
-    rightPointsSlices := (*dataMap)[pair.rightLocation]
-    var count float64 = 0
-    var sumOfX float64 = 0
-    var sumOfY float64 = 0
-    var sumSquaredX float64 = 0
-    var sumSquaredY float64 = 0
-    var sumOfXY float64 = 0
-    var k int
-    for k = 0; k < len(leftPointsSlices); k += 1 {
-      count += 1
-      sumOfX += leftPointsSlices[k].temperature
-      sumOfY += rightPointsSlices[k].temperature
-      sumSquaredX += leftPointsSlices[k].temperature * leftPointsSlices[k].temperature
-      sumSquaredY += rightPointsSlices[k].temperature * rightPointsSlices[k].temperature
-      sumOfXY += leftPointsSlices[k].temperature * rightPointsSlices[k].temperature
-    }
-    std := ((sumOfXY/count) - (sumOfX*sumOfY)/(count*count))/
-    (math.Sqrt((sumSquaredX/count) - ((sumOfX*sumOfX)/(count*count)))*
-      math.Sqrt((sumSquaredY/count) - ((sumOfY*sumOfY)/(count*count))))
-    if math.Abs(std) >= thres {
+    leftSeries := dataset.series(pair.indexOfRow, &bufX)
+    rightSeries := dataset.series(pair.indexOfCol, &bufY)
+    std, ok := getCorrelationOfSeries(measure, leftSeries, rightSeries)
+    if ok && math.Abs(std) >= thres {
       (*matrix)[pair.indexOfRow][pair.indexOfCol] = 1
       (*matrix)[pair.indexOfCol][pair.indexOfRow] = 1
     }
@@ -1359,8 +1531,13 @@ func doPartNaive(sem chan int, taskNum int, listOfPairs *([][]Pair), dataMap *(m
 }
 
 /* DoAll for TSUBASA sketch */
-func doAllBWSketch(partitionsNum int, dataMap *(map[int][]Point), listOfPairs *([][]Pair),
-  granularity int, writeBlockSize int, header string, isDFT bool, ratio float64, durations *([]string)) {
+func doAllBWSketch(partitionsNum int, dataset *Dataset, listOfPairs *([][]Pair),
+  granularity int, writeBlockSize int, header string, isDFT bool, ratio float64, energy float64, durations *([]string)) {
+
+  var seriesDFTs [][][]complex128
+  if isDFT {
+    seriesDFTs = getSeriesDFTs(dataset, granularity, ratio, energy)
+  }
 
   sem_1 := make(chan int, partitionsNum) // To signal parts are finsihed
   sem_2 := make(chan int, 1)             // To signal writing is finished
@@ -1372,7 +1549,7 @@ func doAllBWSketch(partitionsNum int, dataMap *(map[int][]Point), listOfPairs *(
 
   // doPart
   for i := 0; i < partitionsNum; i += 1 {
-    go doPartBWSketch(sem_1, dataChan, i, listOfPairs, dataMap, granularity, writeBlockSize, header, isDFT, ratio, durations)
+    go doPartBWSketch(sem_1, dataChan, i, listOfPairs, dataset, granularity, writeBlockSize, header, isDFT, &seriesDFTs, durations)
   }
 
   // writer worker
@@ -1392,8 +1569,8 @@ func doAllBWSketch(partitionsNum int, dataMap *(map[int][]Point), listOfPairs *(
 }
 
 /* DoPart for TSUBASA sketch */
-func doPartBWSketch(endChan chan int, dataChan chan DataOfChannel, taskNum int, listOfPairs *([][]Pair), dataMap *(map[int][]Point), 
-  granularity int, writeBlockSize int, header string, isDFT bool, ratio float64, durations *([]string)) {
+func doPartBWSketch(endChan chan int, dataChan chan DataOfChannel, taskNum int, listOfPairs *([][]Pair), dataset *Dataset, 
+  granularity int, writeBlockSize int, header string, isDFT bool, seriesDFTs *([][][]complex128), durations *([]string)) {
   t0 := time.Now()
 
   // Open db
@@ -1418,11 +1595,10 @@ func doPartBWSketch(endChan chan int, dataChan chan DataOfChannel, taskNum int,
     pair := pairs[i]
     var bwr BasicWindowResult
     var bwrdft BasicWindowDFTResult
-    //getBasicWindowResult(dataMap, granularity, &pair, &bwr)
     if !isDFT {
-      getBasicWindowResult(dataMap, granularity, &pair, &bwr, nil, false, 0)
+      getBasicWindowResult(dataset, granularity, &pair, &bwr, nil, false, nil)
     } else {
-      getBasicWindowResult(dataMap, granularity, &pair, nil, &bwrdft, true, ratio)
+      getBasicWindowResult(dataset, granularity, &pair, nil, &bwrdft, true, seriesDFTs)
     }
 
     if writeBlockSize <= 0 {
@@ -1477,9 +1653,9 @@ func doPartBWSketch(endChan chan int, dataChan chan DataOfChannel, taskNum int,
 }
 
 /* DoAll for TSUBASA query */
-func doAllBWQuery(NCPU int, dataMap *(map[int][]Point), listOfPairs *([][]Pair),
-  matrix *([][]int), thres float64, readBlockSize int, numberOfBasicwindows int, isDFT bool, 
-  queryStart int, queryEnd int, durations *([]string), readsTime *([]float64)) {
+func doAllBWQuery(NCPU int, dataset *Dataset, listOfPairs *([][]Pair),
+  matrix *([][]int), accurateMatrix *([][]float64), thres float64, readBlockSize int, windows *StoredWindows, isDFT bool, 
+  queryStart int, queryEnd int, seriesSketches *([]SeriesSketch), durations *([]string), readsTime *([]float64)) {
   sem := make(chan int, NCPU)
   // doPart
   for i := 0; i < NCPU; i += 1 {
@@ -1487,7 +1663,7 @@ func doAllBWQuery(NCPU int, dataMap *(map[int][]Point), listOfPairs *([][]Pair),
     if isDFT {
       tableName = fmt.Sprintf("%s_%d", tablenamedft, i)
     }
-    go doPartBWQuery(sem, i, listOfPairs, matrix, thres, tableName, readBlockSize, numberOfBasicwindows, isDFT, queryStart, queryEnd, durations, readsTime)
+    go doPartBWQuery(sem, i, listOfPairs, matrix, accurateMatrix, thres, tableName, readBlockSize, windows, isDFT, queryStart, queryEnd, seriesSketches, durations, readsTime)
   }
   // Waiting for NCPU tasks to be finished
   for i := 0; i < NCPU; i += 1 {
@@ -1498,8 +1674,8 @@ func doAllBWQuery(NCPU int, dataMap *(map[int][]Point), listOfPairs *([][]Pair),
 
 /* DoPart for TSUBASA query */
 func doPartBWQuery(sem chan int, taskNum int, listOfPairs *([][]Pair),
-  matrix *([][]int), thres float64, tableName string, readBlockSize int, numberOfBasicwindows int, isDFT bool, 
-  queryStart int, queryEnd int, durations *([]string), readsTime *([]float64)) {
+  matrix *([][]int), accurateMatrix *([][]float64), thres float64, tableName string, readBlockSize int, windows *StoredWindows, isDFT bool, 
+  queryStart int, queryEnd int, seriesSketches *([]SeriesSketch), durations *([]string), readsTime *([]float64)) {
   t0 := time.Now()
 
   // Open db
@@ -1517,7 +1693,7 @@ func doPartBWQuery(sem chan int, taskNum int, listOfPairs *([][]Pair),
     } else {
       endID = startID + readBlockSize
     }
-    readTimeStr := queryRowsDB(db, tableName, startID, endID, matrix, thres, numberOfBasicwindows, isDFT, queryStart, queryEnd)
+    readTimeStr := queryRowsDB(db, tableName, startID, endID, matrix, accurateMatrix, thres, windows, isDFT, queryStart, queryEnd, seriesSketches)
     //fmt.Println("read: ", readTimeStr)
     readTime += stringToSeconds(readTimeStr)
     startID = endID
@@ -1535,17 +1711,17 @@ func doPartBWQuery(sem chan int, taskNum int, listOfPairs *([][]Pair),
 }
 
 /* Construct network for naive implemetation with parallel computing */
-func networkConstructionNaiveParallel(dataMap *(map[int][]Point), matrix *([][]int), thres float64) {
+func networkConstructionNaiveParallel(dataset *Dataset, matrix *([][]int), thres float64, measure string) {
   NCPU := getNumCPU()
   fmt.Println("CPU Num: ", NCPU)
   runtime.GOMAXPROCS(NCPU)
-  doAllNaive(NCPU, dataMap, matrix, thres)
+  doAllNaive(NCPU, dataset, matrix, thres, measure)
 }
 
 /* Construct network for naive implemetation with parallel computing */
-func networkConstructionBWParallel(dataMap *(map[int][]Point), matrix *([][]int), thres float64, granularity int, 
-  writeBlockSize int, readBlockSize int, isDFT bool, ratio float64, 
-  queryStart int, queryEnd int, sketchDurations *([]string), queryDurations *([]string), queryReadTime *([]float64)) {
+func networkConstructionBWParallel(dataset *Dataset, matrix *([][]int), thres float64, granularity int, 
+  writeBlockSize int, readBlockSize int, isDFT bool, ratio float64, energy float64, 
+  queryStart int, queryEnd int, datasetNew *Dataset, changes *LocationChanges, sink EdgeSink, sketchDurations *([]string), queryDurations *([]string), queryReadTime *([]float64)) {
   NCPU := getNumCPU()
   fmt.Println("CPU Num: ", NCPU)
   partitionsNum := NCPU - 1
@@ -1558,31 +1734,42 @@ func networkConstructionBWParallel(dataMap *(map[int][]Point), matrix *([][]int)
   db := openDB(&dbName) // Open and get the database
 
   // Create partitionsNum tables
+  tableNames := make([]string, partitionsNum)
   for i := 0; i < partitionsNum; i += 1 {
     if !isDFT {
-      tableName := fmt.Sprintf("%s_%d", tablename, i)
-      createTable(db, tableName, pairsbwrschema) // Create a new table for mapping pairs to basic window statistics
+      tableNames[i] = fmt.Sprintf("%s_%d", tablename, i)
+      createTable(db, tableNames[i], pairsbwrschema) // Create a new table for mapping pairs to basic window statistics
     } else {
-      tableName := fmt.Sprintf("%s_%d", tablenamedft, i)
-      createTable(db, tableName, pairsbwrdftschema) // Create a new table for mapping pairs to basic window statistics
+      tableNames[i] = fmt.Sprintf("%s_%d", tablenamedft, i)
+      createTable(db, tableNames[i], pairsbwrdftschema) // Create a new table for mapping pairs to basic window statistics
     }
+    createUpdateTable(db, tableNames[i], isDFT) // Create a new table for the basic windows written by updates
   }
+  createTable(db, seriestablename, seriesschema) // Create a new table for mapping series to statistics
+  createTable(db, indextablename, indexschema) // Create a new table for mapping rows to locations
+  insertLocationIndex(db, dataset)
+  var numberOfBasicwindows int = getNumberOfBasicwindows(dataset, granularity)
+  createSketchState(db, numberOfBasicwindows)
 
   // Close db before parallel
   closeDB(db)
 
   sizeBeforeSketch := getSizeOfDB(dbName)
 
-  var numberOfBasicwindows int = getNumberOfBasicwindows(dataMap, granularity)
   listOfPairs := make([][]Pair, partitionsNum)
-  partitionData(partitionsNum, dataMap, &listOfPairs)
+  partitionData(partitionsNum, dataset, &listOfPairs)
 
   t0 := time.Now()
   header := pairsbwrheader
   if isDFT {
     header = pairsbwrdftheader
   }
-  doAllBWSketch(partitionsNum, dataMap, &listOfPairs, granularity, writeBlockSize, header, isDFT, ratio, sketchDurations)
+  // Store statistics of each series once, pairs only store their cross terms
+  seriesSketches := getSeriesSketches(dataset, granularity)
+  db = openDB(&dbName)
+  insertSeriesSketches(db, &seriesSketches)
+  closeDB(db)
+  doAllBWSketch(partitionsNum, dataset, &listOfPairs, granularity, writeBlockSize, header, isDFT, ratio, energy, sketchDurations)
   elapsed := time.Since(t0)
   fmt.Println("Sketch time: ", elapsed)
 
@@ -1596,48 +1783,138 @@ func networkConstructionBWParallel(dataMap *(map[int][]Point), matrix *([][]int)
   sizeAfterSketch := getSizeOfDB(dbName)
   fmt.Println(fmt.Sprintf("sizeBeforeSketch: %d bytes, sizeAfterSketch: %d bytes, size: %d bytes", sizeBeforeSketch, sizeAfterSketch, sizeAfterSketch - sizeBeforeSketch))
 
+  db = openDB(&dbName)
+  checkLocationIndex(db, dataset)
+
+  accurateMatrix := make([][]float64, dataset.numOfLocations())
+  for i := range accurateMatrix {
+    accurateMatrix[i] = make([]float64, dataset.numOfLocations())
+  }
   t1 := time.Now()
-  doAllBWQuery(partitionsNum, dataMap, &listOfPairs, matrix, thres, readBlockSize, numberOfBasicwindows, isDFT, queryStart, queryEnd, queryDurations, queryReadTime)
+  windows := querySketchState(db)
+  startOfQuery, endOfQuery := windows.getQueryRange(queryStart, queryEnd)
+  seriesSketchesQuery := querySeriesSketches(db, startOfQuery, endOfQuery)
+  closeDB(db)
+  doAllBWQuery(partitionsNum, dataset, &listOfPairs, matrix, &accurateMatrix, thres, readBlockSize, &windows, isDFT, queryStart, queryEnd, &seriesSketchesQuery, queryDurations, queryReadTime)
   elapsed = time.Since(t1)
   fmt.Println("Query time: ", elapsed)
+  oldLocations := dataset.locations
+  oldMatrix := copyMatrix(*matrix)
+  oldCorr := copyFloatMatrix(accurateMatrix)
+
+  // Location changes, the pairs of every table are read again as the partitions of the update and the next query
+  if changes != nil {
+    t4 := time.Now()
+    db = openDB(&dbName)
+    applyStoredLocationChanges(db, tableNames, changes, granularity, isDFT, ratio, energy, writeBlockSize)
+    for i := 0; i < partitionsNum; i += 1 {
+      listOfPairs[i] = queryStoredPairs(db, tableNames[i])
+    }
+    closeDB(db)
+    dataset = changes.dataset
+    datasetNew = changes.datasetNew
+    resizeMatrix(matrix, &accurateMatrix, dataset.numOfLocations())
+    fmt.Println("Location changes time: ", time.Since(t4))
+  }
+
+  // Update part, the new basic windows of each partition go to the update table of its pairs
+  if datasetNew != nil {
+    t2 := time.Now()
+    db = openDB(&dbName)
+    updateStoredSketch(db, dataset, datasetNew, granularity, tableNames, listOfPairs, isDFT, ratio, energy, writeBlockSize)
+    windows = querySketchState(db)
+    startOfQuery, endOfQuery = windows.getQueryRange(queryStart, queryEnd)
+    seriesSketchesQuery = querySeriesSketches(db, startOfQuery, endOfQuery)
+    closeDB(db)
+    fmt.Println("Update time: ", time.Since(t2))
+    clearMatrix(matrix)
+    t3 := time.Now()
+    doAllBWQuery(partitionsNum, dataset, &listOfPairs, matrix, &accurateMatrix, thres, readBlockSize, &windows, isDFT, queryStart, queryEnd, &seriesSketchesQuery, queryDurations, queryReadTime)
+    fmt.Println("Query time: ", time.Since(t3))
+    sendEdgeChanges(sink, windows.end - 1, oldLocations, oldMatrix, oldCorr, dataset.locations, *matrix, accurateMatrix)
+  }
 
   db = openDB(&dbName) 
   // Delete tables
   for i := 0; i < partitionsNum; i += 1 {
-    if !isDFT {
-      tableName := fmt.Sprintf("%s_%d", tablename, i)
-      deleteTable(db, tableName)
-    } else {
-      tableName := fmt.Sprintf("%s_%d", tablenamedft, i)
-      deleteTable(db, tableName)
-    }
+    deleteTable(db, tableNames[i])
+    deleteTable(db, tableNames[i] + updatetablesuffix)
   }
+  deleteTable(db, seriestablename)
+  deleteTable(db, indextablename)
+  deleteSketchState(db)
 
   closeDB(db) // Close the database
   deleteDB(dbName) // Delete the database
 }
 
-func getNetworkInMemo(dataMap *(map[int][]Point), matrix *([][]int), thres float64, granularity int, isDFT bool, ratio float64,
+func getNetworkInMemo(dataset *Dataset, matrix *([][]int), thres float64, granularity int, isDFT bool, ratio float64, energy float64,
   sktechTime *float64, queryTime *float64, totalTime *float64) {
   clearMatrix(matrix)
   t8 := time.Now()
-  networkConstructionBWInMemo(dataMap, matrix, thres, granularity, isDFT, ratio, sktechTime, queryTime)
+  networkConstructionBWInMemo(dataset, matrix, thres, granularity, isDFT, ratio, energy, nil, nil, "", "", sktechTime, queryTime)
   elapsed := time.Since(t8)
   checkMatrix(matrix)
   fmt.Println("Running time: ", elapsed)
   *totalTime = stringToSeconds(fmt.Sprintf("%v", elapsed))
 }
 
-func getDataMap(fileName string, dataMap *(map[int][]Point), before int, numOfLocations int) {
-  readErr := ReadLine(fileName, dataMap, before, numOfLocations) // Args:: {3rd: timestamp limit, 4th: number of locations}
+func getDataset(fileName string, dataset *Dataset, before int, numOfLocations int) {
+  readErr := ReadLine(fileName, dataset, before, numOfLocations) // Args:: {3rd: timestamp limit, 4th: number of locations}
   if (readErr != nil) {
     panic(readErr)
   }
-  fmt.Println("Length of dataMap: ", len(*dataMap))
+  displayDataset(dataset)
+}
+
+/* Parse the number of new values of an update, updatelength=<n>. Default is one basic window */
+func parseUpdateLength(options map[string]string, granularity int) int {
+  if options["updatelength"] == "" {
+    return granularity
+  }
+  intVal, err := strconv.Atoi(options["updatelength"])
+  if err != nil || intVal <= 0 {
+    panic("Invalid update length: " + options["updatelength"])
+  }
+  return intVal
+}
+
+/* Load the new values of an update, the values of timestamps start to start + updatelength - 1 that follow the start
+   loaded ones. With preprocessing, the whole file is preprocessed (granularity may be in resampled units) and the values
+   are taken at the same offset, the climatology is the one of the timestamps before climatologyBefore like for the
+   loaded values */
+func getDatasetNew(fileName string, singlePrecision bool, start int, numOfLocations int, granularity int, climatologyBefore int,
+  options map[string]string) *Dataset {
+  updateLength := parseUpdateLength(options, granularity)
+  datasetNew := newDataset(singlePrecision)
+  if options["resample"] == "" && options["anomaly"] != "t" {
+    getDataset(fileName, datasetNew, start + updateLength, numOfLocations)
+    fillMissingValues(datasetNew)
+  } else {
+    getDataset(fileName, datasetNew, -1, numOfLocations)
+    datasetNew = prepareDataset(datasetNew, options, climatologyBefore)
+  }
+  if datasetNew.length() < start + updateLength {
+    panic(fmt.Sprintf("ERROR: the update needs %d values after the %d loaded ones, the file only has %d", updateLength, start, datasetNew.length()))
+  }
+  return datasetNew.subsequence(start, start + updateLength)
+}
+
+/* Parse optional arguments given as key=value after the positional ones */
+func parseOptions(args []string) map[string]string {
+  options := make(map[string]string)
+  for _, arg := range args {
+    keyValue := strings.SplitN(arg, "=", 2)
+    if len(keyValue) != 2 {
+      panic("Invalid option: " + arg)
+    }
+    options[keyValue[0]] = keyValue[1]
+  }
+  return options
 }
 
 func main() {
-  if len(os.Args) != 15 {
+  if len(os.Args) < 15 {
     panic("Invalid number of arguments.")
   }
   // Get parameters from command arguments
@@ -1664,23 +1941,74 @@ func main() {
   var method string = os.Args[12]
   var inMem string = os.Args[13]
   var update string = os.Args[14]
+  options := parseOptions(os.Args[15:])
+  var singlePrecision bool = options["precision"] == "32"
+  var energy float64 = parseDFTEnergy(options) // 0 keeps <ratio> coefficients per basic window
+  var measure string = parseMeasure(options)
+  var halfLife float64 = parseHalfLife(options) // 0 keeps the sliding windows
   inputArgs := fmt.Sprintf("fileName: %s, before: %d, numOfLocations: %d, thres: %.2f, granularity: %d, writeBlockSize: %d, readBlockSize: %d, ratio: %.2f, queryStart: %d, queryEnd: %d, parallel: %s, method: %s, inMem: %s, update: %s", 
     fileName, before, numOfLocations, thres, granularity, writeBlockSize, readBlockSize, ratio, queryStart, queryEnd, parallel, method, inMem, update)
   fmt.Println(inputArgs)
+  fmt.Println("options: ", options)
+  if method == "r" && (parallel != "f" || inMem != "t" || update != "f") {
+    panic("Method r is only available in memory, without parallel computing or update.")
+  }
+  if options["refine"] == "t" && (method != "d" || parallel != "f" || inMem != "t" || update != "f" || options["hierarchy"] == "t") {
+    panic("refine=t is only available for method d in memory, without parallel computing, update or hierarchy.")
+  }
+  if measure == "mi" && ((method != "n" && method != "t") || parallel != "f" || inMem != "t" || update != "f") {
+    panic("Mutual information is only available for methods n and t in memory, without parallel computing or update.")
+  }
+  if options["stream"] == "t" && ((method != "t" && method != "d") || parallel != "f" || inMem != "t" || update != "t") {
+    panic("stream=t is only available for methods t and d in memory, without parallel computing and with update.")
+  }
+  if (options["addlocations"] != "" || options["removelocations"] != "") && ((method != "t" && method != "d") || update != "t" || (inMem == "t" && options["stream"] != "t")) {
+    panic("addlocations= and removelocations= are only available for methods t and d with update, on stored sketches or with stream=t.")
+  }
+  if (options["usedb"] == "t" || options["keepdb"] == "t") && ((method != "t" && method != "d") || parallel != "f" || inMem != "f") {
+    panic("usedb=t and keepdb=t are only available for methods t and d stored in PostgreSQL, without parallel computing.")
+  }
+  if options["events"] != "" && (update != "t" || (method != "t" && method != "d")) {
+    panic("events= is only available for methods t and d with update.")
+  }
+  if (options["checkpoint"] != "" || options["restore"] != "") && ((method != "t" && method != "d") || parallel != "f" || inMem != "t" ||
+    options["hierarchy"] == "t" || options["refine"] == "t" || measure == "mi" || (update == "t" && options["stream"] != "t")) {
+    panic("checkpoint= and restore= are only available for methods t and d in memory, without parallel computing, hierarchy or refine, and with update only for stream=t.")
+  }
+  if options["checkpointevery"] != "" && (options["stream"] != "t" || options["checkpoint"] == "") {
+    panic("checkpointevery= is only available for stream=t with checkpoint=.")
+  }
+  if halfLife > 0 && (method != "t" || inMem != "t" || update != "t" || options["addlocations"] != "") {
+    panic("halflife= is only available for method t in memory with update, without addlocations=.")
+  }
+  if options["restore"] != "" && (options["addlocations"] != "" || options["removelocations"] != "") {
+    panic("restore= is not available with addlocations= or removelocations=, the restored locations are kept.")
+  }
+  if measure != "pearson" && update == "t" {
+    panic("Rank measures are not available with update, the ranks of the new values depend on the whole series.")
+  }
 
-  // Read data from *.csv to map, which is stored in memory
+  // Read data from *.csv to columns, which are stored in memory
   t1 := time.Now()
-  dataMap := make(map[int][]Point)
-  getDataMap(fileName, &dataMap, before, numOfLocations)
+  dataset := newDataset(singlePrecision)
+  getDataset(fileName, dataset, before, numOfLocations)
+  dataset = prepareDataset(dataset, options, before)
+  displayConstantSeries(dataset)
+  thres = prepareMeasure(dataset, measure, method, thres, granularity, queryStart, queryEnd)
 
   elapsed := time.Since(t1)
   fmt.Println("Read time: ", elapsed)
   fmt.Println("Read: FINISHED")
 
+  // Compare the approximate methods with the exact window correlations
+  if options["compare"] == "t" {
+    compareApproximations(dataset, granularity, ratio, energy, parseRandomProjection(options, dataset, granularity))
+  }
+
   // Matrix initiation
-  matrix := make([][]int, len(dataMap))
+  matrix := make([][]int, dataset.numOfLocations())
   for i := range matrix {
-    matrix[i] = make([]int, len(dataMap))
+    matrix[i] = make([]int, dataset.numOfLocations())
   }
 
   var sketchDurations []string = make([]string, getNumCPU()-1)
@@ -1689,10 +2017,45 @@ func main() {
   var realQueryTime []float64 = make([]float64, getNumCPU()-1)
   var ratioQuery []float64 = make([]float64, getNumCPU()-1)
 
+  // Mutual information, from the whole series (n) or from the histograms of the basic windows (t)
+  if measure == "mi" {
+    clearMatrix(&matrix)
+    t2 := time.Now()
+    networkConstructionMI(dataset, &matrix, thres, granularity, parseMIBins(options), parseSignificance(options), queryStart, queryEnd, method == "t")
+    elapsed = time.Since(t2)
+    checkMatrix(&matrix)
+    fmt.Println("Construction time: ", elapsed)
+  }
+
+  // New values of an update, they slide the in-memory or the stored sketch
+  var datasetNew *Dataset
+  if update == "t" && options["stream"] != "t" {
+    datasetNew = getDatasetNew(fileName, singlePrecision, dataset.length(), numOfLocations, granularity, before, options)
+    if !datasetNew.matchesIndex(dataset.locations) {
+      panic("ERROR: the locations of the new values do not match the loaded dataset")
+    }
+  }
+
+  // Destination of the edges added and removed by updates
+  sink := parseEdgeSink(options)
+  if sink != nil {
+    defer sink.close()
+  }
+
+  // Locations added to and removed from the sketch before it is updated
+  var changes *LocationChanges
+  if options["addlocations"] != "" || options["removelocations"] != "" {
+    if options["stream"] == "t" {
+      changes = getLocationChanges(fileName, singlePrecision, -1, before, granularity, dataset, false, options)
+    } else {
+      changes = getLocationChanges(fileName, singlePrecision, before, before, granularity, dataset, true, options)
+    }
+  }
+
   // Naive implementation without parallel computing
-  if method == "n" && parallel == "f" && update == "f" {
+  if method == "n" && parallel == "f" && update == "f" && measure != "mi" {
     t2 := time.Now()
-    networkConstructionNaive(&dataMap, &matrix, thres)
+    networkConstructionNaive(dataset, &matrix, thres, measure)
     elapsed = time.Since(t2)
     fmt.Println("Construction time: ", elapsed)
   }
@@ -1701,7 +2064,7 @@ func main() {
   if method == "n" && parallel == "t" && update == "f" {
     clearMatrix(&matrix)
     t3 := time.Now()
-    networkConstructionNaiveParallel(&dataMap, &matrix, thres)
+    networkConstructionNaiveParallel(dataset, &matrix, thres, measure)
     elapsed = time.Since(t3)
     checkMatrix(&matrix)
     fmt.Println("Construction time: ", elapsed)
@@ -1712,9 +2075,11 @@ func main() {
     clearMatrix(&matrix)
     t4 := time.Now()
     if method == "t" {
-      networkConstructionBW(&dataMap, &matrix, thres, granularity, writeBlockSize, readBlockSize, false, ratio, queryStart, queryEnd)
+      networkConstructionBW(dataset, &matrix, thres, granularity, writeBlockSize, readBlockSize, false, ratio, energy, queryStart, queryEnd, datasetNew, changes, sink,
+        options["usedb"] == "t", options["keepdb"] == "t")
     } else {
-      networkConstructionBW(&dataMap, &matrix, thres, granularity, writeBlockSize, readBlockSize, true, ratio, queryStart, queryEnd)
+      networkConstructionBW(dataset, &matrix, thres, granularity, writeBlockSize, readBlockSize, true, ratio, energy, queryStart, queryEnd, datasetNew, changes, sink,
+        options["usedb"] == "t", options["keepdb"] == "t")
     }
     elapsed = time.Since(t4)
     checkMatrix(&matrix)
@@ -1722,13 +2087,13 @@ func main() {
   }
 
   // TSUBASA with parallel computing, integreted with PostgreSQL
-  if parallel == "t" && inMem == "f" && update == "f" {
+  if parallel == "t" && inMem == "f" {
     clearMatrix(&matrix)
     t5 := time.Now()
     if method == "t" {
-      networkConstructionBWParallel(&dataMap, &matrix, thres, granularity, writeBlockSize, readBlockSize, false, ratio, queryStart, queryEnd, &sketchDurations, &queryDurations, &queryReadTime)
+      networkConstructionBWParallel(dataset, &matrix, thres, granularity, writeBlockSize, readBlockSize, false, ratio, energy, queryStart, queryEnd, datasetNew, changes, sink, &sketchDurations, &queryDurations, &queryReadTime)
     } else {
-      networkConstructionBWParallel(&dataMap, &matrix, thres, granularity, writeBlockSize, readBlockSize, true, ratio, queryStart, queryEnd, &sketchDurations, &queryDurations, &queryReadTime)
+      networkConstructionBWParallel(dataset, &matrix, thres, granularity, writeBlockSize, readBlockSize, true, ratio, energy, queryStart, queryEnd, datasetNew, changes, sink, &sketchDurations, &queryDurations, &queryReadTime)
     }
     elapsed = time.Since(t5)
     checkMatrix(&matrix)
@@ -1753,28 +2118,94 @@ func main() {
   }
 
   // TSUBASA on single node, in-memory
-  if parallel == "f" && inMem == "t" && update == "f" {
+  var boundMatrix [][]float64 // error bounds of the DFT results
+  if parallel == "f" && inMem == "t" && update == "f" && measure != "mi" {
     clearMatrix(&matrix)
     var sktechTime, queryTime float64
     t6 := time.Now()
-    if method == "t" {
-      networkConstructionBWInMemo(&dataMap, &matrix, thres, granularity, false, ratio, &sktechTime, &queryTime)
+    if options["hierarchy"] == "t" && method != "r" {
+      networkConstructionBWHierarchy(dataset, &matrix, thres, granularity, method != "t", ratio, energy, queryStart, queryEnd, parsePruneLevel(options))
+    } else if method == "t" {
+      networkConstructionBWInMemo(dataset, &matrix, thres, granularity, false, ratio, energy, nil, nil, options["checkpoint"], options["restore"], &sktechTime, &queryTime)
+    } else if method == "r" {
+      networkConstructionBWInMemo(dataset, &matrix, thres, granularity, false, ratio, energy, parseRandomProjection(options, dataset, granularity), nil, "", "", &sktechTime, &queryTime)
+    } else if options["refine"] == "t" {
+      networkConstructionFilterRefine(dataset, &matrix, thres, granularity, ratio, energy, &sktechTime, &queryTime)
     } else {
-      networkConstructionBWInMemo(&dataMap, &matrix, thres, granularity, true, ratio, &sktechTime, &queryTime)
+      boundMatrix = make([][]float64, dataset.numOfLocations())
+      networkConstructionBWInMemo(dataset, &matrix, thres, granularity, true, ratio, energy, nil, &boundMatrix, options["checkpoint"], options["restore"], &sktechTime, &queryTime)
     }
     elapsed = time.Since(t6)
     checkMatrix(&matrix)
     fmt.Println("Running time: ", elapsed)
   }
 
-  // TSUBASA update
-  if update == "t" {
-    dataMapNew := make(map[int][]Point)
-    getDataMap(fileName, &dataMapNew, granularity, numOfLocations)
+  // TSUBASA streaming, the values after the loaded ones are consumed one timestamp at a time
+  if update == "t" && options["stream"] == "t" {
+    var datasetAll *Dataset
+    if changes != nil {
+      datasetAll = changes.dataset // whole series of the locations after the changes
+    } else if options["restore"] == "" {
+      datasetAll = newDataset(singlePrecision)
+      getDataset(fileName, datasetAll, -1, numOfLocations)
+      datasetAll = prepareDataset(datasetAll, options, before)
+      if !datasetAll.matchesIndex(dataset.locations) {
+        panic("ERROR: the streamed locations do not match the loaded dataset")
+      }
+    }
+    t7 := time.Now()
+    var engine *StreamEngine
+    start := dataset.length()
+    if options["restore"] != "" {
+      // The stream continues after the consumed timestamps, over the locations of the checkpoint
+      engine = restoreStreamEngine(options["restore"], granularity, thres, method == "d", ratio, energy, halfLife)
+      start = engine.observed
+      datasetAll = newDataset(singlePrecision)
+      getDataset(fileName, datasetAll, -1, -1)
+      // The climatology is the one the checkpoint was sketched with
+      datasetAll = prepareDataset(datasetAll, options, engine.climatologyBefore).selectLocations(engine.getLocations())
+      dataset = datasetAll
+    } else {
+      engine = newStreamEngine(dataset, granularity, thres, method == "d", ratio, energy, halfLife)
+      engine.climatologyBefore = before
+    }
+    engine.setEdgeSink(sink)
+    engine.setCheckpoint(options["checkpoint"], parseCheckpointEvery(options))
+    if changes != nil {
+      for _, location := range changes.removed {
+        engine.removeLocation(location)
+      }
+      for _, location := range changes.added {
+        engine.addLocation(datasetAll, location)
+      }
+      dataset = datasetAll
+    }
+    observations := make(chan []float64, granularity)
+    go streamDataset(datasetAll, start, observations)
+    engine.run(observations)
+    if options["checkpoint"] != "" {
+      engine.saveCheckpoint(options["checkpoint"])
+    }
+    matrix = engine.getMatrix()
+    fmt.Println("Stream time: ", time.Since(t7))
+  } else if update == "t" && inMem == "t" {
     if method == "t" {
-      networkConstructionBWInMemoUpdate(&dataMap, &matrix, thres, granularity, false, ratio, &dataMapNew)
+      networkConstructionBWInMemoUpdate(dataset, &matrix, thres, granularity, false, ratio, energy, halfLife, datasetNew, parallel == "t", sink)
     } else if method == "d" {
-      networkConstructionBWInMemoUpdate(&dataMap, &matrix, thres, granularity, true, ratio, &dataMapNew)
+      networkConstructionBWInMemoUpdate(dataset, &matrix, thres, granularity, true, ratio, energy, 0, datasetNew, parallel == "t", sink)
+    }
+  }
+
+  // The network of a stored sketch is over the locations after the changes
+  if changes != nil && inMem == "f" {
+    dataset = changes.dataset
+  }
+
+  // Write the network and its location index
+  if options["output"] != "" {
+    writeNetwork(options["output"], dataset, &matrix)
+    if boundMatrix != nil {
+      writeFloatMatrix(&boundMatrix, options["output"] + ".bound.csv")
     }
   }
 }
\ No newline at end of file
@@ -0,0 +1,264 @@
+package main
+
+import (
+  "fmt"
+  "math"
+  "math/rand"
+  "strconv"
+  "time"
+)
+
+const (
+  defaultSketchError = 0.2 // error bound of the correlations that sets the default sketch size
+  defaultSketchSeed = 1
+  projectionConfidence = 0.95 // confidence of the reported error bounds
+)
+
+/* Random projection of z-normalized basic windows. Row i of the matrix multiplies the i-th value of a window,
+   the trailing partial window uses the first rows */
+type RandomProjection struct {
+  k int              // sketch size
+  matrix [][]float64 // granularity x k, entries are +-1/sqrt(k)
+}
+
+/* Create a projection for windows of length granularity with k random Rademacher rows */
+func newRandomProjection(granularity int, k int, seed int64) *RandomProjection {
+  random := rand.New(rand.NewSource(seed))
+  projection := RandomProjection{k: k, matrix: make([][]float64, granularity)}
+  scale := 1 / math.Sqrt(float64(k))
+  for i := range projection.matrix {
+    projection.matrix[i] = make([]float64, k)
+    for j := range projection.matrix[i] {
+      if random.Intn(2) == 0 {
+        projection.matrix[i][j] = scale
+      } else {
+        projection.matrix[i][j] = -scale
+      }
+    }
+  }
+  return &projection
+}
+
+/* Parse the projection options, sketchsize=<k>, sketcherror=<eps> and seed=<n>. Without sketchsize, k is the smallest
+   sketch size whose error bound over all basic windows and pairs of dataset is sketcherror */
+func parseRandomProjection(options map[string]string, dataset *Dataset, granularity int) *RandomProjection {
+  eps := defaultSketchError
+  if options["sketcherror"] != "" {
+    floatVal, err := strconv.ParseFloat(options["sketcherror"], 64)
+    if err != nil || floatVal <= 0 || floatVal >= 2.0 / 3.0 {
+      panic("Invalid sketch error, it must be in (0, 2/3): " + options["sketcherror"])
+    }
+    eps = floatVal
+  }
+  k := getProjectionSketchSize(eps, getProjectionFailureProbability(getNumberOfBasicwindows(dataset, granularity), dataset.numOfLocations()))
+  if options["sketchsize"] != "" {
+    intVal, err := strconv.Atoi(options["sketchsize"])
+    if err != nil || intVal <= 0 {
+      panic("Invalid sketch size: " + options["sketchsize"])
+    }
+    k = intVal
+  }
+  var seed int64 = defaultSketchSeed
+  if options["seed"] != "" {
+    intVal, err := strconv.ParseInt(options["seed"], 10, 64)
+    if err != nil {
+      panic("Invalid seed: " + options["seed"])
+    }
+    seed = intVal
+  }
+  return newRandomProjection(granularity, k, seed)
+}
+
+/* Project one window, z-normalized and scaled to unit length like getDFTResult. A constant window projects to 0 */
+func (projection *RandomProjection) project(window []float64, result []float64) {
+  for j := range result {
+    result[j] = 0
+  }
+  mean, sigma := getWindowMeanSigma(window)
+  if sigma == 0 {
+    return
+  }
+  scale := 1 / (sigma * math.Sqrt(float64(len(window))))
+  for i, x := range window {
+    normalized := (x - mean) * scale
+    row := projection.matrix[i]
+    for j := range result {
+      result[j] += normalized * row[j]
+    }
+  }
+}
+
+/* Project every series and basic window once, indexed by [row][window] */
+func getSeriesProjections(dataset *Dataset, granularity int, projection *RandomProjection) [][][]float64 {
+  t0 := time.Now()
+  numberOfBasicwindows := getNumberOfBasicwindows(dataset, granularity)
+  seriesProjections := make([][][]float64, dataset.numOfLocations())
+  var buf []float64
+  for row := range seriesProjections {
+    series := dataset.series(row, &buf)
+    seriesProjections[row] = make([][]float64, numberOfBasicwindows)
+    for b := 0; b < numberOfBasicwindows; b += 1 {
+      end := int(math.Min(float64((b+1)*granularity), float64(len(series))))
+      seriesProjections[row][b] = make([]float64, projection.k)
+      projection.project(series[b*granularity:end], seriesProjections[row][b])
+    }
+  }
+  fmt.Println("Projection time: ", time.Since(t0))
+  return seriesProjections
+}
+
+/* Estimate the cXY of every basic window of a pair from the inner products of the projections */
+func getProjectionResult(pair *Pair, bwr *BasicWindowResult, seriesProjections *([][][]float64)) {
+  left := (*seriesProjections)[pair.indexOfRow]
+  right := (*seriesProjections)[pair.indexOfCol]
+  slicesOfCXY := make([]float64, len(left))
+  for b := range left {
+    var cXY float64 = 0
+    for j := range left[b] {
+      cXY += left[b][j] * right[b][j]
+    }
+    slicesOfCXY[b] = math.Max(-1, math.Min(1, cXY))
+  }
+  bwr.pair = *pair
+  bwr.slicesOfCXY = &slicesOfCXY
+}
+
+/* Error bound eps of the inner product of two unit vectors projected to k dimensions:
+   P(|<Px,Py> - <x,y>| >= eps) <= 4 exp(-(eps^2 - eps^3) k / 4), solved for the failure probability delta */
+func getProjectionErrorBound(k int, delta float64) float64 {
+  target := 4 * math.Log(4 / delta) / float64(k)
+  // eps^2 - eps^3 is increasing on [0, 2/3], larger errors are not informative for correlations
+  low, high := 0.0, 2.0 / 3.0
+  if high*high - high*high*high < target {
+    return 2
+  }
+  for iteration := 0; iteration < 60; iteration += 1 {
+    mid := (low + high) / 2
+    if mid*mid - mid*mid*mid < target {
+      low = mid
+    } else {
+      high = mid
+    }
+  }
+  return high
+}
+
+/* Smallest sketch size whose error bound is eps with failure probability delta, see getProjectionErrorBound */
+func getProjectionSketchSize(eps float64, delta float64) int {
+  return int(math.Ceil(4 * math.Log(4 / delta) / (eps*eps - eps*eps*eps)))
+}
+
+/* Failure probability of every window of every pair, so that the bound holds for all pairs at once with
+   projectionConfidence (union bound) */
+func getProjectionFailureProbability(numberOfBasicwindows int, locationsNum int) float64 {
+  pairsNum := locationsNum * (locationsNum - 1) / 2
+  return (1 - projectionConfidence) / (math.Max(1, float64(numberOfBasicwindows)) * math.Max(1, float64(pairsNum)))
+}
+
+/* Report the error bound of a query over numberOfBasicwindows windows of locationsNum series. The error of each window's
+   cXY moves the combined correlation by at most the same amount (Cauchy-Schwarz), the confidence is split over the
+   windows of every pair (union bound), so the bound holds for all pairs at once */
+func displayProjectionErrorBound(projection *RandomProjection, numberOfBasicwindows int, locationsNum int) {
+  pairsNum := locationsNum * (locationsNum - 1) / 2
+  if numberOfBasicwindows == 0 || pairsNum == 0 {
+    return
+  }
+  delta := getProjectionFailureProbability(numberOfBasicwindows, locationsNum)
+  eps := getProjectionErrorBound(projection.k, delta)
+  if eps >= 2 {
+    fmt.Println(fmt.Sprintf("Random projection: sketch size %d is too small for an error bound, a bound of %.2f needs sketchsize >= %d",
+      projection.k, defaultSketchError, getProjectionSketchSize(defaultSketchError, delta)))
+    return
+  }
+  fmt.Println(fmt.Sprintf("Random projection: sketch size %d, |corr error| <= %.4f for all %d pairs at once with probability >= %.2f",
+    projection.k, eps, pairsNum, projectionConfidence))
+}
+
+/* Compare the window correlations of the DFT (getDFTResult with N coefficients) and of the random projection
+   with the exact ones over all pairs and basic windows */
+func compareApproximations(dataset *Dataset, granularity int, ratio float64, energy float64, projection *RandomProjection) {
+  numberOfBasicwindows := dataset.length() / granularity // full windows only, getDFTResult has one length
+  locationsNum := dataset.numOfLocations()
+  if numberOfBasicwindows == 0 || locationsNum < 2 {
+    fmt.Println("Comparison: no pair with a full basic window to compare")
+    return
+  }
+  N := getCoefficientsNum(granularity, ratio)
+  if energy > 0 {
+    N = getDistinctCoefficientsNum(granularity)
+  }
+
+  t0 := time.Now()
+  dfts := make([][][]complex128, locationsNum)
+  var buf []float64
+  for row := range dfts {
+    series := dataset.series(row, &buf)
+    dfts[row] = make([][]complex128, numberOfBasicwindows)
+    for b := range dfts[row] {
+      window := series[b*granularity : (b+1)*granularity]
+      mean, sigma := getWindowMeanSigma(window)
+      dfts[row][b] = []complex128{}
+      if sigma > 0 {
+        dfts[row][b] = make([]complex128, N)
+        getDFTResult(sigma, mean, granularity, N, &window, &dfts[row][b])
+        scaleSpectrum(dfts[row][b], granularity)
+      }
+    }
+  }
+  if energy > 0 {
+    truncateSpectra(dfts, energy)
+  }
+  dftTime := time.Since(t0)
+
+  t1 := time.Now()
+  projections := make([][][]float64, locationsNum)
+  for row := range projections {
+    series := dataset.series(row, &buf)
+    projections[row] = make([][]float64, numberOfBasicwindows)
+    for b := range projections[row] {
+      projections[row][b] = make([]float64, projection.k)
+      projection.project(series[b*granularity:(b+1)*granularity], projections[row][b])
+    }
+  }
+  projectionTime := time.Since(t1)
+
+  var sumErrorDFT, maxErrorDFT, sumBoundDFT, withinBoundDFT, sumErrorProjection, maxErrorProjection, count float64
+  var bufX, bufY []float64
+  for i := 0; i < locationsNum; i += 1 {
+    for j := i + 1; j < locationsNum; j += 1 {
+      x := dataset.series(i, &bufX)
+      y := dataset.series(j, &bufY)
+      for b := 0; b < numberOfBasicwindows; b += 1 {
+        var moments Moments
+        for k := b*granularity; k < (b+1)*granularity; k += 1 {
+          moments.add(x[k], y[k])
+        }
+        exact, _ := moments.correlation()
+        d, boundDFT := getSpectralDistance(dfts[i][b], dfts[j][b])
+        var inner float64 = 0
+        for k := range projections[i][b] {
+          inner += projections[i][b][k] * projections[j][b][k]
+        }
+        errorDFT := math.Abs(1 - 0.5*d*d - exact)
+        sumBoundDFT += boundDFT
+        if errorDFT <= boundDFT + 1e-9 {
+          withinBoundDFT += 1
+        }
+        errorProjection := math.Abs(inner - exact)
+        sumErrorDFT += errorDFT
+        sumErrorProjection += errorProjection
+        maxErrorDFT = math.Max(maxErrorDFT, errorDFT)
+        maxErrorProjection = math.Max(maxErrorProjection, errorProjection)
+        count += 1
+      }
+    }
+  }
+  fmt.Println(fmt.Sprintf("DFT (at most %d coefficients): sketch %v, mean |error| %.4f, max |error| %.4f, mean bound %.4f, within bound %.1f%%",
+    N, dftTime, sumErrorDFT/count, maxErrorDFT, sumBoundDFT/count, 100*withinBoundDFT/count))
+  bound := "none"
+  if eps := getProjectionErrorBound(projection.k, 1 - projectionConfidence); eps < 2 {
+    bound = fmt.Sprintf("%.4f", eps)
+  }
+  fmt.Println(fmt.Sprintf("Random projection (sketch size %d): sketch %v, mean |error| %.4f, max |error| %.4f, bound %s for each window of each pair with probability >= %.2f",
+    projection.k, projectionTime, sumErrorProjection/count, maxErrorProjection, bound, projectionConfidence))
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+  "fmt"
+  "math"
+  "sort"
+)
+
+/* Parse the correlation measure, "pearson" (default), "spearman", "kendall" or "mi" (mutual information, see mi.go) */
+func parseMeasure(options map[string]string) string {
+  measure := options["measure"]
+  if measure == "" {
+    return "pearson"
+  }
+  if measure != "pearson" && measure != "spearman" && measure != "kendall" && measure != "mi" {
+    panic("Invalid measure: " + measure)
+  }
+  return measure
+}
+
+/* Get the ranks of a series, ties get their average rank. NaN values are not ranked and stay NaN */
+func getRanks(series []float64, ranks []float64) {
+  indexes := make([]int, 0, len(series))
+  for k, val := range series {
+    ranks[k] = math.NaN()
+    if !math.IsNaN(val) {
+      indexes = append(indexes, k)
+    }
+  }
+  sort.SliceStable(indexes, func(a, b int) bool {
+    return series[indexes[a]] < series[indexes[b]]
+  })
+  for start := 0; start < len(indexes); {
+    end := start + 1
+    for end < len(indexes) && series[indexes[end]] == series[indexes[start]] {
+      end += 1
+    }
+    // Ranks start+1 ... end share their average
+    rank := float64(start + end + 1) / 2
+    for k := start; k < end; k += 1 {
+      ranks[indexes[k]] = rank
+    }
+    start = end
+  }
+}
+
+/* Replace every series by its ranks. The Pearson correlation of ranks is the Spearman correlation,
+   the Kendall correlation does not change */
+func rankDataset(dataset *Dataset) {
+  var buf []float64
+  ranks := make([]float64, dataset.length())
+  for row := range dataset.locations {
+    series := dataset.series(row, &buf)
+    getRanks(series, ranks)
+    for k, rank := range ranks {
+      dataset.set(row, k, rank)
+    }
+  }
+}
+
+/* Get the correlation of two series with the given measure, ok is false when one of them is constant */
+func getCorrelationOfSeries(measure string, leftSeries []float64, rightSeries []float64) (float64, bool) {
+  if measure == "kendall" {
+    return getKendallTau(leftSeries, rightSeries)
+  }
+  // Spearman series are ranked beforehand, see rankDataset
+  var moments Moments
+  for k := 0; k < len(leftSeries); k += 1 {
+    moments.add(leftSeries[k], rightSeries[k])
+  }
+  return moments.correlation()
+}
+
+/* Kendall's tau-b in O(n log n) (Knight's algorithm), ok is false when one of the series is constant */
+func getKendallTau(leftSeries []float64, rightSeries []float64) (float64, bool) {
+  n := len(leftSeries)
+  indexes := make([]int, n)
+  for k := range indexes {
+    indexes[k] = k
+  }
+  // Sort by x, then by y
+  sort.Slice(indexes, func(a, b int) bool {
+    if leftSeries[indexes[a]] != leftSeries[indexes[b]] {
+      return leftSeries[indexes[a]] < leftSeries[indexes[b]]
+    }
+    return rightSeries[indexes[a]] < rightSeries[indexes[b]]
+  })
+  ys := make([]float64, n)
+  for k, index := range indexes {
+    ys[k] = rightSeries[index]
+  }
+  // Pairs tied in x, and tied in both x and y
+  var tiesX, tiesXY float64 = 0, 0
+  for start := 0; start < n; {
+    end := start + 1
+    for end < n && leftSeries[indexes[end]] == leftSeries[indexes[start]] {
+      end += 1
+    }
+    tiesX += float64(end - start) * float64(end - start - 1) / 2
+    for startXY := start; startXY < end; {
+      endXY := startXY + 1
+      for endXY < end && ys[endXY] == ys[startXY] {
+        endXY += 1
+      }
+      tiesXY += float64(endXY - startXY) * float64(endXY - startXY - 1) / 2
+      startXY = endXY
+    }
+    start = end
+  }
+  // Discordant pairs are the swaps needed to sort by y
+  swaps := sortAndCountSwaps(ys, make([]float64, n))
+  var tiesY float64 = 0
+  for start := 0; start < n; {
+    end := start + 1
+    for end < n && ys[end] == ys[start] {
+      end += 1
+    }
+    tiesY += float64(end - start) * float64(end - start - 1) / 2
+    start = end
+  }
+  pairs := float64(n) * float64(n - 1) / 2
+  if pairs - tiesX <= 0 || pairs - tiesY <= 0 {
+    return 0, false
+  }
+  tau := (pairs - tiesX - tiesY + tiesXY - 2 * swaps) / (math.Sqrt(pairs - tiesX) * math.Sqrt(pairs - tiesY))
+  return math.Max(-1, math.Min(1, tau)), true
+}
+
+/* Merge sort values in place, returns the number of swaps of strictly decreasing pairs */
+func sortAndCountSwaps(values []float64, buf []float64) float64 {
+  if len(values) < 2 {
+    return 0
+  }
+  middle := len(values) / 2
+  swaps := sortAndCountSwaps(values[:middle], buf[:middle]) + sortAndCountSwaps(values[middle:], buf[middle:])
+  i, j, k := 0, middle, 0
+  for i < middle && j < len(values) {
+    if values[j] < values[i] {
+      swaps += float64(middle - i)
+      buf[k] = values[j]
+      j += 1
+    } else {
+      buf[k] = values[i]
+      i += 1
+    }
+    k += 1
+  }
+  k += copy(buf[k:], values[i:middle])
+  copy(buf[k:], values[j:])
+  copy(values, buf)
+  return swaps
+}
+
+/* The sketches approximate Kendall's tau from the Spearman correlation rho of a Gaussian copula, where the Pearson
+   correlation is r = sin(pi tau / 2) = 2 sin(pi rho / 6). The relation is monotonic, so a Kendall threshold is a
+   Spearman threshold of 6/pi asin(sin(pi thres / 2) / 2) */
+func getSpearmanThreshold(kendallThres float64) float64 {
+  return 6 / math.Pi * math.Asin(math.Sin(math.Pi * kendallThres / 2) / 2)
+}
+
+/* Prepare the dataset for a rank measure, returns the threshold for the sketch methods. The series are ranked as a
+   whole, so the sketch methods must query all basic windows: the Pearson correlation of the ranks over a shorter range
+   is not the Spearman correlation of that range */
+func prepareMeasure(dataset *Dataset, measure string, method string, thres float64, granularity int, queryStart int, queryEnd int) float64 {
+  if measure == "pearson" || measure == "mi" {
+    return thres
+  }
+  numberOfBasicwindows := getNumberOfBasicwindows(dataset, granularity)
+  if method != "n" && (queryStart > 0 || queryEnd < numberOfBasicwindows) {
+    panic(fmt.Sprintf("ERROR: measure %s needs the query range to cover all %d basic windows, the series are ranked as a whole",
+      measure, numberOfBasicwindows))
+  }
+  rankDataset(dataset)
+  if measure == "kendall" && method != "n" {
+    thres = getSpearmanThreshold(thres)
+    fmt.Println(fmt.Sprintf("Kendall's tau is approximated from the Spearman sketch assuming a Gaussian copula, the network is approximate: threshold %.4f", thres))
+  }
+  return thres
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+  "math"
+  "math/rand"
+  "testing"
+)
+
+/* Helper function: Kendall's tau-b by comparing every pair of timestamps */
+func getKendallTauQuadratic(xs []float64, ys []float64) (float64, bool) {
+  var concordant, discordant, tiesOnlyX, tiesOnlyY, pairs float64 = 0, 0, 0, 0, 0
+  for a := range xs {
+    for b := a + 1; b < len(xs); b += 1 {
+      pairs += 1
+      product := (xs[a] - xs[b]) * (ys[a] - ys[b])
+      switch {
+        case product > 0:
+          concordant += 1
+        case product < 0:
+          discordant += 1
+        case xs[a] == xs[b] && ys[a] != ys[b]:
+          tiesOnlyX += 1
+        case xs[a] != xs[b] && ys[a] == ys[b]:
+          tiesOnlyY += 1
+      }
+    }
+  }
+  untiedX := concordant + discordant + tiesOnlyY
+  untiedY := concordant + discordant + tiesOnlyX
+  if untiedX == 0 || untiedY == 0 {
+    return 0, false
+  }
+  return (concordant - discordant) / (math.Sqrt(untiedX) * math.Sqrt(untiedY)), true
+}
+
+/* Kendall's tau-b of series with and without ties, and of constant series, against the O(n^2) definition */
+func TestKendallTauTies(t *testing.T) {
+  random := rand.New(rand.NewSource(17))
+  tests := []struct {
+    name string
+    length int
+    levelsX int // number of distinct values of x, 0 draws continuous values
+    levelsY int
+    sign float64 // sign of the dependence of y on x
+  }{
+    {"no ties", 200, 0, 0, 1},
+    {"negative", 200, 0, 0, -1},
+    {"ties in x", 150, 5, 0, 1},
+    {"ties in y", 150, 0, 3, -1},
+    {"ties in both", 300, 4, 4, 1},
+    {"binary", 100, 2, 2, 1},
+    {"two values", 2, 0, 0, 1},
+    {"constant x", 50, 1, 0, 1},
+    {"constant y", 50, 0, 1, 1},
+    {"single value", 1, 0, 0, 1},
+  }
+  level := func(val float64, levels int) float64 {
+    if levels == 0 {
+      return val
+    }
+    // Cut a standard normal value into levels bins
+    return math.Min(float64(levels - 1), math.Max(0, math.Floor((val + 1.5) * float64(levels) / 3)))
+  }
+  for _, test := range tests {
+    xs := make([]float64, test.length)
+    ys := make([]float64, test.length)
+    for k := range xs {
+      x := random.NormFloat64()
+      xs[k] = level(x, test.levelsX)
+      ys[k] = level(test.sign * 0.5 * x + random.NormFloat64(), test.levelsY)
+    }
+    expected, expectedOk := getKendallTauQuadratic(xs, ys)
+    tau, ok := getKendallTau(xs, ys)
+    if ok != expectedOk || math.Abs(tau - expected) > 1e-12 {
+      t.Errorf("%s: tau %v (%v), expected %v (%v)", test.name, tau, ok, expected, expectedOk)
+    }
+  }
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+  "fmt"
+  "os"
+  "bufio"
+  "bytes"
+  "errors"
+  "io"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "compress/gzip"
+  // package for zstd-compressed input
+  "github.com/klauspost/compress/zstd"
+)
+
+const (
+  readChunkSize        = 4 << 20 // bytes of input handed to one parser goroutine
+  maxReportedLineErrors = 20     // malformed lines printed before only counting them
+)
+
+/* A block of complete lines, its position in the input and the line number of its first line */
+type LineChunk struct {
+  index int
+  firstLine int
+  data []byte
+}
+
+/* A malformed line found while parsing */
+type LineError struct {
+  line int
+  err error
+}
+
+/* A parsed sample waiting to be written to its column */
+type ParsedSample struct {
+  row int
+  timestamp int
+  temperature float64
+  line int
+}
+
+/* Columns of the dataset shared by the parser goroutines */
+type ColumnStore struct {
+  mu sync.Mutex
+  dataset *Dataset
+  counts []int        // row -> number of samples written
+  written [][]uint64  // row -> bitset of the written timestamps, a sample of value NaN is written too
+  limit int           // maximum number of locations, negative for no limit
+  length int          // allocated length of every series
+  maxTimestamp int    // largest timestamp written
+  fixedLength bool    // length is known in advance (before > 0)
+  duplicates int      // samples of a cell that was already written
+  nextChunk int       // index of the next chunk that is written
+  turn *sync.Cond     // signalled when nextChunk advances
+}
+
+/* Open a possibly compressed input, gzip and zstd are detected by their magic bytes */
+func openInput(filePth string) (io.Reader, func(), error) {
+  f, err := os.Open(filePth)
+  if err != nil {
+    return nil, nil, err
+  }
+  bfRd := bufio.NewReaderSize(f, readChunkSize)
+  magic, _ := bfRd.Peek(4)
+  switch {
+    case len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+      gzRd, err := gzip.NewReader(bfRd)
+      if err != nil {
+        f.Close()
+        return nil, nil, err
+      }
+      fmt.Println("Input format: gzip")
+      return gzRd, func() { gzRd.Close(); f.Close() }, nil
+    case len(magic) == 4 && magic[0] == 0x28 && magic[1] == 0xb5 && magic[2] == 0x2f && magic[3] == 0xfd:
+      zstdRd, err := zstd.NewReader(bfRd)
+      if err != nil {
+        f.Close()
+        return nil, nil, err
+      }
+      fmt.Println("Input format: zstd")
+      return zstdRd, func() { zstdRd.Close(); f.Close() }, nil
+  }
+  return bfRd, func() { f.Close() }, nil
+}
+
+/* Parse an unsigned or negative decimal integer without allocating */
+func parseIntBytes(b []byte) (int, bool) {
+  if len(b) == 0 {
+    return 0, false
+  }
+  sign := 1
+  if b[0] == '-' {
+    sign = -1
+    b = b[1:]
+    if len(b) == 0 {
+      return 0, false
+    }
+  }
+  var val int = 0
+  for _, c := range b {
+    if c < '0' || c > '9' {
+      return 0, false
+    }
+    val = val*10 + int(c-'0')
+  }
+  return sign * val, true
+}
+
+/* Transfer a line ([]byte) to Point */
+func processLine(line []byte) (Point, error) {
+  line = bytes.TrimRight(line, "\r\n")
+  dataPoint := Point{-1, -1, -1, -1, 0}
+  var fields [4][]byte
+  numOfFields := 0
+  for numOfFields < 4 {
+    index := bytes.IndexByte(line, ',')
+    if index < 0 {
+      fields[numOfFields] = line
+      numOfFields += 1
+      line = nil
+      break
+    }
+    fields[numOfFields] = line[:index]
+    numOfFields += 1
+    line = line[index+1:]
+  }
+  if numOfFields != 4 || line != nil {
+    return dataPoint, errors.New("invalid number of items")
+  }
+  var ok bool
+  if dataPoint.timestamp, ok = parseIntBytes(fields[0]); !ok {
+    return dataPoint, fmt.Errorf("invalid timestamp %q", fields[0])
+  }
+  if dataPoint.latitude, ok = parseIntBytes(fields[1]); !ok {
+    return dataPoint, fmt.Errorf("invalid latitude %q", fields[1])
+  }
+  if dataPoint.longitude, ok = parseIntBytes(fields[2]); !ok {
+    return dataPoint, fmt.Errorf("invalid longitude %q", fields[2])
+  }
+  floatVal, err := strconv.ParseFloat(string(fields[3]), 64)
+  if err != nil {
+    return dataPoint, fmt.Errorf("invalid temperature %q", fields[3])
+  }
+  if dataPoint.timestamp < 0 {
+    return dataPoint, fmt.Errorf("negative timestamp %d", dataPoint.timestamp)
+  }
+  dataPoint.location = dataPoint.longitude + 1000 * dataPoint.latitude
+  dataPoint.temperature = floatVal
+  return dataPoint, nil
+}
+
+/* Get the timestamp of the first line in data, used to stop reading early */
+func leadingTimestamp(data []byte) (int, bool) {
+  index := bytes.IndexByte(data, ',')
+  if index < 0 {
+    return 0, false
+  }
+  return parseIntBytes(data[:index])
+}
+
+/* Create an empty column store writing to dataset */
+func newColumnStore(dataset *Dataset, before int, count int) *ColumnStore {
+  store := ColumnStore{dataset: dataset, limit: count, maxTimestamp: -1, turn: sync.NewCond(&sync.Mutex{})}
+  if before > 0 {
+    store.length = before
+    store.fixedLength = true
+  }
+  return &store
+}
+
+/* Get the row of a location, registering it if there is still room. Returns -1 if the location is not loaded */
+func (store *ColumnStore) rowOf(location int, latitude int, longitude int) int {
+  store.mu.Lock()
+  defer store.mu.Unlock()
+  if row, ok := store.dataset.indexOfLocation[location]; ok {
+    return row
+  }
+  if store.limit >= 0 && store.dataset.numOfLocations() >= store.limit {
+    return -1
+  }
+  store.counts = append(store.counts, 0)
+  store.written = append(store.written, make([]uint64, (store.length + 63) / 64))
+  return store.dataset.addLocation(location, latitude, longitude, store.length)
+}
+
+/* Register the locations of a chunk and write its samples, which refer to their location by its index in firstPoints
+   (the first point of every location of the chunk). Chunks are written in the order of the input, so that a count
+   limit keeps the first locations of the file and the first sample of a cell is kept whatever the order the chunks
+   are parsed in */
+func (store *ColumnStore) writeChunk(chunkIndex int, firstPoints []Point, samples []ParsedSample, lineErrors *([]LineError)) {
+  store.turn.L.Lock()
+  for store.nextChunk != chunkIndex {
+    store.turn.Wait()
+  }
+  store.turn.L.Unlock()
+  rows := make([]int, len(firstPoints))
+  for i, dataPoint := range firstPoints {
+    rows[i] = store.rowOf(dataPoint.location, dataPoint.latitude, dataPoint.longitude)
+  }
+  maxTimestamp := -1
+  kept := samples[:0]
+  for _, sample := range samples {
+    if sample.row = rows[sample.row]; sample.row < 0 {
+      continue
+    }
+    if sample.timestamp > maxTimestamp {
+      maxTimestamp = sample.timestamp
+    }
+    kept = append(kept, sample)
+  }
+  store.write(kept, maxTimestamp, lineErrors)
+  store.turn.L.Lock()
+  store.nextChunk += 1
+  store.turn.Broadcast()
+  store.turn.L.Unlock()
+}
+
+/* Grow every series so that timestamp maxTimestamp fits */
+func (store *ColumnStore) grow(maxTimestamp int) {
+  store.mu.Lock()
+  defer store.mu.Unlock()
+  if maxTimestamp < store.length {
+    return
+  }
+  newLength := 2 * store.length
+  if newLength <= maxTimestamp {
+    newLength = maxTimestamp + 1
+  }
+  store.dataset.grow(newLength)
+  for row := range store.written {
+    store.written[row] = append(store.written[row], make([]uint64, (newLength + 63) / 64 - len(store.written[row]))...)
+  }
+  store.length = newLength
+}
+
+/* Write parsed samples to their columns. A sample of a cell that is already written comes from a duplicate line, it is
+   reported and not written */
+func (store *ColumnStore) write(samples []ParsedSample, maxTimestamp int, lineErrors *([]LineError)) {
+  if !store.fixedLength {
+    store.grow(maxTimestamp)
+  }
+  store.mu.Lock()
+  defer store.mu.Unlock()
+  for _, sample := range samples {
+    word, bit := sample.timestamp / 64, uint64(1) << uint(sample.timestamp % 64)
+    if store.written[sample.row][word] & bit != 0 {
+      *lineErrors = append(*lineErrors, LineError{sample.line, fmt.Errorf("duplicate sample of location %d at timestamp %d",
+        store.dataset.locations[sample.row], sample.timestamp)})
+      store.duplicates += 1
+      continue
+    }
+    store.written[sample.row][word] |= bit
+    store.dataset.set(sample.row, sample.timestamp, sample.temperature)
+    store.counts[sample.row] += 1
+  }
+  if maxTimestamp > store.maxTimestamp {
+    store.maxTimestamp = maxTimestamp
+  }
+}
+
+/* Parse a chunk of lines and write the samples to the store */
+func parseChunk(chunk LineChunk, store *ColumnStore, before int, lineErrors *([]LineError)) {
+  samples := make([]ParsedSample, 0, bytes.Count(chunk.data, []byte{'\n'}) + 1)
+  var firstPoints []Point        // first point of every location of the chunk
+  indexOfLocation := make(map[int]int) // location -> index in firstPoints
+  lineNumber := chunk.firstLine
+  data := chunk.data
+  for len(data) > 0 {
+    var line []byte
+    index := bytes.IndexByte(data, '\n')
+    if index < 0 {
+      line = data
+      data = nil
+    } else {
+      line = data[:index]
+      data = data[index+1:]
+    }
+    lineNumber += 1
+    if len(bytes.TrimSpace(line)) == 0 {
+      continue
+    }
+    if ts, ok := leadingTimestamp(line); ok && before > 0 && ts >= before {
+      // Lines are ordered by time like in readChunks, the rest of the input is not read
+      break
+    }
+    dataPoint, err := processLine(line)
+    if err != nil {
+      // The header of the csv file is not a malformed line
+      if lineNumber == 1 && strings.HasPrefix(string(line), "time") {
+        continue
+      }
+      *lineErrors = append(*lineErrors, LineError{lineNumber, err})
+      continue
+    }
+    i, ok := indexOfLocation[dataPoint.location]
+    if !ok {
+      i = len(firstPoints)
+      indexOfLocation[dataPoint.location] = i
+      firstPoints = append(firstPoints, dataPoint)
+    }
+    // Rows are only known after registering, the sample keeps the index of its location until then
+    samples = append(samples, ParsedSample{i, dataPoint.timestamp, dataPoint.temperature, lineNumber})
+  }
+  store.writeChunk(chunk.index, firstPoints, samples, lineErrors)
+}
+
+/* Split the input into chunks of complete lines of about chunkSize bytes and send them to the parsers */
+func readChunks(rd io.Reader, chunkChan chan LineChunk, before int, chunkSize int) error {
+  defer close(chunkChan)
+  var remained []byte
+  lineNumber := 0
+  chunkIndex := 0
+  for {
+    buf := make([]byte, len(remained), len(remained) + chunkSize)
+    copy(buf, remained)
+    n, err := io.ReadFull(rd, buf[len(remained):cap(buf)])
+    buf = buf[:len(remained) + n]
+    isLast := err == io.EOF || err == io.ErrUnexpectedEOF
+    if err != nil && !isLast {
+      return err
+    }
+    var data []byte
+    if isLast {
+      data = buf
+      remained = nil
+    } else {
+      index := bytes.LastIndexByte(buf, '\n')
+      if index < 0 {
+        // A single line longer than the chunk, keep reading
+        remained = buf
+        continue
+      }
+      data = buf[:index+1]
+      remained = buf[index+1:]
+    }
+    if len(data) > 0 {
+      // Lines are ordered by time, so nothing after this chunk is needed
+      if ts, ok := leadingTimestamp(data); ok && before > 0 && ts >= before {
+        return nil
+      }
+      chunkChan <- LineChunk{chunkIndex, lineNumber, data}
+      chunkIndex += 1
+      lineNumber += bytes.Count(data, []byte{'\n'})
+    }
+    if isLast {
+      return nil
+    }
+  }
+}
+
+/* Arguments: before: set timestamp limit, count: set number of locations limit */
+func ReadLine(filePth string, dataset *Dataset,
+              before int, count int) error {
+  rd, closeInput, err := openInput(filePth)
+  if err != nil {
+    return err
+  }
+  defer closeInput()
+  fmt.Println("Open file: SUCCESS")
+
+  lineErrors, duplicates, err := parseInput(rd, dataset, before, count, readChunkSize)
+  if err != nil {
+    return err
+  }
+
+  // Report malformed lines
+  if len(lineErrors) > 0 {
+    for i := 0; i < len(lineErrors) && i < maxReportedLineErrors; i += 1 {
+      fmt.Println(fmt.Sprintf("WARNING: line %d: %v", lineErrors[i].line, lineErrors[i].err))
+    }
+    fmt.Println(fmt.Sprintf("WARNING: %d malformed lines", len(lineErrors)))
+  }
+  if duplicates > 0 {
+    return fmt.Errorf("%d duplicate samples, every location has at most one sample per timestamp", duplicates)
+  }
+  return nil
+}
+
+/* Parse the lines of rd into dataset in chunks of about chunkSize bytes, one parser goroutine per CPU. Returns the
+   malformed lines sorted by line number and how many of them are duplicate samples */
+func parseInput(rd io.Reader, dataset *Dataset, before int, count int, chunkSize int) ([]LineError, int, error) {
+  store := newColumnStore(dataset, before, count)
+  NCPU := getNumCPU()
+  chunkChan := make(chan LineChunk, NCPU)
+  listOfLineErrors := make([][]LineError, NCPU)
+  var wg sync.WaitGroup
+
+  readErrChan := make(chan error, 1)
+  go func() { readErrChan <- readChunks(rd, chunkChan, before, chunkSize) }()
+  for i := 0; i < NCPU; i += 1 {
+    wg.Add(1)
+    go func(taskNum int) {
+      defer wg.Done()
+      for chunk := range chunkChan {
+        parseChunk(chunk, store, before, &listOfLineErrors[taskNum])
+      }
+    }(i)
+  }
+  wg.Wait()
+  if err := <-readErrChan; err != nil {
+    return nil, 0, err
+  }
+  var lineErrors []LineError
+  for i := 0; i < NCPU; i += 1 {
+    lineErrors = append(lineErrors, listOfLineErrors[i]...)
+  }
+  sortLineErrors(&lineErrors)
+
+  // Trim series to the timestamps actually read
+  length := store.maxTimestamp + 1
+  dataset.truncate(length)
+  dataset.timestamps = make([]int, length)
+  for k := 0; k < length; k += 1 {
+    dataset.timestamps[k] = k
+  }
+  for row, location := range dataset.locations {
+    if store.counts[row] != length {
+      fmt.Println(fmt.Sprintf("WARNING: location %d has %d samples, expected %d", location, store.counts[row], length))
+    }
+  }
+  // Rows are assigned in the order of the file, sort them by location for a stable index
+  dataset.sortByLocation()
+  return lineErrors, store.duplicates, nil
+}
+
+/* Sort malformed lines by line number */
+func sortLineErrors(lineErrors *([]LineError)) {
+  sort.Slice(*lineErrors, func(a, b int) bool {
+    return (*lineErrors)[a].line < (*lineErrors)[b].line
+  })
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+  "bytes"
+  "fmt"
+  "math"
+  "math/rand"
+  "sort"
+  "strings"
+  "testing"
+)
+
+/* A csv file ordered by time with a header, gaps, NaN values, blank and malformed lines and duplicate samples */
+func newTestInput(locationsNum int, length int, seed int64) string {
+  random := rand.New(rand.NewSource(seed))
+  var sb strings.Builder
+  sb.WriteString("time,latitude,longitude,temperature\n")
+  for k := 0; k < length; k += 1 {
+    for _, row := range random.Perm(locationsNum) {
+      line := fmt.Sprintf("%d,%d,%d,%.3f\n", k, 10 + row, 5 - row, random.NormFloat64())
+      switch random.Intn(20) {
+        case 0:
+          continue // gap
+        case 1:
+          line = fmt.Sprintf("%d,%d,%d,nan\n", k, 10 + row, 5 - row)
+        case 2:
+          sb.WriteString(line) // duplicate
+        case 3:
+          sb.WriteString(fmt.Sprintf("%d,%d,x\n", k, row))
+        case 4:
+          sb.WriteString("\n")
+        case 5:
+          line = strings.Replace(line, "\n", "\r\n", 1)
+      }
+      sb.WriteString(line)
+    }
+  }
+  return sb.String()
+}
+
+/* Parse the input line by line up to timestamp before: the first sample of a cell is kept, the first count locations of
+   the file are loaded */
+func parseSerially(input string, before int, count int) (map[int][]float64, []int) {
+  values := make(map[int][]float64)
+  written := make(map[[2]int]bool)
+  var errorLines []int
+  maxTimestamp := -1
+  for n, line := range strings.Split(strings.TrimSuffix(input, "\n"), "\n") {
+    if len(bytes.TrimSpace([]byte(line))) == 0 {
+      continue
+    }
+    if ts, ok := leadingTimestamp([]byte(line)); ok && before > 0 && ts >= before {
+      break
+    }
+    dataPoint, err := processLine([]byte(line))
+    if err != nil {
+      if n > 0 || !strings.HasPrefix(line, "time") {
+        errorLines = append(errorLines, n + 1)
+      }
+      continue
+    }
+    if _, ok := values[dataPoint.location]; !ok {
+      if count >= 0 && len(values) >= count {
+        continue
+      }
+      values[dataPoint.location] = nil
+    }
+    cell := [2]int{dataPoint.location, dataPoint.timestamp}
+    if written[cell] {
+      errorLines = append(errorLines, n + 1)
+      continue
+    }
+    written[cell] = true
+    for len(values[dataPoint.location]) <= dataPoint.timestamp {
+      values[dataPoint.location] = append(values[dataPoint.location], math.NaN())
+    }
+    values[dataPoint.location][dataPoint.timestamp] = dataPoint.temperature
+    if dataPoint.timestamp > maxTimestamp {
+      maxTimestamp = dataPoint.timestamp
+    }
+  }
+  for location := range values {
+    for len(values[location]) <= maxTimestamp {
+      values[location] = append(values[location], math.NaN())
+    }
+  }
+  return values, errorLines
+}
+
+/* Parse inputs in chunks of a few bytes (a line longer than a chunk included) up to a single chunk and compare the
+   dataset and the line numbers of malformed lines and duplicates with a serial parse */
+func TestParseInputChunks(t *testing.T) {
+  input := newTestInput(7, 60, 3)
+  tests := []struct {
+    before int
+    count int
+  }{
+    {-1, -1},
+    {25, -1},
+    {-1, 3},
+    {40, 5},
+  }
+  for _, test := range tests {
+    values, errorLines := parseSerially(input, test.before, test.count)
+    for _, chunkSize := range []int{1, 7, 64, 1000, 1 << 20} {
+      dataset := newDataset(false)
+      lineErrors, _, err := parseInput(strings.NewReader(input), dataset, test.before, test.count, chunkSize)
+      if err != nil {
+        t.Fatalf("before %d, count %d, chunk size %d: %v", test.before, test.count, chunkSize, err)
+      }
+      var lines []int
+      for _, lineError := range lineErrors {
+        lines = append(lines, lineError.line)
+      }
+      if fmt.Sprint(lines) != fmt.Sprint(errorLines) {
+        t.Errorf("before %d, count %d, chunk size %d: malformed lines %v, a serial parse has %v", test.before, test.count, chunkSize, lines, errorLines)
+      }
+      var locations []int
+      for location := range values {
+        locations = append(locations, location)
+      }
+      sort.Ints(locations)
+      if fmt.Sprint(dataset.locations) != fmt.Sprint(locations) {
+        t.Fatalf("before %d, count %d, chunk size %d: locations %v, a serial parse has %v", test.before, test.count, chunkSize, dataset.locations, locations)
+      }
+      var buf []float64
+      for row, location := range dataset.locations {
+        series := dataset.series(row, &buf)
+        if fmt.Sprint(series) != fmt.Sprint(values[location]) {
+          t.Errorf("before %d, count %d, chunk size %d: location %d has %v, a serial parse has %v", test.before, test.count, chunkSize,
+            location, series, values[location])
+        }
+      }
+    }
+  }
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+  "fmt"
+  "time"
+)
+
+/* Get the DFT estimate of the correlation of a pair and its error bound. The estimate never falls below the exact
+   correlation, which is at least estimate - bound */
+func getDFTEstimate(seriesSketches *([]SeriesSketch), bwrdft *BasicWindowDFTResult) (float64, float64) {
+  seriesSketchX := &((*seriesSketches)[bwrdft.pair.indexOfRow])
+  seriesSketchY := &((*seriesSketches)[bwrdft.pair.indexOfCol])
+  estimate := getCorrelationOfWindows(seriesSketchX.slicesOfMean, seriesSketchY.slicesOfMean, seriesSketchX.slicesOfSigma, seriesSketchY.slicesOfSigma,
+    seriesSketchX.slicesOfCount, nil, bwrdft.slicesOfDXY, true)
+  bound := getDFTQueryBound(seriesSketchX, seriesSketchY, bwrdft.slicesOfBound)
+  return estimate, bound
+}
+
+/* Helper function: a pair is a candidate unless its bounds keep |corr| below thres */
+func isCandidate(estimate float64, bound float64, thres float64) bool {
+  return estimate >= thres || estimate - bound <= -thres
+}
+
+/* In-memory exact network construction. Every pair is screened with its DFT estimate and bound, only the candidates
+   are refined with the exact statistics of their basic windows, so the network is the same as with method "t" */
+func networkConstructionFilterRefine(dataset *Dataset, matrix *([][]int), thres float64, granularity int,
+  ratio float64, energy float64, sktechTime *float64, queryTime *float64) {
+  locationsNum := dataset.numOfLocations()
+
+  // Sketch part, only the DFT is computed for every pair
+  t0 := time.Now()
+  seriesSketches := getSeriesSketches(dataset, granularity)
+  seriesDFTs := getSeriesDFTs(dataset, granularity, ratio, energy)
+  var results []BasicWindowDFTResult
+  for i := 0; i < locationsNum; i += 1 {
+    for j := i + 1; j < locationsNum; j += 1 {
+      pair := Pair{dataset.locations[i], dataset.locations[j], i, j}
+      var bwrdft BasicWindowDFTResult
+      getBasicWindowResult(dataset, granularity, &pair, nil, &bwrdft, true, &seriesDFTs)
+      results = append(results, bwrdft)
+    }
+  }
+  elapsed := time.Since(t0)
+  *sktechTime = stringToSeconds(fmt.Sprintf("%v", elapsed))
+  fmt.Println("Sketch time: ", elapsed)
+
+  // Filter part
+  t1 := time.Now()
+  var candidates []Pair
+  for i := range results {
+    estimate, bound := getDFTEstimate(&seriesSketches, &results[i])
+    if isCandidate(estimate, bound, thres) {
+      candidates = append(candidates, results[i].pair)
+    }
+  }
+  filterTime := time.Since(t1)
+
+  // Refine part
+  t2 := time.Now()
+  for i := range candidates {
+    var bwr BasicWindowResult
+    getBasicWindowResult(dataset, granularity, &candidates[i], &bwr, nil, false, nil)
+    updateMatrixBWR(matrix, thres, &(bwr.pair), &seriesSketches, bwr.slicesOfCXY, nil, false, nil)
+  }
+  refineTime := time.Since(t2)
+  elapsed = time.Since(t1)
+  *queryTime = stringToSeconds(fmt.Sprintf("%v", elapsed))
+
+  var pruned float64 = 0
+  if len(results) > 0 {
+    pruned = 100 * float64(len(results) - len(candidates)) / float64(len(results))
+  }
+  fmt.Println(fmt.Sprintf("Filter: %d of %d pairs are candidates (%.1f%% pruned), filter time: %v, refine time: %v",
+    len(candidates), len(results), pruned, filterTime, refineTime))
+  fmt.Println("Query time: ", elapsed)
+}
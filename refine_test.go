@@ -0,0 +1,50 @@
+package main
+
+import (
+  "fmt"
+  "testing"
+)
+
+/* Helper function: an empty adjacency matrix of the locations of dataset */
+func newTestMatrix(dataset *Dataset) [][]int {
+  matrix := make([][]int, dataset.numOfLocations())
+  for i := range matrix {
+    matrix[i] = make([]int, dataset.numOfLocations())
+  }
+  return matrix
+}
+
+/* Filter-and-refine builds the same network as method "t" for tight and loose DFT bounds, with positive and negative
+   correlations */
+func TestFilterRefineExact(t *testing.T) {
+  const granularity = 20
+  dataset := newWalksDataset(8, 30 * granularity + 7, 13)
+  var buf []float64
+  for _, row := range []int{1, 4} {
+    for k, val := range dataset.series(row, &buf) {
+      dataset.set(row, k, -val)
+    }
+  }
+  tests := []struct {
+    thres float64
+    ratio float64
+    energy float64
+  }{
+    {0.1, 0.5, 0},
+    {0.5, 0.1, 0},
+    {0.5, 0.5, 0},
+    {0.8, 0.2, 0},
+    {0.9, 1, 0},
+    {0.7, 0.5, 0.9},
+  }
+  for _, test := range tests {
+    var sketchTime, queryTime float64
+    expected := newTestMatrix(dataset)
+    networkConstructionBWInMemo(dataset, &expected, test.thres, granularity, false, test.ratio, test.energy, nil, nil, "", "", &sketchTime, &queryTime)
+    matrix := newTestMatrix(dataset)
+    networkConstructionFilterRefine(dataset, &matrix, test.thres, granularity, test.ratio, test.energy, &sketchTime, &queryTime)
+    if fmt.Sprint(matrix) != fmt.Sprint(expected) {
+      t.Errorf("thres %v, ratio %v, energy %v: network %v, method t gives %v", test.thres, test.ratio, test.energy, matrix, expected)
+    }
+  }
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+  "math"
+)
+
+/* Running sums of one series over the retained basic windows. Means are taken relative to a fixed reference (the mean
+   when sketching), so that a large offset does not cancel when the sums are combined */
+type SeriesAggregate struct {
+  reference float64
+  count float64      // sum of n
+  sumDelta float64   // sum of n (mean - reference)
+  sumSquares float64 // sum of n (sigma^2 + (mean - reference)^2)
+}
+
+/* Running sum of a pair over the retained basic windows: sum of n (sigmaX sigmaY cXY + deltaX deltaY). For DFT sketches
+   cXY is estimated from dXY */
+type PairAggregate struct {
+  sumCross float64
+}
+
+/* Get the aggregates of every series over all windows of its sketch */
+func getSeriesAggregates(seriesSketches *([]SeriesSketch)) []SeriesAggregate {
+  seriesAggregates := make([]SeriesAggregate, len(*seriesSketches))
+  for row := range seriesAggregates {
+    seriesSketch := &((*seriesSketches)[row])
+    var sum, count float64 = 0, 0
+    for b := range *seriesSketch.slicesOfMean {
+      sum += (*seriesSketch.slicesOfCount)[b] * (*seriesSketch.slicesOfMean)[b]
+      count += (*seriesSketch.slicesOfCount)[b]
+    }
+    if count > 0 {
+      seriesAggregates[row].reference = sum / count
+    }
+    for b := range *seriesSketch.slicesOfMean {
+      seriesAggregates[row].add(seriesSketch, b, 1)
+    }
+  }
+  return seriesAggregates
+}
+
+/* Add (sign 1) or remove (sign -1) basic window b of a series */
+func (aggregate *SeriesAggregate) add(seriesSketch *SeriesSketch, b int, sign float64) {
+  n := (*seriesSketch.slicesOfCount)[b]
+  sigma := (*seriesSketch.slicesOfSigma)[b]
+  delta := (*seriesSketch.slicesOfMean)[b] - aggregate.reference
+  aggregate.count += sign * n
+  aggregate.sumDelta += sign * n * delta
+  aggregate.sumSquares += sign * n * (sigma * sigma + delta * delta)
+}
+
+/* Get the aggregate of a pair over all windows of its sketch, slicesOfXY holds cXY or, with isDFT, dXY */
+func getPairAggregate(pair *Pair, seriesSketches *([]SeriesSketch), seriesAggregates []SeriesAggregate, slicesOfXY *([]float64), isDFT bool) PairAggregate {
+  var aggregate PairAggregate
+  for b := range *slicesOfXY {
+    aggregate.add(&seriesAggregates[pair.indexOfRow], &seriesAggregates[pair.indexOfCol],
+      &((*seriesSketches)[pair.indexOfRow]), &((*seriesSketches)[pair.indexOfCol]), slicesOfXY, b, 1, isDFT)
+  }
+  return aggregate
+}
+
+/* Helper function: cXY of basic window b, estimated from dXY with isDFT like in getCorrelationOfWindows */
+func getWindowCXY(slicesOfXY *([]float64), b int, isDFT bool) float64 {
+  if isDFT {
+    return 1 - 0.5 * (*slicesOfXY)[b] * (*slicesOfXY)[b]
+  }
+  return (*slicesOfXY)[b]
+}
+
+/* Add (sign 1) or remove (sign -1) basic window b of a pair, only the references of the series aggregates are used */
+func (aggregate *PairAggregate) add(seriesAggregateX *SeriesAggregate, seriesAggregateY *SeriesAggregate,
+  seriesSketchX *SeriesSketch, seriesSketchY *SeriesSketch, slicesOfXY *([]float64), b int, sign float64, isDFT bool) {
+  n := (*seriesSketchX.slicesOfCount)[b]
+  deltaX := (*seriesSketchX.slicesOfMean)[b] - seriesAggregateX.reference
+  deltaY := (*seriesSketchY.slicesOfMean)[b] - seriesAggregateY.reference
+  cross := (*seriesSketchX.slicesOfSigma)[b] * (*seriesSketchY.slicesOfSigma)[b] * getWindowCXY(slicesOfXY, b, isDFT)
+  aggregate.sumCross += sign * n * (cross + deltaX * deltaY)
+}
+
+/* Get the windows that updateSlices drops from old and the first window of coming that it keeps. A replaced last
+   window is dropped as well */
+func getSlideRange(numberOfBasicwindows int, numberOfComing int, replaceLast bool) ([]int, int) {
+  kept := numberOfBasicwindows
+  var expired []int
+  if replaceLast {
+    kept -= 1
+    expired = append(expired, numberOfBasicwindows - 1)
+  }
+  drop := kept + numberOfComing - numberOfBasicwindows
+  for b := 0; b < drop && b < kept; b += 1 {
+    expired = append(expired, b)
+  }
+  firstAdded := 0
+  if drop > kept {
+    firstAdded = drop - kept
+  }
+  return expired, firstAdded
+}
+
+/* Slide the aggregate of a series like updateSeriesSketch, in O(1) per expired and coming window */
+func (aggregate *SeriesAggregate) slide(seriesSketchOld *SeriesSketch, seriesSketchComing *SeriesSketch, replaceLast bool) {
+  expired, firstAdded := getSlideRange(len(*seriesSketchOld.slicesOfMean), len(*seriesSketchComing.slicesOfMean), replaceLast)
+  for _, b := range expired {
+    aggregate.add(seriesSketchOld, b, -1)
+  }
+  for b := firstAdded; b < len(*seriesSketchComing.slicesOfMean); b += 1 {
+    aggregate.add(seriesSketchComing, b, 1)
+  }
+}
+
+/* Slide the aggregate of a pair like updateBWR (updateBWRDFT with isDFT), in O(1) per expired and coming window */
+func (aggregate *PairAggregate) slide(seriesAggregateX *SeriesAggregate, seriesAggregateY *SeriesAggregate,
+  seriesSketchXOld *SeriesSketch, seriesSketchYOld *SeriesSketch, slicesOfXYOld *([]float64),
+  seriesSketchXComing *SeriesSketch, seriesSketchYComing *SeriesSketch, slicesOfXYComing *([]float64), replaceLast bool, isDFT bool) {
+  expired, firstAdded := getSlideRange(len(*slicesOfXYOld), len(*slicesOfXYComing), replaceLast)
+  for _, b := range expired {
+    aggregate.add(seriesAggregateX, seriesAggregateY, seriesSketchXOld, seriesSketchYOld, slicesOfXYOld, b, -1, isDFT)
+  }
+  for b := firstAdded; b < len(*slicesOfXYComing); b += 1 {
+    aggregate.add(seriesAggregateX, seriesAggregateY, seriesSketchXComing, seriesSketchYComing, slicesOfXYComing, b, 1, isDFT)
+  }
+}
+
+/* Get the correlation of a pair over the retained windows from the aggregates, it equals getCorrelationOfWindows */
+func getRunningCorrelation(seriesAggregateX *SeriesAggregate, seriesAggregateY *SeriesAggregate, pairAggregate *PairAggregate) float64 {
+  count := seriesAggregateX.count
+  if count <= 0 {
+    return 0
+  }
+  numerator := pairAggregate.sumCross - seriesAggregateX.sumDelta * seriesAggregateY.sumDelta / count
+  demoninator1 := seriesAggregateX.sumSquares - seriesAggregateX.sumDelta * seriesAggregateX.sumDelta / count
+  demoninator2 := seriesAggregateY.sumSquares - seriesAggregateY.sumDelta * seriesAggregateY.sumDelta / count
+  // Rounding of the removed windows may leave a tiny variance for a series that became constant
+  if demoninator1 <= 1e-12 * seriesAggregateX.sumSquares || demoninator2 <= 1e-12 * seriesAggregateY.sumSquares {
+    return 0
+  }
+  return math.Max(-1, math.Min(1, numerator / (math.Sqrt(demoninator1) * math.Sqrt(demoninator2))))
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+  "math"
+  "math/rand"
+  "testing"
+)
+
+/* Correlated random walks with a large offset, row r is a mix of a shared walk and its own */
+func newTestDataset(locationsNum int, length int, seed int64) *Dataset {
+  random := rand.New(rand.NewSource(seed))
+  dataset := newDataset(false)
+  for row := 0; row < locationsNum; row += 1 {
+    dataset.addLocation(100 + row, row, -row, length)
+  }
+  dataset.timestamps = make([]int, length)
+  shared := 0.0
+  own := make([]float64, locationsNum)
+  for k := 0; k < length; k += 1 {
+    dataset.timestamps[k] = k
+    shared += random.NormFloat64()
+    for row := range own {
+      own[row] += random.NormFloat64()
+      weight := float64(row) / float64(locationsNum)
+      dataset.set(row, k, 1e4 + weight * shared + (1 - weight) * own[row] + math.Sin(float64(k) / 7))
+    }
+  }
+  return dataset
+}
+
+/* Sketch dataset from scratch and combine the windows of every pair like the query */
+func getFreshCorrelations(dataset *Dataset, granularity int, isDFT bool, ratio float64) map[Pair]float64 {
+  seriesSketches := getSeriesSketches(dataset, granularity)
+  var seriesDFTs [][][]complex128
+  if isDFT {
+    seriesDFTs = getSeriesDFTs(dataset, granularity, ratio, 0)
+  }
+  correlations := make(map[Pair]float64)
+  for i := range dataset.locations {
+    for j := i + 1; j < len(dataset.locations); j += 1 {
+      pair := Pair{dataset.locations[i], dataset.locations[j], i, j}
+      seriesSketchX := &seriesSketches[i]
+      seriesSketchY := &seriesSketches[j]
+      if !isDFT {
+        var bwr BasicWindowResult
+        getBasicWindowResult(dataset, granularity, &pair, &bwr, nil, false, nil)
+        correlations[pair] = getCorrelationOfWindows(seriesSketchX.slicesOfMean, seriesSketchY.slicesOfMean, seriesSketchX.slicesOfSigma,
+          seriesSketchY.slicesOfSigma, seriesSketchX.slicesOfCount, bwr.slicesOfCXY, nil, false)
+      } else {
+        var bwrdft BasicWindowDFTResult
+        getBasicWindowResult(dataset, granularity, &pair, nil, &bwrdft, true, &seriesDFTs)
+        correlations[pair] = getCorrelationOfWindows(seriesSketchX.slicesOfMean, seriesSketchY.slicesOfMean, seriesSketchX.slicesOfSigma,
+          seriesSketchY.slicesOfSigma, seriesSketchX.slicesOfCount, nil, bwrdft.slicesOfDXY, true)
+      }
+    }
+  }
+  return correlations
+}
+
+/* Slide the running sums through several updates (aligned, partial, completing a partial window and longer than the
+   sketch) and compare every pair with a fresh sketch of the retained basic windows */
+func TestRunningCorrelationSlide(t *testing.T) {
+  const granularity, ratio, locationsNum = 20, 0.4, 5
+  updateLengths := []int{20, 10, 35, 5, 60, 1, 19, 300}
+  total := 410
+  for _, length := range updateLengths {
+    total += length
+  }
+  datasetAll := newTestDataset(locationsNum, total, 7)
+  for _, isDFT := range []bool{false, true} {
+    length := 410
+    dataset := datasetAll.subsequence(0, length)
+    seriesSketches := getSeriesSketches(dataset, granularity)
+    numberOfBasicwindows := len(*seriesSketches[0].slicesOfMean)
+    var seriesDFTs [][][]complex128
+    if isDFT {
+      seriesDFTs = getSeriesDFTs(dataset, granularity, ratio, 0)
+    }
+    seriesAggregates := getSeriesAggregates(&seriesSketches)
+    pairs := getPairsOfLocations(dataset.locations)
+    slicesOfXY := make(map[Pair]*([]float64))
+    pairAggregates := make(map[Pair]*PairAggregate)
+    for _, pair := range pairs {
+      var bwr BasicWindowResult
+      var bwrdft BasicWindowDFTResult
+      getBasicWindowResult(dataset, granularity, &pair, &bwr, &bwrdft, isDFT, &seriesDFTs)
+      slicesOfXY[pair] = bwr.slicesOfCXY
+      if isDFT {
+        slicesOfXY[pair] = bwrdft.slicesOfDXY
+      }
+      pairAggregate := getPairAggregate(&pair, &seriesSketches, seriesAggregates, slicesOfXY[pair], isDFT)
+      pairAggregates[pair] = &pairAggregate
+    }
+    matrix := make([][]int, locationsNum)
+    accurateMatrix := make([][]float64, locationsNum)
+    for row := range matrix {
+      matrix[row] = make([]int, locationsNum)
+      accurateMatrix[row] = make([]float64, locationsNum)
+    }
+
+    for _, updateLength := range updateLengths {
+      datasetNew := datasetAll.subsequence(length, length + updateLength)
+      datasetComing, replaceLast := getComingDataset(dataset, datasetNew, granularity)
+      seriesSketchesComing := getSeriesSketches(datasetComing, granularity)
+      var seriesDFTsComing [][][]complex128
+      if isDFT {
+        seriesDFTsComing = getSeriesDFTsSliding(dataset, datasetNew, granularity, ratio, 0)
+      }
+      seriesAggregatesNew := make([]SeriesAggregate, locationsNum)
+      seriesSketchesNew := make([]SeriesSketch, locationsNum)
+      for row := range seriesAggregatesNew {
+        seriesAggregatesNew[row] = seriesAggregates[row]
+        seriesAggregatesNew[row].slide(&seriesSketches[row], &seriesSketchesComing[row], replaceLast)
+        updateSeriesSketch(&seriesSketchesNew[row], &seriesSketches[row], &seriesSketchesComing[row], replaceLast)
+      }
+      for _, pair := range pairs {
+        var bwr, bwrNew BasicWindowResult
+        var bwrdft, bwrdftNew BasicWindowDFTResult
+        getBasicWindowResult(datasetComing, granularity, &pair, &bwr, &bwrdft, isDFT, &seriesDFTsComing)
+        if !isDFT {
+          pairAggregates[pair].slide(&seriesAggregatesNew[pair.indexOfRow], &seriesAggregatesNew[pair.indexOfCol],
+            &seriesSketches[pair.indexOfRow], &seriesSketches[pair.indexOfCol], slicesOfXY[pair],
+            &seriesSketchesComing[pair.indexOfRow], &seriesSketchesComing[pair.indexOfCol], bwr.slicesOfCXY, replaceLast, false)
+          setCorrelation(&matrix, 0.5, &pair, getRunningCorrelation(&seriesAggregatesNew[pair.indexOfRow], &seriesAggregatesNew[pair.indexOfCol],
+            pairAggregates[pair]), &accurateMatrix)
+          bwrOld := BasicWindowResult{pair, slicesOfXY[pair]}
+          updateBWR(&bwrNew, &bwrOld, &bwr, replaceLast)
+          slicesOfXY[pair] = bwrNew.slicesOfCXY
+        } else {
+          bwrdftOld := BasicWindowDFTResult{pair, slicesOfXY[pair], nil}
+          updateMatrixUpdate(&matrix, 0.5, &pair, &seriesAggregatesNew[pair.indexOfRow], &seriesAggregatesNew[pair.indexOfCol], pairAggregates[pair],
+            &seriesSketches[pair.indexOfRow], &seriesSketches[pair.indexOfCol], &bwrdftOld,
+            &seriesSketchesComing[pair.indexOfRow], &seriesSketchesComing[pair.indexOfCol], &bwrdft, replaceLast, &accurateMatrix)
+          updateBWRDFT(&bwrdftNew, &bwrdftOld, &bwrdft, replaceLast)
+          slicesOfXY[pair] = bwrdftNew.slicesOfDXY
+        }
+      }
+      seriesSketches = seriesSketchesNew
+      seriesAggregates = seriesAggregatesNew
+      length += updateLength
+      dataset = datasetAll.subsequence(0, length)
+
+      // The retained basic windows are the last ones of the split at multiples of granularity
+      end := getNumberOfBasicwindowsOfLength(length, granularity)
+      datasetRetained := datasetAll.subsequence((end - numberOfBasicwindows) * granularity, length)
+      freshCorrelations := getFreshCorrelations(datasetRetained, granularity, isDFT, ratio)
+      for _, pair := range pairs {
+        corr := accurateMatrix[pair.indexOfRow][pair.indexOfCol]
+        if math.Abs(corr - freshCorrelations[pair]) > 1e-9 {
+          t.Errorf("isDFT %t, update of %d values (replaceLast %t): pair %v has %v, a fresh sketch has %v",
+            isDFT, updateLength, replaceLast, pair, corr, freshCorrelations[pair])
+        }
+        if (math.Abs(corr) >= 0.5) != (matrix[pair.indexOfRow][pair.indexOfCol] == 1) {
+          t.Errorf("isDFT %t: pair %v is not connected by its correlation %v", isDFT, pair, corr)
+        }
+      }
+    }
+  }
+}
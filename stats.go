@@ -0,0 +1,112 @@
+package main
+
+import (
+  "fmt"
+  "math"
+)
+
+/* Running moments of a pair of series, accumulated with Welford's method so that large offsets do not cancel */
+type Moments struct {
+  count float64
+  meanX float64
+  meanY float64
+  m2X float64   // sum of squared deviations of x
+  m2Y float64   // sum of squared deviations of y
+  cXY float64   // sum of co-deviations of x and y
+}
+
+/* Add one value to x only */
+func (moments *Moments) addX(x float64) {
+  moments.count += 1
+  deltaX := x - moments.meanX
+  moments.meanX += deltaX / moments.count
+  moments.m2X += deltaX * (x - moments.meanX)
+}
+
+/* Add one pair of values */
+func (moments *Moments) add(x float64, y float64) {
+  moments.count += 1
+  deltaX := x - moments.meanX
+  deltaY := y - moments.meanY
+  moments.meanX += deltaX / moments.count
+  moments.meanY += deltaY / moments.count
+  moments.m2X += deltaX * (x - moments.meanX)
+  moments.m2Y += deltaY * (y - moments.meanY)
+  moments.cXY += deltaX * (y - moments.meanY)
+}
+
+/* Merge the moments of another part of the series (Chan et al.) */
+func (moments *Moments) merge(other *Moments) {
+  if other.count == 0 {
+    return
+  }
+  count := moments.count + other.count
+  deltaX := other.meanX - moments.meanX
+  deltaY := other.meanY - moments.meanY
+  factor := moments.count * other.count / count
+  moments.m2X += other.m2X + deltaX * deltaX * factor
+  moments.m2Y += other.m2Y + deltaY * deltaY * factor
+  moments.cXY += other.cXY + deltaX * deltaY * factor
+  moments.meanX += deltaX * other.count / count
+  moments.meanY += deltaY * other.count / count
+  moments.count = count
+}
+
+/* Population standard deviation of x */
+func (moments *Moments) sigmaX() float64 {
+  if moments.count == 0 || moments.m2X <= 0 {
+    return 0
+  }
+  return math.Sqrt(moments.m2X / moments.count)
+}
+
+/* Population standard deviation of y */
+func (moments *Moments) sigmaY() float64 {
+  if moments.count == 0 || moments.m2Y <= 0 {
+    return 0
+  }
+  return math.Sqrt(moments.m2Y / moments.count)
+}
+
+/* Sum of squares of x, derived from the stable moments */
+func (moments *Moments) sumSquaredX() float64 {
+  return moments.m2X + moments.count * moments.meanX * moments.meanX
+}
+
+/* Pearson correlation of x and y. ok is false when one of them is constant, the correlation is then 0 */
+func (moments *Moments) correlation() (float64, bool) {
+  if moments.m2X <= 0 || moments.m2Y <= 0 {
+    return 0, false
+  }
+  corr := moments.cXY / (math.Sqrt(moments.m2X) * math.Sqrt(moments.m2Y))
+  // Rounding can push the value slightly outside [-1, 1]
+  return math.Max(-1, math.Min(1, corr)), true
+}
+
+/* Get the rows whose series have zero variance */
+func getConstantSeries(dataset *Dataset) []int {
+  var constantRows []int
+  var buf []float64
+  for row := range dataset.locations {
+    var moments Moments
+    for _, val := range dataset.series(row, &buf) {
+      moments.addX(val)
+    }
+    if moments.m2X <= 0 {
+      constantRows = append(constantRows, row)
+    }
+  }
+  return constantRows
+}
+
+/* Report constant series, their correlations are 0 and they never get edges */
+func displayConstantSeries(dataset *Dataset) {
+  constantRows := getConstantSeries(dataset)
+  if len(constantRows) == 0 {
+    return
+  }
+  fmt.Println(fmt.Sprintf("WARNING: %d constant series (zero variance), their correlations are reported as 0:", len(constantRows)))
+  for _, row := range constantRows {
+    fmt.Println(fmt.Sprintf("  row: %d, location: %d", row, dataset.locations[row]))
+  }
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+  "math"
+  "math/rand"
+  "testing"
+)
+
+/* Helper function: mean, population standard deviations and correlation of x and y in two passes */
+func getTwoPassMoments(xs []float64, ys []float64) (float64, float64, float64, float64, float64) {
+  var meanX, meanY float64 = 0, 0
+  for k := range xs {
+    meanX += xs[k]
+    meanY += ys[k]
+  }
+  meanX /= float64(len(xs))
+  meanY /= float64(len(ys))
+  var m2X, m2Y, cXY float64 = 0, 0, 0
+  for k := range xs {
+    m2X += (xs[k] - meanX) * (xs[k] - meanX)
+    m2Y += (ys[k] - meanY) * (ys[k] - meanY)
+    cXY += (xs[k] - meanX) * (ys[k] - meanY)
+  }
+  corr := math.NaN()
+  if m2X > 0 && m2Y > 0 {
+    corr = cXY / math.Sqrt(m2X * m2Y)
+  }
+  return meanX, meanY, math.Sqrt(m2X / float64(len(xs))), math.Sqrt(m2Y / float64(len(ys))), corr
+}
+
+/* Helper function: whether got is within tolerance of expected, relative to the magnitude of expected */
+func isClose(got float64, expected float64, tolerance float64) bool {
+  return math.Abs(got - expected) <= tolerance * math.Max(1, math.Abs(expected))
+}
+
+/* Accumulate series one value at a time and merged from parts, and compare with a two-pass computation */
+func TestMomentsTwoPass(t *testing.T) {
+  random := rand.New(rand.NewSource(5))
+  tests := []struct {
+    name string
+    length int
+    offset float64 // added to every value, a large offset breaks the naive sum of squares
+    constantY bool
+    splits []int // lengths of the parts merged together
+  }{
+    {"single value", 1, 0, false, []int{1}},
+    {"two values", 2, 0, false, []int{1, 1}},
+    {"short", 7, 0, false, []int{3, 0, 4}},
+    {"large offset", 1000, 1e9, false, []int{500, 1, 499}},
+    {"constant y", 50, 1e4, true, []int{10, 40}},
+    {"uneven parts", 365, 273.15, false, []int{1, 2, 300, 62}},
+  }
+  for _, test := range tests {
+    xs := make([]float64, test.length)
+    ys := make([]float64, test.length)
+    for k := range xs {
+      xs[k] = test.offset + random.NormFloat64()
+      ys[k] = test.offset
+      if !test.constantY {
+        ys[k] += 0.6 * (xs[k] - test.offset) + 0.8 * random.NormFloat64()
+      }
+    }
+    meanX, meanY, sigmaX, sigmaY, corr := getTwoPassMoments(xs, ys)
+
+    var whole, onlyX, merged Moments
+    for k := range xs {
+      whole.add(xs[k], ys[k])
+      onlyX.addX(xs[k])
+    }
+    begin := 0
+    for _, length := range test.splits {
+      var part Moments
+      for k := begin; k < begin + length; k += 1 {
+        part.add(xs[k], ys[k])
+      }
+      merged.merge(&part)
+      begin += length
+    }
+
+    for _, moments := range []struct {
+      how string
+      moments *Moments
+    }{{"add", &whole}, {"merge", &merged}} {
+      m := moments.moments
+      if m.count != float64(test.length) || !isClose(m.meanX, meanX, 1e-12) || !isClose(m.meanY, meanY, 1e-12) {
+        t.Errorf("%s, %s: count %v, means %v %v, expected %d, %v %v", test.name, moments.how, m.count, m.meanX, m.meanY,
+          test.length, meanX, meanY)
+      }
+      if !isClose(m.sigmaX(), sigmaX, 1e-6) || !isClose(m.sigmaY(), sigmaY, 1e-6) {
+        t.Errorf("%s, %s: sigmas %v %v, expected %v %v", test.name, moments.how, m.sigmaX(), m.sigmaY(), sigmaX, sigmaY)
+      }
+      got, ok := m.correlation()
+      if ok != !math.IsNaN(corr) || (ok && !isClose(got, corr, 1e-6)) {
+        t.Errorf("%s, %s: correlation %v (%v), expected %v", test.name, moments.how, got, ok, corr)
+      }
+      if !isClose(m.sumSquaredX(), float64(test.length) * (sigmaX * sigmaX + meanX * meanX), 1e-9) {
+        t.Errorf("%s, %s: sum of squares %v, expected %v", test.name, moments.how, m.sumSquaredX(),
+          float64(test.length) * (sigmaX * sigmaX + meanX * meanX))
+      }
+    }
+    if onlyX.count != whole.count || onlyX.meanX != whole.meanX || onlyX.m2X != whole.m2X {
+      t.Errorf("%s: addX gives %+v, add gives %+v", test.name, onlyX, whole)
+    }
+  }
+}
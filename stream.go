@@ -0,0 +1,617 @@
+package main
+
+import (
+  "fmt"
+  "sort"
+  "sync"
+  "time"
+)
+
+/* Edge of the network with its correlation */
+type Edge struct {
+  pair Pair
+  corr float64
+}
+
+/* Long-running network maintenance over a stream of observations. Values are collected per location until the open
+   basic window fills, the window is then closed: every sketch slides by one basic window and the network is queried
+   again. With a half-life, the running sums of "t" decay by every closed window instead of sliding. The latest matrix
+   and edges can be read at any time from other goroutines */
+type StreamEngine struct {
+  mutex sync.RWMutex
+  sendMutex sync.Mutex // held while sending events, keeps them in the order of the windows
+  granularity int
+  thres float64
+  isDFT bool
+  ratio float64
+  energy float64
+  halfLife float64    // 0 for sliding windows
+  decayFactor float64 // weight of a basic window relative to the next one, with a half-life
+  locations []int
+  pairs []Pair
+  seriesSketches []SeriesSketch
+  pairWindowsMap map[Pair]BasicWindowResult
+  pairWindowsMapDFT map[Pair]BasicWindowDFTResult
+  seriesAggregates []SeriesAggregate // running (or decayed) sums, one per location
+  pairAggregates []PairAggregate     // running (or decayed) sums, aligned with pairs
+  plan *FFTPlan
+  seriesDFTs [][][]complex128 // for "d", the spectra of the retained basic windows, indexed by [row][window]
+  window *Dataset           // values of the open basic window, one series per location
+  filled int                // number of values in the open basic window
+  observed int              // number of timestamps consumed, including the sketched ones
+  windowsClosed int
+  matrix [][]int
+  accurateMatrix [][]float64
+  sink EdgeSink // receives the edges added and removed when a window closes, nil for none
+  pendingEvents []EdgeEvent // events of closed windows not sent yet
+  checkpointName string // file of the periodic checkpoints, "" for none
+  checkpointEvery int   // number of closed windows between checkpoints
+  climatologyBefore int // timestamps the climatology of anomaly=t was computed from, stored with the checkpoints
+}
+
+/* Sketch the full basic windows of dataset, the values of a trailing partial basic window open the first window of the stream.
+   halfLife > 0 decays the correlations of "t", see parseHalfLife */
+func newStreamEngine(dataset *Dataset, granularity int, thres float64, isDFT bool, ratio float64, energy float64, halfLife float64) *StreamEngine {
+  numberOfBasicwindows := dataset.length() / granularity
+  if numberOfBasicwindows == 0 {
+    panic("ERROR: the stream needs at least one full basic window to start")
+  }
+  locationsNum := dataset.numOfLocations()
+  engine := StreamEngine{granularity: granularity, thres: thres, isDFT: isDFT, ratio: ratio, energy: energy, halfLife: halfLife,
+    pairWindowsMap: make(map[Pair]BasicWindowResult), pairWindowsMapDFT: make(map[Pair]BasicWindowDFTResult)}
+  if halfLife > 0 {
+    engine.decayFactor = getDecayFactor(granularity, halfLife)
+  }
+  engine.locations = make([]int, locationsNum)
+  getLocations(dataset, &engine.locations)
+  engine.window = newDataset(false)
+  for row := range engine.locations {
+    engine.window.addLocation(dataset.locations[row], dataset.latitudes[row], dataset.longitudes[row], granularity)
+  }
+  engine.window.timestamps = make([]int, granularity)
+  // The window starts with the values of the last full basic window, a missing value takes the value before it
+  for row := range engine.locations {
+    for k := 0; k < granularity; k += 1 {
+      engine.window.set(row, k, dataset.at(row, (numberOfBasicwindows - 1)*granularity + k))
+    }
+  }
+
+  // Sketch the full basic windows only
+  t0 := time.Now()
+  datasetFull := newDataset(dataset.singlePrecision)
+  var buf []float64
+  for row := range engine.locations {
+    datasetFull.addLocation(dataset.locations[row], dataset.latitudes[row], dataset.longitudes[row], numberOfBasicwindows*granularity)
+    for k, val := range dataset.series(row, &buf)[:numberOfBasicwindows*granularity] {
+      datasetFull.set(row, k, val)
+    }
+  }
+  datasetFull.timestamps = dataset.timestamps[:numberOfBasicwindows*granularity]
+  engine.seriesSketches = getSeriesSketches(datasetFull, granularity)
+  if isDFT {
+    engine.seriesDFTs = getSeriesDFTs(datasetFull, granularity, ratio, energy)
+    engine.plan = newFFTPlan(granularity)
+  }
+  for i := 0; i < locationsNum; i += 1 {
+    for j := i + 1; j < locationsNum; j += 1 {
+      pair := Pair{engine.locations[i], engine.locations[j], i, j}
+      engine.pairs = append(engine.pairs, pair)
+      if !isDFT {
+        var bwr BasicWindowResult
+        getBasicWindowResult(datasetFull, granularity, &pair, &bwr, nil, false, nil)
+        engine.pairWindowsMap[pair] = bwr
+      } else {
+        var bwrdft BasicWindowDFTResult
+        getBasicWindowResult(datasetFull, granularity, &pair, nil, &bwrdft, true, &engine.seriesDFTs)
+        engine.pairWindowsMapDFT[pair] = bwrdft
+      }
+    }
+  }
+  if !isDFT && halfLife > 0 {
+    engine.seriesAggregates = getDecayedSeriesAggregates(&engine.seriesSketches, engine.decayFactor)
+    engine.pairAggregates = make([]PairAggregate, len(engine.pairs))
+    for n, pair := range engine.pairs {
+      bwr := engine.pairWindowsMap[pair]
+      engine.pairAggregates[n] = getDecayedPairAggregate(&pair, &engine.seriesSketches, engine.seriesAggregates, bwr.slicesOfCXY, engine.decayFactor)
+    }
+  } else {
+    engine.seriesAggregates = getSeriesAggregates(&engine.seriesSketches)
+    engine.pairAggregates = make([]PairAggregate, len(engine.pairs))
+    for n, pair := range engine.pairs {
+      engine.pairAggregates[n] = getPairAggregate(&pair, &engine.seriesSketches, engine.seriesAggregates, engine.getSlicesOfXY(pair), isDFT)
+    }
+  }
+  fmt.Println("Sketch time: ", time.Since(t0))
+  engine.matrix = make([][]int, locationsNum)
+  engine.accurateMatrix = make([][]float64, locationsNum)
+  for row := range engine.matrix {
+    engine.matrix[row] = make([]int, locationsNum)
+    engine.accurateMatrix[row] = make([]float64, locationsNum)
+  }
+  engine.query()
+
+  // The remaining values open the first basic window of the stream
+  engine.observed = numberOfBasicwindows*granularity
+  observation := make([]float64, locationsNum)
+  for k := numberOfBasicwindows*granularity; k < dataset.length(); k += 1 {
+    for row := range observation {
+      observation[row] = dataset.at(row, k)
+    }
+    engine.push(observation)
+  }
+  return &engine
+}
+
+/* Add one observation, the values of all locations at the next timestamp ordered by row. A missing value (NaN) takes
+   the last value of its location */
+func (engine *StreamEngine) push(observation []float64) {
+  if len(observation) != len(engine.locations) {
+    panic(fmt.Sprintf("ERROR: observation has %d values for %d locations", len(observation), len(engine.locations)))
+  }
+  engine.mutex.Lock()
+  missing := 0
+  for row, val := range observation {
+    if isMissing(val) {
+      // The last value of the location is carried forward, the window holds it at the previous slot
+      val = engine.window.at(row, (engine.filled + engine.granularity - 1) % engine.granularity)
+      missing += 1
+    }
+    engine.window.set(row, engine.filled, val)
+  }
+  if missing > 0 {
+    fmt.Println(fmt.Sprintf("Timestamp %d: %d missing values, the last values of their locations are carried forward", engine.observed, missing))
+  }
+  engine.filled += 1
+  engine.observed += 1
+  closed := engine.filled == engine.granularity
+  if closed {
+    engine.closeWindow()
+    engine.filled = 0
+  }
+  engine.mutex.Unlock()
+  if closed {
+    engine.sendPendingEvents()
+  }
+}
+
+/* Send the events of the closed windows without holding the mutex, so that a slow sink does not block queries and a
+   sink may read the engine */
+func (engine *StreamEngine) sendPendingEvents() {
+  engine.sendMutex.Lock()
+  defer engine.sendMutex.Unlock()
+  engine.mutex.Lock()
+  sink, events := engine.sink, engine.pendingEvents
+  engine.pendingEvents = nil
+  engine.mutex.Unlock()
+  if sink != nil && len(events) > 0 {
+    sink.send(events)
+  }
+}
+
+/* Close the open basic window: slide every sketch by it and query the network again */
+func (engine *StreamEngine) closeWindow() {
+  t0 := time.Now()
+  seriesSketchesComing := getSeriesSketches(engine.window, engine.granularity)
+  seriesSketchesOld := engine.seriesSketches
+  engine.seriesSketches = make([]SeriesSketch, len(seriesSketchesOld))
+  for row := range engine.seriesSketches {
+    updateSeriesSketch(&engine.seriesSketches[row], &seriesSketchesOld[row], &seriesSketchesComing[row], false)
+    if engine.halfLife > 0 {
+      engine.seriesAggregates[row].decay(&seriesSketchesOld[row], &seriesSketchesComing[row], false, engine.decayFactor)
+    } else {
+      engine.seriesAggregates[row].slide(&seriesSketchesOld[row], &seriesSketchesComing[row], false)
+    }
+  }
+  var seriesDFTsComing [][][]complex128
+  if engine.isDFT {
+    // The spectra are computed from the values of the window, so no rounding error builds up over the stream
+    seriesDFTsComing = getSeriesDFTsOfWindow(engine.plan, engine.window, engine.ratio, engine.energy)
+    for row := range engine.seriesDFTs {
+      engine.seriesDFTs[row] = append(engine.seriesDFTs[row][1:], seriesDFTsComing[row][0])
+    }
+  }
+  for n, pair := range engine.pairs {
+    if !engine.isDFT {
+      var bwr, bwrNew BasicWindowResult
+      getBasicWindowResult(engine.window, engine.granularity, &pair, &bwr, nil, false, nil)
+      bwrOld := engine.pairWindowsMap[pair]
+      if engine.halfLife > 0 {
+        engine.pairAggregates[n].decay(&engine.seriesAggregates[pair.indexOfRow], &engine.seriesAggregates[pair.indexOfCol],
+          &seriesSketchesOld[pair.indexOfRow], &seriesSketchesOld[pair.indexOfCol], bwrOld.slicesOfCXY,
+          &seriesSketchesComing[pair.indexOfRow], &seriesSketchesComing[pair.indexOfCol], bwr.slicesOfCXY, false, engine.decayFactor)
+      } else {
+        engine.pairAggregates[n].slide(&engine.seriesAggregates[pair.indexOfRow], &engine.seriesAggregates[pair.indexOfCol],
+          &seriesSketchesOld[pair.indexOfRow], &seriesSketchesOld[pair.indexOfCol], bwrOld.slicesOfCXY,
+          &seriesSketchesComing[pair.indexOfRow], &seriesSketchesComing[pair.indexOfCol], bwr.slicesOfCXY, false, false)
+      }
+      updateBWR(&bwrNew, &bwrOld, &bwr, false)
+      engine.pairWindowsMap[pair] = bwrNew
+    } else {
+      var bwrdft, bwrdftNew BasicWindowDFTResult
+      getBasicWindowResult(engine.window, engine.granularity, &pair, nil, &bwrdft, true, &seriesDFTsComing)
+      bwrdftOld := engine.pairWindowsMapDFT[pair]
+      engine.pairAggregates[n].slide(&engine.seriesAggregates[pair.indexOfRow], &engine.seriesAggregates[pair.indexOfCol],
+        &seriesSketchesOld[pair.indexOfRow], &seriesSketchesOld[pair.indexOfCol], bwrdftOld.slicesOfDXY,
+        &seriesSketchesComing[pair.indexOfRow], &seriesSketchesComing[pair.indexOfCol], bwrdft.slicesOfDXY, false, true)
+      updateBWRDFT(&bwrdftNew, &bwrdftOld, &bwrdft, false)
+      engine.pairWindowsMapDFT[pair] = bwrdftNew
+    }
+  }
+  var oldMatrix [][]int
+  var oldCorr [][]float64
+  if engine.sink != nil {
+    oldMatrix = copyMatrix(engine.matrix)
+    oldCorr = copyFloatMatrix(engine.accurateMatrix)
+  }
+  engine.query()
+  engine.windowsClosed += 1
+  fmt.Println(fmt.Sprintf("Window %d closed: %d edges, update time: %v", engine.windowsClosed, len(engine.getEdgesLocked()), time.Since(t0)))
+  if engine.sink != nil {
+    engine.pendingEvents = append(engine.pendingEvents, getEdgeChanges(engine.observed / engine.granularity - 1, engine.locations, oldMatrix, oldCorr,
+      engine.locations, engine.matrix, engine.accurateMatrix)...)
+  }
+  if engine.checkpointName != "" && engine.windowsClosed % engine.checkpointEvery == 0 {
+    writeCheckpoint(engine.checkpointName, engine.getCheckpoint())
+  }
+}
+
+/* Write a checkpoint to fileName after every closed windows, every 0 stops the checkpoints */
+func (engine *StreamEngine) setCheckpoint(fileName string, every int) {
+  engine.mutex.Lock()
+  defer engine.mutex.Unlock()
+  engine.checkpointName = fileName
+  engine.checkpointEvery = every
+  if every <= 0 {
+    engine.checkpointName = ""
+  }
+}
+
+/* Write a checkpoint of the current state to fileName */
+func (engine *StreamEngine) saveCheckpoint(fileName string) {
+  engine.mutex.RLock()
+  defer engine.mutex.RUnlock()
+  writeCheckpoint(fileName, engine.getCheckpoint())
+}
+
+/* Helper function: get the state of the engine, the caller holds the mutex. The checkpoint shares the slices of the
+   engine, it is written before the engine changes */
+func (engine *StreamEngine) getCheckpoint() *SketchCheckpoint {
+  checkpoint := SketchCheckpoint{granularity: engine.granularity, isDFT: engine.isDFT, ratio: engine.ratio, energy: engine.energy, halfLife: engine.halfLife,
+    locations: engine.locations, latitudes: engine.window.latitudes, longitudes: engine.window.longitudes,
+    seriesSketches: engine.seriesSketches, pairWindowsMap: engine.pairWindowsMap, pairWindowsMapDFT: engine.pairWindowsMapDFT,
+    accurateMatrix: engine.accurateMatrix}
+  stream := StreamCheckpoint{observed: engine.observed, filled: engine.filled, windowsClosed: engine.windowsClosed, climatologyBefore: engine.climatologyBefore,
+    window: engine.window.values, seriesAggregates: engine.seriesAggregates, pairAggregates: engine.pairAggregates,
+    seriesDFTs: engine.seriesDFTs}
+  checkpoint.stream = &stream
+  return &checkpoint
+}
+
+/* Restore an engine from a checkpoint of a stream, it continues at the observation after the consumed ones. The network
+   is rebuilt from the stored correlations with thres */
+func restoreStreamEngine(fileName string, granularity int, thres float64, isDFT bool, ratio float64, energy float64, halfLife float64) *StreamEngine {
+  checkpoint := readCheckpoint(fileName)
+  checkpoint.checkParameters(granularity, isDFT, ratio, energy, halfLife)
+  stream := checkpoint.stream
+  if stream == nil {
+    panic(fmt.Sprintf("ERROR: checkpoint %s is not a checkpoint of a stream", fileName))
+  }
+  engine := StreamEngine{granularity: granularity, thres: thres, isDFT: isDFT, ratio: ratio, energy: energy, halfLife: halfLife,
+    locations: checkpoint.locations, pairs: getPairsOfLocations(checkpoint.locations), seriesSketches: checkpoint.seriesSketches,
+    pairWindowsMap: checkpoint.pairWindowsMap, pairWindowsMapDFT: checkpoint.pairWindowsMapDFT,
+    seriesAggregates: stream.seriesAggregates, pairAggregates: stream.pairAggregates, seriesDFTs: stream.seriesDFTs,
+    filled: stream.filled, observed: stream.observed, windowsClosed: stream.windowsClosed, climatologyBefore: stream.climatologyBefore,
+    accurateMatrix: checkpoint.accurateMatrix}
+  if halfLife > 0 {
+    engine.decayFactor = getDecayFactor(granularity, halfLife)
+  }
+  engine.window = newDataset(false)
+  for row, location := range engine.locations {
+    engine.window.addLocation(location, checkpoint.latitudes[row], checkpoint.longitudes[row], granularity)
+    copy(engine.window.values[row], stream.window[row])
+  }
+  engine.window.timestamps = make([]int, granularity)
+  if isDFT {
+    engine.plan = newFFTPlan(granularity)
+  }
+  engine.matrix = make([][]int, len(engine.locations))
+  for row := range engine.matrix {
+    engine.matrix[row] = make([]int, len(engine.locations))
+  }
+  for _, pair := range engine.pairs {
+    setCorrelation(&engine.matrix, thres, &pair, engine.accurateMatrix[pair.indexOfRow][pair.indexOfCol], nil)
+  }
+  fmt.Println(fmt.Sprintf("Stream restored after %d timestamps and %d closed windows: %d edges", engine.observed, engine.windowsClosed,
+    len(engine.getEdgesLocked())))
+  return &engine
+}
+
+/* Send the edges added and removed by every closed window to sink, nil stops the events */
+func (engine *StreamEngine) setEdgeSink(sink EdgeSink) {
+  engine.mutex.Lock()
+  defer engine.mutex.Unlock()
+  engine.sink = sink
+  engine.pendingEvents = nil
+}
+
+/* Query every pair over the retained basic windows from the running sums of the pairs */
+func (engine *StreamEngine) query() {
+  clearMatrix(&engine.matrix)
+  for n, pair := range engine.pairs {
+    corr := getRunningCorrelation(&engine.seriesAggregates[pair.indexOfRow], &engine.seriesAggregates[pair.indexOfCol], &engine.pairAggregates[n])
+    setCorrelation(&engine.matrix, engine.thres, &pair, corr, &engine.accurateMatrix)
+  }
+}
+
+/* Helper function: get the cross terms of a pair, cXY for "t" and dXY for "d" */
+func (engine *StreamEngine) getSlicesOfXY(pair Pair) *([]float64) {
+  if engine.isDFT {
+    return engine.pairWindowsMapDFT[pair].slicesOfDXY
+  }
+  return engine.pairWindowsMap[pair].slicesOfCXY
+}
+
+/* Add a location to the live sketch, its pairs with every location of the engine are sketched over the retained basic
+   windows. dataset holds the values of the location and of the engine's locations from the start of the stream on.
+   Rows stay ordered by location, the rows after the new one move by one */
+func (engine *StreamEngine) addLocation(dataset *Dataset, location int) {
+  engine.mutex.Lock()
+  defer engine.mutex.Unlock()
+  t0 := time.Now()
+  if engine.indexOf(location) >= 0 {
+    panic(fmt.Sprintf("ERROR: location %d is already in the sketch", location))
+  }
+  if engine.halfLife > 0 {
+    // The decayed sums of the other locations cover windows that are no longer retained
+    panic("ERROR: locations cannot be added to decayed correlations")
+  }
+  if dataset.length() < engine.observed {
+    panic(fmt.Sprintf("ERROR: the values of location %d do not cover the %d consumed timestamps", location, engine.observed))
+  }
+  locations := append(append([]int(nil), engine.locations...), location)
+  sort.Ints(locations)
+  newRow := sort.SearchInts(locations, location)
+  oldRows := make([]int, len(locations))
+  for row := range oldRows {
+    if row < newRow {
+      oldRows[row] = row
+    } else if row == newRow {
+      oldRows[row] = -1
+    } else {
+      oldRows[row] = row - 1
+    }
+  }
+
+  // Values of the retained basic windows
+  numberOfBasicwindows := len(*engine.seriesSketches[0].slicesOfMean)
+  end := engine.observed - engine.filled
+  datasetLocations := dataset.selectLocations(locations)
+  datasetRetained := datasetLocations.subsequence(end - numberOfBasicwindows*engine.granularity, end)
+
+  // Only the new location is sketched, the pairs read the spectra of the other locations from the engine
+  datasetLocation := datasetRetained.selectLocations([]int{location})
+  seriesSketchesLocation := getSeriesSketches(datasetLocation, engine.granularity)
+  var seriesDFTsLocation [][][]complex128
+  if engine.isDFT {
+    var buf []float64
+    seriesDFTsLocation = [][][]complex128{getSeriesDFT(engine.plan, nil, datasetLocation.series(0, &buf), engine.granularity, engine.ratio, engine.energy)}
+    if engine.energy > 0 {
+      // The location keeps the coefficients reaching the energy in its own windows, a pair compares the common ones
+      truncateSpectra(seriesDFTsLocation, engine.energy)
+    }
+  }
+
+  seriesSketches := make([]SeriesSketch, len(locations))
+  seriesAggregates := make([]SeriesAggregate, len(locations))
+  var seriesDFTsMoved [][][]complex128
+  if engine.isDFT {
+    seriesDFTsMoved = make([][][]complex128, len(locations))
+  }
+  window := newDataset(false)
+  window.timestamps = make([]int, engine.granularity)
+  for row, oldRow := range oldRows {
+    window.addLocation(locations[row], datasetLocations.latitudes[row], datasetLocations.longitudes[row], engine.granularity)
+    if oldRow >= 0 {
+      seriesSketches[row] = engine.seriesSketches[oldRow]
+      seriesAggregates[row] = engine.seriesAggregates[oldRow]
+      if engine.isDFT {
+        seriesDFTsMoved[row] = engine.seriesDFTs[oldRow]
+      }
+      for k := 0; k < engine.granularity; k += 1 {
+        window.set(row, k, engine.window.at(oldRow, k))
+      }
+      continue
+    }
+    seriesSketches[row] = seriesSketchesLocation[0]
+    seriesAggregates[row] = getSeriesAggregates(&seriesSketchesLocation)[0]
+    if engine.isDFT {
+      seriesDFTsMoved[row] = seriesDFTsLocation[0]
+    }
+    // The slots after the filled ones keep the values of the last closed window, like the other locations
+    for k := 0; k < engine.granularity; k += 1 {
+      if k < engine.filled {
+        window.set(row, k, datasetLocations.at(row, end + k))
+      } else {
+        window.set(row, k, datasetLocations.at(row, end - engine.granularity + k))
+      }
+    }
+  }
+  engine.seriesSketches = seriesSketches
+  engine.seriesAggregates = seriesAggregates
+  engine.seriesDFTs = seriesDFTsMoved
+  engine.window = window
+  engine.rebuildPairs(locations, oldRows, func(pair *Pair) (BasicWindowResult, BasicWindowDFTResult) {
+    var bwr BasicWindowResult
+    var bwrdft BasicWindowDFTResult
+    if !engine.isDFT {
+      getBasicWindowResult(datasetRetained, engine.granularity, pair, &bwr, nil, false, nil)
+    } else {
+      getBasicWindowResult(datasetRetained, engine.granularity, pair, nil, &bwrdft, true, &engine.seriesDFTs)
+    }
+    return bwr, bwrdft
+  })
+  engine.query()
+  fmt.Println(fmt.Sprintf("Location %d added at row %d: %d pairs sketched, %d edges, time: %v", location, newRow, len(locations) - 1,
+    len(engine.getEdgesLocked()), time.Since(t0)))
+}
+
+/* Remove a location from the live sketch with its pairs and its row and column of the matrix, the rows after it move by one */
+func (engine *StreamEngine) removeLocation(location int) {
+  engine.mutex.Lock()
+  defer engine.mutex.Unlock()
+  t0 := time.Now()
+  removedRow := engine.indexOf(location)
+  if removedRow < 0 {
+    panic(fmt.Sprintf("ERROR: location %d is not in the sketch", location))
+  }
+  if len(engine.locations) <= 2 {
+    panic("ERROR: the sketch needs at least two locations")
+  }
+  locations := make([]int, 0, len(engine.locations) - 1)
+  oldRows := make([]int, 0, len(engine.locations) - 1)
+  for row, oldLocation := range engine.locations {
+    if row != removedRow {
+      locations = append(locations, oldLocation)
+      oldRows = append(oldRows, row)
+    }
+  }
+  seriesSketches := make([]SeriesSketch, len(locations))
+  for row, oldRow := range oldRows {
+    seriesSketches[row] = engine.seriesSketches[oldRow]
+  }
+  engine.seriesSketches = seriesSketches
+  seriesAggregates := make([]SeriesAggregate, len(locations))
+  for row, oldRow := range oldRows {
+    seriesAggregates[row] = engine.seriesAggregates[oldRow]
+  }
+  engine.seriesAggregates = seriesAggregates
+  if engine.isDFT {
+    seriesDFTs := make([][][]complex128, len(locations))
+    for row, oldRow := range oldRows {
+      seriesDFTs[row] = engine.seriesDFTs[oldRow]
+    }
+    engine.seriesDFTs = seriesDFTs
+  }
+  engine.window = engine.window.selectLocations(locations)
+  engine.rebuildPairs(locations, oldRows, nil)
+  engine.query()
+  fmt.Println(fmt.Sprintf("Location %d removed from row %d: %d edges, time: %v", location, removedRow, len(engine.getEdgesLocked()), time.Since(t0)))
+}
+
+/* Helper function: move the statistics of the pairs to the rows of locations. oldRows maps every row to its row before
+   the change, -1 for an added location whose pairs are sketched by sketchPair. Pairs of a removed location are dropped,
+   the matrices are resized. The series sketches are already moved */
+func (engine *StreamEngine) rebuildPairs(locations []int, oldRows []int, sketchPair func(pair *Pair) (BasicWindowResult, BasicWindowDFTResult)) {
+  indexOfPair := make(map[Pair]int, len(engine.pairs))
+  for n, pair := range engine.pairs {
+    indexOfPair[pair] = n
+  }
+  var pairs []Pair
+  var pairAggregates []PairAggregate
+  pairWindowsMap := make(map[Pair]BasicWindowResult)
+  pairWindowsMapDFT := make(map[Pair]BasicWindowDFTResult)
+  for i := range locations {
+    for j := i + 1; j < len(locations); j += 1 {
+      pair := Pair{locations[i], locations[j], i, j}
+      pairs = append(pairs, pair)
+      if oldRows[i] < 0 || oldRows[j] < 0 {
+        bwr, bwrdft := sketchPair(&pair)
+        if !engine.isDFT {
+          pairWindowsMap[pair] = bwr
+          pairAggregates = append(pairAggregates, getPairAggregate(&pair, &engine.seriesSketches, engine.seriesAggregates, bwr.slicesOfCXY, false))
+        } else {
+          pairWindowsMapDFT[pair] = bwrdft
+          pairAggregates = append(pairAggregates, getPairAggregate(&pair, &engine.seriesSketches, engine.seriesAggregates, bwrdft.slicesOfDXY, true))
+        }
+        continue
+      }
+      oldPair := Pair{locations[i], locations[j], oldRows[i], oldRows[j]}
+      pairAggregates = append(pairAggregates, engine.pairAggregates[indexOfPair[oldPair]])
+      if !engine.isDFT {
+        bwr := engine.pairWindowsMap[oldPair]
+        bwr.pair = pair
+        pairWindowsMap[pair] = bwr
+      } else {
+        bwrdft := engine.pairWindowsMapDFT[oldPair]
+        bwrdft.pair = pair
+        pairWindowsMapDFT[pair] = bwrdft
+      }
+    }
+  }
+  engine.locations = locations
+  engine.pairs = pairs
+  engine.pairAggregates = pairAggregates
+  engine.pairWindowsMap = pairWindowsMap
+  engine.pairWindowsMapDFT = pairWindowsMapDFT
+  engine.matrix = make([][]int, len(locations))
+  engine.accurateMatrix = make([][]float64, len(locations))
+  for row := range engine.matrix {
+    engine.matrix[row] = make([]int, len(locations))
+    engine.accurateMatrix[row] = make([]float64, len(locations))
+  }
+}
+
+/* Helper function: get the row of a location, -1 if it is not in the sketch */
+func (engine *StreamEngine) indexOf(location int) int {
+  for row, engineLocation := range engine.locations {
+    if engineLocation == location {
+      return row
+    }
+  }
+  return -1
+}
+
+/* Get the locations of the sketch, ordered by row */
+func (engine *StreamEngine) getLocations() []int {
+  engine.mutex.RLock()
+  defer engine.mutex.RUnlock()
+  return append([]int(nil), engine.locations...)
+}
+
+/* Consume observations until the channel is closed */
+func (engine *StreamEngine) run(observations <-chan []float64) {
+  for observation := range observations {
+    engine.push(observation)
+  }
+}
+
+/* Get a copy of the latest matrix */
+func (engine *StreamEngine) getMatrix() [][]int {
+  engine.mutex.RLock()
+  defer engine.mutex.RUnlock()
+  matrix := make([][]int, len(engine.matrix))
+  for row := range matrix {
+    matrix[row] = append([]int(nil), engine.matrix[row]...)
+  }
+  return matrix
+}
+
+/* Get the latest edges with their correlations */
+func (engine *StreamEngine) getEdges() []Edge {
+  engine.mutex.RLock()
+  defer engine.mutex.RUnlock()
+  return engine.getEdgesLocked()
+}
+
+/* Helper function: get the edges, the caller holds the mutex */
+func (engine *StreamEngine) getEdgesLocked() []Edge {
+  var edges []Edge
+  for _, pair := range engine.pairs {
+    if engine.matrix[pair.indexOfRow][pair.indexOfCol] == 1 {
+      edges = append(edges, Edge{pair, engine.accurateMatrix[pair.indexOfRow][pair.indexOfCol]})
+    }
+  }
+  return edges
+}
+
+/* Send the observations of dataset from timestamp start on, then close the channel */
+func streamDataset(dataset *Dataset, start int, observations chan<- []float64) {
+  for k := start; k < dataset.length(); k += 1 {
+    observation := make([]float64, dataset.numOfLocations())
+    for row := range observation {
+      observation[row] = dataset.at(row, k)
+    }
+    observations <- observation
+  }
+  close(observations)
+}